@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/executor"
+)
+
+// capabilityFullResync is how often the complete capability set is sent even when the
+// server acknowledged every change (e.g. its database was restored meanwhile)
+const capabilityFullResync = 12 * time.Hour
+
+// capabilitySync tracks the capability sections the server holds, so heartbeats only
+// carry what changed. Only used from the Run loop.
+type capabilitySync struct {
+	acked  map[string]string // section -> hash acknowledged by the server
+	fullAt time.Time         // last acknowledged complete set
+}
+
+// update returns the capability part of the next heartbeat
+func (s *capabilitySync) update(r executor.CapabilityReport) api.CapabilityUpdate {
+	u := api.CapabilityUpdate{Hash: r.Hash}
+	if s.acked == nil || time.Since(s.fullAt) >= capabilityFullResync {
+		u.Sections = r.Sections
+		return u
+	}
+
+	for name, hash := range r.Hashes {
+		if s.acked[name] != hash {
+			if u.Sections == nil {
+				u.Sections = make(map[string]interface{})
+			}
+			u.Sections[name] = r.Sections[name]
+		}
+	}
+	u.Partial = u.Sections != nil
+	return u
+}
+
+// acknowledge records the heartbeat response: a server echoing the hash holds the
+// complete set of r; any other answer means everything is sent again next time.
+func (s *capabilitySync) acknowledge(r executor.CapabilityReport, u api.CapabilityUpdate, resp *api.HeartbeatResponse) {
+	if resp == nil || resp.CapabilitiesHash != r.Hash {
+		s.acked = nil
+		return
+	}
+	if s.acked == nil || !u.Partial && u.Sections != nil {
+		s.fullAt = time.Now()
+	}
+	s.acked = r.Hashes
+}
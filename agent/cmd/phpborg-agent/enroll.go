@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/cert"
+	"github.com/phpborg/phpborg-agent/internal/config"
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+	"github.com/phpborg/phpborg-agent/internal/platform"
+)
+
+// runEnroll implements "phpborg-agent enroll": it generates the agent identity and keys
+// locally, registers with the server using its agent registration token and writes the
+// configuration, replacing the bash installer.
+func runEnroll(args []string) error {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	serverURL := fs.String("server", "", "phpBorg server URL (e.g. https://phpborg.example.com)")
+	token := fs.String("token", "", "Agent registration token of the server (Settings > Agents)")
+	name := fs.String("name", "", "Agent name (default: hostname)")
+	configPath := fs.String("config", config.GetDefaultConfigPath(), "Path of the configuration file to write")
+	serverCA := fs.String("server-ca", "", "CA bundle to verify the server with (private PKI)")
+	proxyURL := fs.String("proxy", "", "Egress proxy for API traffic (http://host:port or socks5://host:port)")
+	insecure := fs.Bool("insecure", false, "Skip server TLS verification (development only)")
+	install := fs.Bool("install", false, "Install and enable the system service afterwards")
+	force := fs.Bool("force", false, "Overwrite an existing configuration")
+	fs.Parse(args)
+
+	if *serverURL == "" || *token == "" {
+		return errors.New("--server and --token are required")
+	}
+	if _, err := os.Stat(*configPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists (agent already enrolled?), use --force to overwrite", *configPath)
+	}
+
+	hostname, _ := os.Hostname()
+	if *name == "" {
+		*name = hostname
+	}
+	agentUUID, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = apiURL(*serverURL)
+	cfg.Server.InsecureSkipVerify = *insecure
+	cfg.TLS.ServerCAFile = *serverCA
+	cfg.Proxy.URL = *proxyURL
+	cfg.Agent.UUID = agentUUID
+	cfg.Agent.Name = *name
+	cfg.Agent.Version = Version
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Borg SSH key, same location as the bash installer used
+	if err := os.MkdirAll(cfg.Agent.DataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	sshKeyPath := filepath.Join(cfg.Agent.DataDir, ".ssh", "id_ed25519")
+	if _, err := os.Stat(sshKeyPath); os.IsNotExist(err) {
+		if err := platform.Current.GenerateSSHKey(ctx, sshKeyPath); err != nil {
+			return err
+		}
+		fmt.Printf("SSH key generated: %s\n", sshKeyPath)
+	}
+	sshPublicKey, err := os.ReadFile(sshKeyPath + ".pub")
+	if err != nil {
+		return fmt.Errorf("failed to read SSH public key: %w", err)
+	}
+
+	// TLS key pair: only the CSR leaves the host
+	key, err := cert.GenerateKey()
+	if err != nil {
+		return err
+	}
+	csr, err := cert.CreateCSR(key, agentUUID)
+	if err != nil {
+		return err
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create API client: %w", err)
+	}
+
+	fmt.Printf("Enrolling agent %s (%s) with %s...\n", *name, agentUUID, cfg.Server.URL)
+	enrollment, err := client.Enroll(ctx, &api.EnrollRequest{
+		RegistrationToken: *token,
+		UUID:              agentUUID,
+		Name:              *name,
+		Hostname:          hostname,
+		OS:                runtime.GOOS,
+		Arch:              runtime.GOARCH,
+		Version:           Version,
+		SSHPublicKey:      strings.TrimSpace(string(sshPublicKey)),
+		CSR:               string(csr),
+	})
+	if err != nil {
+		return fmt.Errorf("enrollment failed: %w", err)
+	}
+
+	if err := enrollment.AgentToken.Save(cfg.TokenFilePath()); err != nil {
+		return fmt.Errorf("failed to save agent token: %w", err)
+	}
+
+	cfg.BorgSSH.Host = enrollment.BorgHost
+	if enrollment.BorgPort > 0 {
+		cfg.BorgSSH.Port = enrollment.BorgPort
+	}
+	if enrollment.BorgUser != "" {
+		cfg.BorgSSH.User = enrollment.BorgUser
+	}
+	cfg.BorgSSH.PrivateKeyPath = sshKeyPath
+	cfg.BorgSSH.BackupPath = enrollment.BackupPath
+
+	if enrollment.TLSCert != "" {
+		if err := writeEnrollmentCerts(cfg, filepath.Join(filepath.Dir(*configPath), "certs"), key, enrollment); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*configPath), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err := cfg.SaveToFile(*configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Agent enrolled, configuration written to %s\n", *configPath)
+
+	if *install {
+		return installAsService(*configPath)
+	}
+	return nil
+}
+
+// writeEnrollmentCerts installs the issued certificate, the CA and the local key, and
+// enables mTLS in cfg
+func writeEnrollmentCerts(cfg *config.Config, certsDir string, key *ecdsa.PrivateKey, enrollment *api.EnrollResponse) error {
+	certPEM := []byte(enrollment.TLSCert)
+	caPEM := []byte(enrollment.CACert)
+	keyPEM, err := cert.EncodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := cert.VerifyKeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(certsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create certificates directory: %w", err)
+	}
+	cfg.TLS.CertFile = filepath.Join(certsDir, "agent.crt")
+	cfg.TLS.KeyFile = filepath.Join(certsDir, "agent.key")
+	cfg.TLS.CAFile = filepath.Join(certsDir, "ca.crt")
+
+	if err := fileutil.WriteAtomic(cfg.TLS.KeyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := fileutil.WriteAtomic(cfg.TLS.CertFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if err := fileutil.WriteAtomic(cfg.TLS.CAFile, caPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write CA: %w", err)
+	}
+	return nil
+}
+
+// apiURL turns the server URL into the API base URL
+func apiURL(serverURL string) string {
+	u := strings.TrimRight(serverURL, "/")
+	if !strings.HasSuffix(u, "/api") {
+		u += "/api"
+	}
+	return u
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/metrics"
+)
+
+const (
+	// Bounds applied to the heartbeat interval asked by the server
+	minHeartbeatInterval = 10 * time.Second
+	maxHeartbeatInterval = 15 * time.Minute
+
+	// clockSkewWarning is the skew from which the clock is reported as wrong:
+	// certificate validity checks and archive timestamps are affected
+	clockSkewWarning = 30 * time.Second
+)
+
+// heartbeatState is what the agent learnt from heartbeat responses
+type heartbeatState struct {
+	mu             sync.Mutex
+	serverInterval time.Duration // asked by the server (0 = none, use the config)
+	skew           *time.Duration
+	skewWarned     bool
+}
+
+// heartbeatInterval returns the interval asked by the server (agent.heartbeat_interval
+// setting), or the configured one when the server asks for none
+func (a *Agent) heartbeatInterval() time.Duration {
+	a.heartbeat.mu.Lock()
+	interval := a.heartbeat.serverInterval
+	a.heartbeat.mu.Unlock()
+	if interval > 0 {
+		return interval
+	}
+
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config.Polling.HeartbeatInterval
+}
+
+// clockSkew returns the last measured clock skew (server minus agent), nil if unknown
+func (a *Agent) clockSkew() *time.Duration {
+	a.heartbeat.mu.Lock()
+	defer a.heartbeat.mu.Unlock()
+	if a.heartbeat.skew == nil {
+		return nil
+	}
+	skew := *a.heartbeat.skew
+	return &skew
+}
+
+// recordHeartbeatResponse applies the interval asked by the server, or goes back to
+// the configured one when the response carries none, and measures the clock skew.
+// sentAt and receivedAt frame the request.
+func (a *Agent) recordHeartbeatResponse(resp *api.HeartbeatResponse, sentAt, receivedAt time.Time) {
+	h := &a.heartbeat
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var interval time.Duration
+	if resp.NextHeartbeatIn > 0 {
+		interval = time.Duration(resp.NextHeartbeatIn) * time.Second
+		if interval < minHeartbeatInterval {
+			interval = minHeartbeatInterval
+		}
+		if interval > maxHeartbeatInterval {
+			interval = maxHeartbeatInterval
+		}
+	}
+	if interval != h.serverInterval {
+		if interval > 0 {
+			slog.Info("Server sets the heartbeat interval", logging.ComponentKey, "HEARTBEAT", "interval", interval)
+		} else {
+			slog.Info("Server no longer sets the heartbeat interval, using polling.heartbeat_interval", logging.ComponentKey, "HEARTBEAT")
+		}
+		h.serverInterval = interval
+	}
+
+	serverTime, err := time.Parse(time.RFC3339, resp.ServerTime)
+	if err != nil {
+		return // missing or unparsable: the skew stays unknown
+	}
+	// The server stamped the response somewhere during the round trip, with second
+	// precision: compare with the middle of the request, half a second in.
+	local := sentAt.Add(receivedAt.Sub(sentAt) / 2)
+	skew := serverTime.Add(500 * time.Millisecond).Sub(local).Round(100 * time.Millisecond)
+	h.skew = &skew
+	metrics.ClockSkew.Set(skew.Seconds())
+
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs >= clockSkewWarning && !h.skewWarned:
+		h.skewWarned = true
+		direction := "behind"
+		if skew < 0 {
+			direction = "ahead of"
+		}
+		slog.Warn("Local clock is off: certificate checks and archive timestamps will be wrong (check NTP)", logging.ComponentKey, "HEARTBEAT", "skew", abs, "direction", direction+" the server clock")
+	case abs < clockSkewWarning && h.skewWarned:
+		h.skewWarned = false
+		slog.Info("Clock back in sync with the server", logging.ComponentKey, "HEARTBEAT", "skew", skew)
+	}
+}
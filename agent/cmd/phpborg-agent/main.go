@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -15,12 +20,40 @@ import (
 	"github.com/phpborg/phpborg-agent/internal/cert"
 	"github.com/phpborg/phpborg-agent/internal/config"
 	"github.com/phpborg/phpborg-agent/internal/executor"
+	"github.com/phpborg/phpborg-agent/internal/ledger"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/metrics"
+	"github.com/phpborg/phpborg-agent/internal/offline"
+	"github.com/phpborg/phpborg-agent/internal/queue"
+	"github.com/phpborg/phpborg-agent/internal/secrets"
+	"github.com/phpborg/phpborg-agent/internal/spool"
+	"github.com/phpborg/phpborg-agent/internal/status"
 	"github.com/phpborg/phpborg-agent/internal/task"
 )
 
 const Version = "2.4.9"
 
+// ledgerRetention is how long the outcome of an executed task answers its re-deliveries
+const ledgerRetention = 7 * 24 * time.Hour
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "enroll":
+			if err := runEnroll(os.Args[2:]); err != nil {
+				log.Fatalf("Enrollment failed: %v", err)
+			}
+			os.Exit(0)
+		case "status":
+			if err := runStatus(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	// Parse command line flags
 	configPath := flag.String("config", config.GetDefaultConfigPath(), "Path to configuration file")
 	showVersion := flag.Bool("version", false, "Show version and exit")
@@ -35,7 +68,7 @@ func main() {
 
 	// Handle service installation/uninstallation
 	if *installService {
-		if err := installAsService(); err != nil {
+		if err := installAsService(*configPath); err != nil {
 			log.Fatalf("Failed to install service: %v", err)
 		}
 		fmt.Println("Service installed successfully")
@@ -60,20 +93,17 @@ func main() {
 	cfg.Agent.Version = Version
 
 	// Setup logging
-	if cfg.Logging.File != "" {
-		f, err := os.OpenFile(cfg.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatalf("Failed to open log file: %v", err)
-		}
-		defer f.Close()
-		log.SetOutput(f)
+	logs, err := logging.Setup(cfg.Logging)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
 	}
+	defer logs.Close()
 
 	log.Println("============================================================")
 	log.Printf("  phpBorg Agent v%s", Version)
 	log.Println("============================================================")
 	log.Printf("[AGENT] Agent: %s (%s)", cfg.Agent.Name, cfg.Agent.UUID)
-	log.Printf("[AGENT] Server URL: %s", cfg.Server.URL)
+	log.Printf("[AGENT] Server URL: %s", strings.Join(cfg.Server.URLList(), ", "))
 
 	// Create API client
 	client, err := api.NewClient(cfg)
@@ -85,31 +115,112 @@ func main() {
 	// Create executor
 	exec := executor.NewExecutor(cfg)
 
+	// Running tasks and heartbeats as shown by the local status API
+	tracker := status.NewTracker()
+	client.SetProgressObserver(tracker.TaskProgress)
+
+	// Open the result spool (outcomes not yet reported to the server)
+	resultSpool, err := spool.Open(filepath.Join(cfg.Agent.DataDir, "spool"), client)
+	if err != nil {
+		log.Fatalf("[AGENT] Failed to open result spool: %v", err)
+	}
+
+	// Open the ledger of executed tasks (answers re-deliveries)
+	taskLedger, err := ledger.Open(filepath.Join(cfg.Agent.DataDir, "ledger"), ledgerRetention)
+	if err != nil {
+		log.Fatalf("[AGENT] Failed to open task ledger: %v", err)
+	}
+
 	// Create task handler
-	handler := task.NewHandler(cfg, client, exec)
+	handler := task.NewHandler(cfg, client, exec, resultSpool, taskLedger)
 
 	// Create certificate renewer for auto-renewal
 	certRenewer := cert.NewRenewer(cfg, client)
 
+	// Open the durable task queue
+	taskQueue, interrupted, err := queue.Open(filepath.Join(cfg.Agent.DataDir, "queue"))
+	if err != nil {
+		log.Fatalf("[AGENT] Failed to open task queue: %v", err)
+	}
+	taskQueue.SetClasses(task.Classes())
+	taskQueue.SetSerialKey(task.SerialKey)
+	taskQueue.SetLimits(cfg.Agent.TaskLimits)
+	interruptedTasks := make([]api.Task, 0, len(interrupted))
+	for _, e := range interrupted {
+		slog.Warn("Task was running when the agent stopped", logging.ComponentKey, "QUEUE", "task_id", e.Task.ID, "type", e.Task.Type)
+		interruptedTasks = append(interruptedTasks, e.Task)
+	}
+
+	// Offline schedule: backups run locally while the server is unreachable
+	var offlineScheduler *offline.Scheduler
+	if cfg.Offline.Enabled {
+		offlineDir := filepath.Join(cfg.Agent.DataDir, "offline")
+		offlineStore, err := offline.OpenStore(offlineDir)
+		if err != nil {
+			log.Fatalf("[AGENT] Failed to open offline schedule: %v", err)
+		}
+		var secretStore *secrets.Store
+		if cfg.Offline.SecretKeyFile != "" {
+			secretStore, err = secrets.Open(filepath.Join(offlineDir, "secrets.enc"), cfg.Offline.SecretKeyFile)
+			if err != nil {
+				log.Fatalf("[AGENT] Failed to open secret store: %v", err)
+			}
+		} else {
+			log.Printf("[AGENT] No secret store (offline.secret_key_file): encrypted repositories are not backed up while the server is unreachable")
+		}
+		offlineScheduler = offline.NewScheduler(cfg.Offline, client, offlineStore, secretStore, handler, taskQueue)
+		handler.SetOfflineRuns(offlineScheduler)
+	}
+
 	// Create agent
 	agent := &Agent{
+		configPath:  *configPath,
+		logs:        logs,
 		config:      cfg,
 		client:      client,
 		exec:        exec,
 		handler:     handler,
 		certRenewer: certRenewer,
+		queue:       taskQueue,
+		interrupted: interruptedTasks,
+		spool:       resultSpool,
+		offline:     offlineScheduler,
+		tracker:     tracker,
+		startedAt:   time.Now().UTC(),
 	}
+	handler.SetGracePeriod(agent.gracePeriod)
 
-	// Setup signal handling
+	// Setup signal handling. ctx stops everything, including running tasks; intakeCtx
+	// only stops taking new tasks (drain).
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	intakeCtx, stopIntake := context.WithCancel(ctx)
+	defer stopIntake()
 
-	sigChan := make(chan os.Signal, 1)
+	sigChan := make(chan os.Signal, 2)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		sig := <-sigChan
-		log.Printf("[AGENT] Received signal %v, shutting down...", sig)
+		grace := agent.gracePeriod()
+		if grace <= 0 {
+			log.Printf("[AGENT] Received signal %v, shutting down...", sig)
+			cancel()
+			return
+		}
+
+		log.Printf("[AGENT] Received signal %v, draining: no new tasks, running tasks have %v to finish (signal again to force)", sig, grace)
+		stopIntake()
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case sig := <-sigChan:
+			log.Printf("[AGENT] Received signal %v again, stopping running tasks now", sig)
+		case <-timer.C:
+			log.Printf("[AGENT] Grace period of %v expired, stopping running tasks", grace)
+		case <-ctx.Done():
+		}
 		cancel()
 	}()
 
@@ -118,7 +229,7 @@ func main() {
 	defer certRenewer.Stop()
 
 	// Run agent
-	if err := agent.Run(ctx); err != nil {
+	if err := agent.Run(ctx, intakeCtx); err != nil {
 		log.Fatalf("[AGENT] Agent error: %v", err)
 	}
 
@@ -127,15 +238,50 @@ func main() {
 
 // Agent is the main agent structure
 type Agent struct {
+	configPath string
+	logs       *logging.Manager
+	// configMu guards the settings changed by a reload (see reloadConfig) against
+	// the goroutines reading them
+	configMu    sync.RWMutex
 	config      *config.Config
 	client      *api.Client
 	exec        *executor.Executor
 	handler     *task.Handler
 	certRenewer *cert.Renewer
+	queue       *queue.Queue
+	interrupted []api.Task // running when the agent stopped, reported failed by Run
+	spool       *spool.Spool
+	offline     *offline.Scheduler // nil when offline.enabled is off
+	tracker     *status.Tracker
+	startedAt   time.Time
+
+	// streaming is true while the server push channel is connected; polling is
+	// suspended meanwhile and resumes on its own when the channel drops.
+	streaming atomic.Bool
+	// draining is true once shutdown started: no new task is taken
+	draining atomic.Bool
+	// pollMu serialises pollTasks, called by the poll ticker and by the stream on
+	// (re)connection
+	pollMu sync.Mutex
+
+	// Capability sections the server holds (heartbeats send the changes only)
+	capabilities capabilitySync
+	// Interval and clock skew learnt from heartbeat responses
+	heartbeat heartbeatState
+
+	// Worker pool, resized on reload (see resizeWorkers)
+	runCtx       context.Context
+	intakeCtx    context.Context
+	workersMu    sync.Mutex
+	workers      sync.WaitGroup
+	workerStops  []context.CancelFunc
+	nextWorkerID int
 }
 
-// Run starts the agent main loop
-func (a *Agent) Run(ctx context.Context) error {
+// Run starts the agent main loop. When intakeCtx is done the agent drains: it stops
+// starting tasks and returns once the running ones are finished (or ctx is done),
+// heartbeats and result reporting going on meanwhile.
+func (a *Agent) Run(ctx, intakeCtx context.Context) error {
 	log.Println("[AGENT] Agent started, polling for tasks...")
 	log.Printf("[AGENT] Poll interval: %v, Heartbeat interval: %v", a.config.Polling.Interval, a.config.Polling.HeartbeatInterval)
 
@@ -146,108 +292,353 @@ func (a *Agent) Run(ctx context.Context) error {
 		log.Println("[AGENT] Successfully connected to server!")
 	}
 
+	// Tasks the queue had handed to a worker when the agent stopped: report them rather
+	// than leave them assigned server-side. Before the reconciliation, which handles the
+	// backups it has a marker for.
+	a.handler.FailInterrupted(ctx, a.interrupted)
+	a.interrupted = nil
+
 	// Bug 27c: report any task left "running" by a previous restart/crash as failed,
 	// so it does not stay orphaned server-side (the backup resumes from its checkpoint
 	// on the next dispatch).
 	a.handler.ReconcileOrphanedTasks(ctx)
 
-	// Start task workers
-	taskChan := make(chan api.Task, 10)
+	// Background loops live until the running tasks are done, even while draining
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+
+	// Replay results that could not be reported before (server unreachable)
 	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.spool.Run(bgCtx)
+	}()
+
+	// Local status API for operators on the host
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := status.Serve(bgCtx, a.config.StatusSocketPath(), a.statusSnapshot); err != nil {
+			log.Printf("[STATUS] Status API unavailable: %v", err)
+		}
+	}()
 
-	for i := 0; i < a.config.Agent.MaxConcurrentTasks; i++ {
+	// Prometheus metrics, when enabled
+	if a.config.Metrics.Listen != "" {
+		a.registerMetrics()
 		wg.Add(1)
-		go func(workerID int) {
+		go func() {
 			defer wg.Done()
-			a.taskWorker(ctx, workerID, taskChan)
-		}(i)
+			if err := metrics.Serve(bgCtx, a.config.Metrics.Listen, metrics.Default); err != nil {
+				log.Printf("[METRICS] Metrics endpoint unavailable: %v", err)
+			}
+		}()
 	}
 
-	// Start heartbeat ticker
-	heartbeatTicker := time.NewTicker(a.config.Polling.HeartbeatInterval)
+	// Sync the schedule, and run it while the server is unreachable. Like a worker, it
+	// starts nothing once draining and the drain waits for the backup it runs.
+	if a.offline != nil {
+		a.workers.Add(1)
+		go func() {
+			defer a.workers.Done()
+			a.offline.Run(ctx, intakeCtx)
+		}()
+	}
+
+	// Re-detect capabilities when docker objects change
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.exec.WatchCapabilityTriggers(bgCtx)
+	}()
+
+	// Pick up client certificates replaced on disk
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.client.WatchCertificate(bgCtx)
+	}()
+
+	// Start task workers
+	a.runCtx, a.intakeCtx = ctx, intakeCtx
+	a.resizeWorkers(a.config.Agent.MaxConcurrentTasks)
+
+	// SIGHUP reloads the configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Start heartbeat ticker, at the interval the server asks for when it does
+	heartbeatEvery := a.heartbeatInterval()
+	heartbeatTicker := time.NewTicker(heartbeatEvery)
 	defer heartbeatTicker.Stop()
+	retuneHeartbeat := func() {
+		if d := a.heartbeatInterval(); d != heartbeatEvery {
+			heartbeatEvery = d
+			heartbeatTicker.Reset(d)
+		}
+	}
 
 	// Start task polling ticker
 	pollTicker := time.NewTicker(a.config.Polling.Interval)
 	defer pollTicker.Stop()
 
+	// Start the push channel (polling takes over whenever it is down). It stays up
+	// while draining so cancel events still reach the running tasks; tasks it delivers
+	// only go to the durable queue.
+	if a.config.Polling.Stream {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.streamTasks(bgCtx)
+		}()
+	}
+
+	intake := intakeCtx.Done()
+	var drained chan struct{}
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("[AGENT] Shutting down agent...")
-			close(taskChan)
+			a.workers.Wait()
+			stopBackground()
 			wg.Wait()
 			return nil
 
+		case <-intake:
+			intake = nil
+			a.draining.Store(true)
+			log.Printf("[AGENT] Draining, waiting for running tasks (%d queued task(s) kept for the next start)", a.queue.Len())
+			drained = make(chan struct{})
+			go func() {
+				a.workers.Wait()
+				close(drained)
+			}()
+
+		case <-drained:
+			log.Println("[AGENT] All running tasks finished, shutting down agent...")
+			stopBackground()
+			wg.Wait()
+			return nil
+
+		case <-hup:
+			pollInterval := a.config.Polling.Interval
+			a.reloadConfig()
+			retuneHeartbeat()
+			if a.config.Polling.Interval != pollInterval {
+				pollTicker.Reset(a.config.Polling.Interval)
+			}
+
 		case <-heartbeatTicker.C:
 			if err := a.sendHeartbeat(ctx); err != nil {
-				log.Printf("[HEARTBEAT] Failed: %v", err)
+				slog.Warn("Heartbeat failed", logging.ComponentKey, "HEARTBEAT", "error", err)
 			}
+			retuneHeartbeat()
 
 		case <-pollTicker.C:
-			a.pollTasks(ctx, taskChan)
+			if a.streaming.Load() || a.draining.Load() {
+				continue
+			}
+			a.pollTasks(ctx)
 		}
 	}
 }
 
 // sendHeartbeat sends a heartbeat to the server
 func (a *Agent) sendHeartbeat(ctx context.Context) error {
-	caps := a.exec.DetectCapabilities(ctx)
-	osInfo := a.exec.GetOSInfo(ctx)
-
-	_, err := a.client.SendHeartbeat(ctx, Version, caps, osInfo)
+	report := a.exec.Capabilities(ctx, false)
+	caps := a.capabilities.update(report)
+	osInfo := a.exec.OSInfo(ctx)
+
+	sentAt := time.Now()
+	resp, err := a.client.SendHeartbeat(ctx, api.HeartbeatRequest{
+		Version:      Version,
+		OSInfo:       osInfo,
+		Capabilities: caps,
+		TaskTypes:    task.Types(),
+		ClockSkew:    a.clockSkew(),
+		BorgHost:     a.exec.BorgHost(),
+	})
+	a.tracker.Heartbeat(err)
+	if a.offline != nil && (err == nil || api.IsRejected(err)) {
+		a.offline.ServerReached()
+	}
 	if err != nil {
+		metrics.Heartbeats.Inc("failure")
 		return err
 	}
+	a.recordHeartbeatResponse(resp, sentAt, time.Now())
+	a.capabilities.acknowledge(report, caps, resp)
+	metrics.Heartbeats.Inc("success")
+	metrics.LastHeartbeatSuccess.Set(float64(time.Now().Unix()))
 
-	log.Printf("[HEARTBEAT] Sent successfully (OS: %s)", osInfo)
+	slog.Debug("Sent successfully", logging.ComponentKey, "HEARTBEAT", "os", osInfo)
 	return nil
 }
 
 // pollTasks fetches pending tasks from the server
-func (a *Agent) pollTasks(ctx context.Context, taskChan chan<- api.Task) {
+func (a *Agent) pollTasks(ctx context.Context) {
+	a.pollMu.Lock()
+	defer a.pollMu.Unlock()
+
 	resp, err := a.client.GetTasks(ctx)
 	if err != nil {
-		log.Printf("[POLL] Failed to poll tasks: %v", err)
+		slog.Warn("Failed to poll tasks", logging.ComponentKey, "POLL", "error", err)
 		return
 	}
 
 	if resp.Count > 0 {
-		log.Printf("[POLL] Received %d task(s)", resp.Count)
+		slog.Info("Received tasks", logging.ComponentKey, "POLL", "count", resp.Count)
 		for _, t := range resp.Tasks {
-			log.Printf("[TASK] Queuing task #%d (type: %s)", t.ID, t.Type)
-			select {
-			case taskChan <- t:
-			case <-ctx.Done():
-				return
-			default:
-				log.Printf("[TASK] Queue full, skipping task #%d", t.ID)
-			}
+			a.queueTask(t)
 		}
 	}
 }
 
-// taskWorker processes tasks from the task channel
-func (a *Agent) taskWorker(ctx context.Context, workerID int, taskChan <-chan api.Task) {
-	log.Printf("[WORKER-%d] Started", workerID)
+// queueTask records a task received by polling or by the push channel in the durable
+// queue. A task already queued or running (re-offered by the server) is ignored.
+func (a *Agent) queueTask(t api.Task) {
+	added, err := a.queue.Push(t)
+	if err != nil {
+		slog.Warn("Task queued in memory only (not persisted)", logging.ComponentKey, "TASK", "task_id", t.ID, "error", err)
+	}
+	if added {
+		slog.Info("Queued task", logging.ComponentKey, "TASK", "task_id", t.ID, "type", t.Type, "pending", a.queue.Len())
+	}
+}
+
+// streamTasks keeps the server push channel open, reconnecting with backoff. While it
+// is down the poll ticker delivers tasks as before; a server without the channel is
+// retried rarely so it is not hammered with requests it cannot answer.
+func (a *Agent) streamTasks(ctx context.Context) {
+	const (
+		minBackoff         = 5 * time.Second
+		maxBackoff         = 5 * time.Minute
+		unsupportedBackoff = 30 * time.Minute
+	)
+	backoff := minBackoff
 
 	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("[WORKER-%d] Stopping", workerID)
+		err := a.client.StreamTasks(ctx,
+			func() {
+				a.streaming.Store(true)
+				backoff = minBackoff
+				slog.Info("Connected, task polling suspended", logging.ComponentKey, "STREAM")
+				// Catch up on anything queued while the channel was down.
+				a.pollTasks(ctx)
+			},
+			func(ev api.TaskEvent) {
+				switch ev.Type {
+				case api.StreamEventTask:
+					a.queueTask(*ev.Task)
+				case api.StreamEventCancel:
+					if !a.handler.CancelTask(ev.TaskID) {
+						slog.Debug("Cancel ignored: task not running here", logging.ComponentKey, "STREAM", "task_id", ev.TaskID)
+					}
+				}
+			},
+		)
+
+		wasStreaming := a.streaming.Swap(false)
+		if ctx.Err() != nil {
 			return
-		case t, ok := <-taskChan:
-			if !ok {
-				log.Printf("[WORKER-%d] Task channel closed", workerID)
-				return
-			}
-			log.Printf("[WORKER-%d] Processing task #%d (type: %s)", workerID, t.ID, t.Type)
-			startTime := time.Now()
-			if err := a.handler.ProcessTask(ctx, t); err != nil {
-				log.Printf("[WORKER-%d] Task #%d FAILED after %v: %v", workerID, t.ID, time.Since(startTime), err)
+		}
+
+		wait := backoff
+		if errors.Is(err, api.ErrStreamUnsupported) {
+			slog.Info("Server has no task stream, polling", logging.ComponentKey, "STREAM", "interval", a.pollInterval())
+			wait = unsupportedBackoff
+		} else {
+			if wasStreaming {
+				slog.Warn("Disconnected, falling back to polling", logging.ComponentKey, "STREAM", "error", err)
 			} else {
-				log.Printf("[WORKER-%d] Task #%d COMPLETED in %v", workerID, t.ID, time.Since(startTime))
+				slog.Debug("Connection failed", logging.ComponentKey, "STREAM", "error", err, "retry_in", wait)
 			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// taskWorker processes tasks from the durable queue until intakeCtx is done. Tasks run
+// under ctx, so a task already started survives the drain.
+func (a *Agent) taskWorker(ctx, intakeCtx context.Context, workerID int) {
+	slog.Debug("Started", logging.ComponentKey, fmt.Sprintf("WORKER-%d", workerID))
+
+	for {
+		t, err := a.queue.Next(intakeCtx)
+		if err != nil {
+			slog.Debug("Stopping", logging.ComponentKey, fmt.Sprintf("WORKER-%d", workerID))
+			return
+		}
+		startTime := time.Now()
+		a.tracker.TaskStarted(t)
+		taskID := t.ID
+		taskCtx := executor.WithProcessObserver(logging.WithTask(ctx, t.ID, t.Type), func(pid int, command string) {
+			a.tracker.TaskProcess(taskID, pid, command)
+		})
+		logger := logging.Component(taskCtx, fmt.Sprintf("WORKER-%d", workerID))
+		logger.Info("Processing task", "priority", t.Priority)
+		outcome := "success"
+		if err := a.handler.ProcessTask(taskCtx, t); err != nil {
+			outcome = "failure"
+			logger.Warn("Task FAILED", "duration", time.Since(startTime).Round(time.Millisecond), "error", err)
+		} else {
+			logger.Info("Task COMPLETED", "duration", time.Since(startTime).Round(time.Millisecond))
 		}
+		metrics.TasksTotal.Inc(t.Type, outcome)
+		metrics.TaskDuration.Observe(time.Since(startTime).Seconds(), t.Type, outcome)
+		a.tracker.TaskFinished(t.ID)
+		a.queue.Done(t.ID)
+	}
+}
+
+// statusSnapshot collects the state served by the local status API
+func (a *Agent) statusSnapshot() status.Snapshot {
+	s := status.Snapshot{
+		Version:      Version,
+		UUID:         a.config.Agent.UUID,
+		Name:         a.config.Agent.Name,
+		StartedAt:    a.startedAt,
+		Draining:     a.draining.Load(),
+		Streaming:    a.streaming.Load(),
+		Breaker:      a.client.BreakerState(),
+		Endpoint:     a.client.Endpoint(),
+		BorgHost:     a.exec.BorgHost(),
+		QueuePending: a.queue.Len(),
+		SpoolPending: a.spool.Len(),
+	}
+	a.tracker.Fill(&s)
+
+	s.HeartbeatIntervalSeconds = a.heartbeatInterval().Seconds()
+	if skew := a.clockSkew(); skew != nil {
+		seconds := skew.Seconds()
+		s.ClockSkewSeconds = &seconds
+	}
+
+	if a.offline != nil {
+		syncedAt, active, pending := a.offline.State()
+		s.Offline = &status.OfflineStatus{Active: active, RunsPending: pending}
+		if !syncedAt.IsZero() {
+			s.Offline.SyncedAt = &syncedAt
+		}
+	}
+
+	if expiry, err := a.certRenewer.CertificateExpiry(); err == nil {
+		s.CertExpiresAt = &expiry
+	}
+	if mode, probedAt := a.exec.BorgMode(); mode != "" {
+		s.BorgMode = mode
+		s.BorgModeProbed = &probedAt
 	}
+	return s
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+
+	"github.com/phpborg/phpborg-agent/internal/metrics"
+	"github.com/phpborg/phpborg-agent/internal/status"
+)
+
+// registerMetrics adds the gauges read from the agent state at scrape time
+func (a *Agent) registerMetrics() {
+	metrics.Info.Set(1, Version)
+
+	metrics.Default.NewGaugeFunc("phpborg_agent_queue_pending",
+		"Tasks waiting in the local queue.", func() float64 {
+			return float64(a.queue.Len())
+		})
+	metrics.Default.NewGaugeFunc("phpborg_agent_spool_pending",
+		"Task results waiting to be reported to the server.", func() float64 {
+			return float64(a.spool.Len())
+		})
+	metrics.Default.NewGaugeFunc("phpborg_agent_tasks_running",
+		"Tasks currently running.", func() float64 {
+			var s status.Snapshot
+			a.tracker.Fill(&s)
+			return float64(len(s.Running))
+		})
+	metrics.Default.NewGaugeFunc("phpborg_agent_draining",
+		"1 while the agent is shutting down and finishing its running tasks.", func() float64 {
+			if a.draining.Load() {
+				return 1
+			}
+			return 0
+		})
+	metrics.Default.NewGaugeFunc("phpborg_agent_cert_expiry_timestamp_seconds",
+		"Unix time the mTLS client certificate expires (absent without mTLS).", func() float64 {
+			expiry, err := a.certRenewer.CertificateExpiry()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(expiry.Unix())
+		})
+}
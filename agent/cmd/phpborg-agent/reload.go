@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/config"
+)
+
+// liveSettings are the settings a SIGHUP applies without restart, by YAML path
+// prefix. Anything else (identity, server, TLS, auth, data dir...) needs a restart.
+var liveSettings = []string{
+	"polling.interval",
+	"polling.heartbeat_interval",
+	"agent.max_concurrent_tasks",
+	"agent.task_limits",
+	"agent.shutdown_grace_period",
+	"logging.",
+	"borg_ssh.",
+	"proxy.ssh_through_proxy",
+	"proxy.ssh_jump",
+	"proxy.ssh_proxy_command",
+}
+
+func isLiveSetting(path string) bool {
+	for _, prefix := range liveSettings {
+		if path == prefix || (strings.HasSuffix(prefix, ".") && strings.HasPrefix(path, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadConfig re-reads the configuration file and applies the live settings (see
+// liveSettings). Other changes are logged and left for the next restart. It runs on
+// the Run loop, which owns the tickers and the worker pool.
+func (a *Agent) reloadConfig() {
+	newCfg, err := config.LoadFromFile(a.configPath)
+	if err != nil {
+		log.Printf("[CONFIG] Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	newCfg.Agent.Version = Version
+
+	changes := config.Diff(a.config, newCfg)
+	if len(changes) == 0 {
+		log.Println("[CONFIG] Reloaded, no changes")
+		return
+	}
+
+	var rejected []config.Change
+	for _, c := range changes {
+		if !isLiveSetting(c.Path) {
+			rejected = append(rejected, c)
+		}
+	}
+
+	if err := a.logs.Apply(newCfg.Logging); err != nil {
+		log.Printf("[CONFIG] Cannot apply the logging settings, keeping the current ones: %v", err)
+		newCfg.Logging = a.config.Logging
+	}
+
+	a.configMu.Lock()
+	a.config.Polling.Interval = newCfg.Polling.Interval
+	a.config.Polling.HeartbeatInterval = newCfg.Polling.HeartbeatInterval
+	a.config.Agent.MaxConcurrentTasks = newCfg.Agent.MaxConcurrentTasks
+	a.config.Agent.TaskLimits = newCfg.Agent.TaskLimits
+	a.config.Agent.ShutdownGracePeriod = newCfg.Agent.ShutdownGracePeriod
+	a.config.Logging = newCfg.Logging
+	a.config.BorgSSH = newCfg.BorgSSH
+	a.config.Proxy.SSHThroughProxy = newCfg.Proxy.SSHThroughProxy
+	a.config.Proxy.SSHJump = newCfg.Proxy.SSHJump
+	a.config.Proxy.SSHProxyCommand = newCfg.Proxy.SSHProxyCommand
+	a.configMu.Unlock()
+
+	a.exec.SetSSHConfig(a.config.BorgSSH, a.config.Proxy)
+	a.queue.SetLimits(a.config.Agent.TaskLimits)
+	a.resizeWorkers(a.config.Agent.MaxConcurrentTasks)
+
+	for _, c := range changes {
+		if isLiveSetting(c.Path) {
+			log.Printf("[CONFIG] Applied %s", c)
+		}
+	}
+	for _, c := range rejected {
+		log.Printf("[CONFIG] NOT applied (restart required): %s", c)
+	}
+	log.Printf("[CONFIG] Reloaded from %s: %d change(s) applied, %d need a restart", a.configPath, len(changes)-len(rejected), len(rejected))
+}
+
+// gracePeriod returns the current shutdown grace period
+func (a *Agent) gracePeriod() time.Duration {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config.Agent.ShutdownGracePeriod
+}
+
+// pollInterval returns the current task polling interval
+func (a *Agent) pollInterval() time.Duration {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config.Polling.Interval
+}
+
+// resizeWorkers grows or shrinks the worker pool to n workers. A removed worker
+// finishes its current task first.
+func (a *Agent) resizeWorkers(n int) {
+	a.workersMu.Lock()
+	defer a.workersMu.Unlock()
+
+	for len(a.workerStops) < n {
+		workerCtx, stop := context.WithCancel(a.intakeCtx)
+		a.workerStops = append(a.workerStops, stop)
+		workerID := a.nextWorkerID
+		a.nextWorkerID++
+		a.workers.Add(1)
+		go func() {
+			defer a.workers.Done()
+			a.taskWorker(a.runCtx, workerCtx, workerID)
+		}()
+	}
+	for len(a.workerStops) > n {
+		last := len(a.workerStops) - 1
+		a.workerStops[last]()
+		a.workerStops = a.workerStops[:last]
+	}
+}
@@ -10,11 +10,16 @@ import (
 	"os/exec"
 	"path/filepath"
 	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/config"
+	"github.com/phpborg/phpborg-agent/internal/platform"
 )
 
 const serviceName = "phpborg-agent"
 
-func installAsService() error {
+// installAsService writes and enables the systemd unit running the agent with the
+// configuration at configPath
+func installAsService(configPath string) error {
 	// Get current executable path
 	execPath, err := os.Executable()
 	if err != nil {
@@ -25,16 +30,31 @@ func installAsService() error {
 		return fmt.Errorf("failed to resolve symlinks: %w", err)
 	}
 
-	// Create systemd service file content
+	// The grace period of the configuration sets the stop timeout of the unit
+	grace := config.DefaultConfig().Agent.ShutdownGracePeriod
+	if cfg, err := config.LoadFromFile(configPath); err == nil {
+		grace = cfg.Agent.ShutdownGracePeriod
+	}
+
+	// Create systemd service file content. Unlike the unit of the installer (dedicated
+	// user, platform.SystemdUnit), this one runs as root without filesystem sandboxing:
+	// restores write anywhere and certificate renewal writes under /etc/phpborg-agent.
 	serviceContent := fmt.Sprintf(`[Unit]
 Description=phpBorg Backup Agent
 After=network.target
 
 [Service]
 Type=simple
-ExecStart=%s
+ExecStart=%s -config %s
+# "systemctl reload" applies config changes without interrupting backups
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=always
 RestartSec=10
+# Graceful drain: SIGTERM goes to the agent only (not to the borg processes), which
+# lets running tasks finish for agent.shutdown_grace_period before stopping them.
+# TimeoutStopSec is that grace period plus a margin.
+KillMode=mixed
+TimeoutStopSec=%d
 User=root
 WorkingDirectory=/
 
@@ -50,7 +70,7 @@ ProtectHome=false
 
 [Install]
 WantedBy=multi-user.target
-`, execPath)
+`, execPath, configPath, platform.SystemdStopTimeout(grace))
 
 	// Write service file
 	servicePath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
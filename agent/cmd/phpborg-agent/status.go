@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/config"
+	"github.com/phpborg/phpborg-agent/internal/status"
+)
+
+// runStatus implements "phpborg-agent status": it reads the local status API of the
+// running agent and prints it
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := fs.String("config", config.GetDefaultConfigPath(), "Path to configuration file")
+	socket := fs.String("socket", "", "Status socket (default: from the configuration)")
+	asJSON := fs.Bool("json", false, "Print the raw JSON document")
+	fs.Parse(args)
+
+	socketPath := *socket
+	if socketPath == "" {
+		cfg, err := config.LoadFromFile(*configPath)
+		if err != nil {
+			// Unreadable config (e.g. not root): try the default location.
+			cfg = config.DefaultConfig()
+		}
+		socketPath = cfg.StatusSocketPath()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	s, err := status.Fetch(ctx, socketPath)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+
+	printStatus(s)
+	return nil
+}
+
+func printStatus(s *status.Snapshot) {
+	state := "running"
+	if s.Draining {
+		state = "draining (shutting down)"
+	}
+	channel := "polling"
+	if s.Streaming {
+		channel = "push stream"
+	}
+
+	fmt.Printf("phpBorg Agent %s — %s (%s)\n", s.Version, s.Name, s.UUID)
+	fmt.Printf("  State:       %s, up %s\n", state, since(s.StartedAt))
+	fmt.Printf("  Server:      %s via %s, circuit breaker %s\n", s.Endpoint, channel, s.Breaker)
+	if s.BorgHost != "" {
+		fmt.Printf("  Borg host:   %s\n", s.BorgHost)
+	}
+	if hb := s.LastHeartbeat; hb != nil {
+		if hb.OK {
+			fmt.Printf("  Heartbeat:   ok, %s ago (every %v)\n", since(hb.At), time.Duration(s.HeartbeatIntervalSeconds*float64(time.Second)))
+		} else {
+			fmt.Printf("  Heartbeat:   FAILED %s ago: %s\n", since(hb.At), hb.Error)
+		}
+	} else {
+		fmt.Printf("  Heartbeat:   none yet\n")
+	}
+	if s.ClockSkewSeconds != nil {
+		skew := time.Duration(*s.ClockSkewSeconds * float64(time.Second)).Round(100 * time.Millisecond)
+		warning := ""
+		if skew >= clockSkewWarning || skew <= -clockSkewWarning {
+			warning = " — WARNING: clock out of sync, check NTP"
+		}
+		fmt.Printf("  Clock skew:  %+.1fs (server minus local)%s\n", skew.Seconds(), warning)
+	}
+	if s.CertExpiresAt != nil {
+		fmt.Printf("  Certificate: expires %s (in %d days)\n", s.CertExpiresAt.Format("2006-01-02"), int(time.Until(*s.CertExpiresAt).Hours()/24))
+	}
+	if s.BorgMode != "" {
+		fmt.Printf("  Borg mode:   %s (probed %s ago)\n", s.BorgMode, since(*s.BorgModeProbed))
+	}
+	fmt.Printf("  Queue:       %d pending, %d result(s) waiting to be reported\n", s.QueuePending, s.SpoolPending)
+	if o := s.Offline; o != nil {
+		synced := "never synced"
+		if o.SyncedAt != nil {
+			synced = "synced " + since(*o.SyncedAt) + " ago"
+		}
+		mode := "standby"
+		if o.Active {
+			mode = "ACTIVE (server unreachable, running backups locally)"
+		}
+		fmt.Printf("  Offline:     %s, schedule %s, %d run(s) to upload\n", mode, synced, o.RunsPending)
+	}
+
+	if len(s.Running) == 0 {
+		fmt.Println("\nNo task running.")
+		return
+	}
+
+	fmt.Printf("\nRunning tasks:\n")
+	for _, t := range s.Running {
+		fmt.Printf("  #%d %s", t.ID, t.Type)
+		if t.Priority != "" {
+			fmt.Printf(" [%s]", t.Priority)
+		}
+		fmt.Printf(" — %d%%", t.Progress)
+		if t.Phase != "" {
+			fmt.Printf(", phase %s", t.Phase)
+		}
+		fmt.Printf(", running for %s\n", since(t.StartedAt))
+
+		if t.PID > 0 {
+			fmt.Printf("      process:  %s (pid %d)\n", t.Command, t.PID)
+		}
+		if info := t.Info; info != nil {
+			if info.FilesCount > 0 || info.OriginalSize > 0 {
+				fmt.Printf("      files:    %d, %s read, %s deduplicated\n", info.FilesCount, formatSize(info.OriginalSize), formatSize(info.DeduplicatedSize))
+			}
+			if info.CurrentPath != "" {
+				fmt.Printf("      path:     %s\n", info.CurrentPath)
+			}
+			if info.Message != "" {
+				fmt.Printf("      message:  %s\n", strings.TrimSpace(info.Message))
+			}
+		}
+		if !t.UpdatedAt.IsZero() {
+			fmt.Printf("      updated:  %s ago\n", since(t.UpdatedAt))
+		}
+	}
+}
+
+// since formats the time elapsed since t, rounded for display
+func since(t time.Time) string {
+	d := time.Since(t)
+	if d < time.Hour {
+		return d.Round(time.Second).String()
+	}
+	return d.Round(time.Minute).String()
+}
+
+// formatSize formats a byte count (binary units)
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
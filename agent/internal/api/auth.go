@@ -0,0 +1,244 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// Agent credential endpoints. Both answer with an AgentToken.
+const (
+	authEnrollPath  = "/agent/auth/enroll"
+	authRefreshPath = "/agent/auth/refresh"
+)
+
+// registerPath registers a new agent with the registration token of the server (also
+// used by the installer scripts)
+const registerPath = "/agent/register-token"
+
+// minRefreshMargin is the least time before expiry at which a token is refreshed
+const minRefreshMargin = 5 * time.Minute
+
+// AgentToken is a signed, expiring agent credential issued by the server
+type AgentToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Set locally when the token was received, used to plan the refresh
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// needsRefresh reports whether the token is in the last third of its lifetime (and at
+// least minRefreshMargin before expiry)
+func (t *AgentToken) needsRefresh() bool {
+	margin := t.ExpiresAt.Sub(t.IssuedAt) / 3
+	if margin < minRefreshMargin {
+		margin = minRefreshMargin
+	}
+	return time.Until(t.ExpiresAt) < margin
+}
+
+// tokenSource holds the agent token: it exchanges the one-time enrollment token on
+// first use, refreshes the token before it expires and persists it to tokenFile.
+type tokenSource struct {
+	client          *Client
+	tokenFile       string
+	enrollmentToken string
+
+	mu    sync.Mutex
+	token *AgentToken
+	// stale forces a refresh after the server rejected the current token
+	stale bool
+}
+
+// newTokenSource loads the stored token. It returns nil when there is neither a stored
+// token nor an enrollment token (the agent then relies on mTLS only).
+func newTokenSource(c *Client, tokenFile, enrollmentToken string) (*tokenSource, error) {
+	ts := &tokenSource{client: c, tokenFile: tokenFile, enrollmentToken: enrollmentToken}
+
+	data, err := os.ReadFile(tokenFile)
+	switch {
+	case err == nil:
+		var t AgentToken
+		if err := json.Unmarshal(data, &t); err != nil || t.Token == "" {
+			return nil, fmt.Errorf("invalid agent token file %s", tokenFile)
+		}
+		ts.token = &t
+		if enrollmentToken != "" {
+			slog.Info("Agent already enrolled, auth.enrollment_token is no longer used and can be removed from the config", logging.ComponentKey, "AUTH")
+		}
+	case os.IsNotExist(err):
+		if enrollmentToken == "" {
+			return nil, nil
+		}
+	default:
+		return nil, fmt.Errorf("failed to read agent token: %w", err)
+	}
+
+	return ts, nil
+}
+
+// bearer returns a valid agent token, enrolling or refreshing it first if needed
+func (ts *tokenSource) bearer(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token == nil {
+		if err := ts.enroll(ctx); err != nil {
+			return "", err
+		}
+		return ts.token.Token, nil
+	}
+
+	if ts.stale || ts.token.needsRefresh() {
+		if err := ts.refresh(ctx); err != nil {
+			if time.Now().Before(ts.token.ExpiresAt) && !ts.stale {
+				// Still valid: keep using it, the next call tries again.
+				slog.Warn("Token refresh failed, keeping the current token", logging.ComponentKey, "AUTH", "valid_until", ts.token.ExpiresAt.Format(time.RFC3339), "error", err)
+				return ts.token.Token, nil
+			}
+			return "", err
+		}
+	}
+
+	return ts.token.Token, nil
+}
+
+// invalidate marks the token as rejected by the server. Only the token that was sent
+// is invalidated, a concurrent call may already have refreshed it.
+func (ts *tokenSource) invalidate(sent string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != nil && ts.token.Token == sent {
+		ts.stale = true
+	}
+}
+
+// enroll exchanges the one-time enrollment token for an agent token. Caller holds ts.mu.
+func (ts *tokenSource) enroll(ctx context.Context) error {
+	body := map[string]interface{}{
+		"uuid": ts.client.config.Agent.UUID,
+		"name": ts.client.config.Agent.Name,
+	}
+	resp, err := ts.client.doWithRetry(ctx, "POST", authEnrollPath, body, callOptions{bearer: ts.enrollmentToken})
+	if err != nil {
+		return fmt.Errorf("enrollment failed: %w", err)
+	}
+	if err := ts.store(resp); err != nil {
+		return err
+	}
+	slog.Info("Agent enrolled", logging.ComponentKey, "AUTH", "valid_until", ts.token.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// refresh trades the current token for a new one. The server accepts a token that has
+// expired recently, and identifies the agent by its client certificate under mTLS.
+// Caller holds ts.mu.
+func (ts *tokenSource) refresh(ctx context.Context) error {
+	resp, err := ts.client.doWithRetry(ctx, "POST", authRefreshPath, nil, callOptions{bearer: ts.token.Token})
+	if err != nil {
+		return fmt.Errorf("token refresh failed: %w", err)
+	}
+	if err := ts.store(resp); err != nil {
+		return err
+	}
+	slog.Info("Agent token refreshed", logging.ComponentKey, "AUTH", "valid_until", ts.token.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// store parses a token response and persists it. Caller holds ts.mu.
+func (ts *tokenSource) store(resp *APIResponse) error {
+	var t AgentToken
+	if err := json.Unmarshal(resp.Data, &t); err != nil {
+		return fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if t.Token == "" || t.ExpiresAt.IsZero() {
+		return errors.New("server returned an empty agent token")
+	}
+	t.IssuedAt = time.Now().UTC()
+
+	// Use the new token even if it cannot be saved: the old one is probably revoked.
+	ts.token = &t
+	ts.stale = false
+	if err := t.Save(ts.tokenFile); err != nil {
+		slog.Warn("Failed to save agent token", logging.ComponentKey, "AUTH", "file", ts.tokenFile, "error", err)
+	}
+	return nil
+}
+
+// Save writes the token to path (mode 0600)
+func (t *AgentToken) Save(path string) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal agent token: %w", err)
+	}
+	return fileutil.WriteAtomic(path, data, 0600)
+}
+
+// EnrollRequest registers a new agent with the registration token of the server. Keys
+// are generated on the agent: only public material (SSH public key, CSR) is sent.
+type EnrollRequest struct {
+	RegistrationToken string `json:"registration_token"`
+	UUID              string `json:"uuid"`
+	Name              string `json:"name"`
+	Hostname          string `json:"hostname"`
+	OS                string `json:"os"`
+	Arch              string `json:"architecture"`
+	Version           string `json:"agent_version"`
+	SSHPublicKey      string `json:"ssh_public_key"`
+	CSR               string `json:"csr"` // PEM, signed by the agent key, CN agent-{uuid}
+}
+
+// EnrollResponse is returned by a successful enrollment
+type EnrollResponse struct {
+	AgentToken
+	BorgHost   string `json:"borg_host"`
+	BorgPort   int    `json:"borg_port"`
+	BorgUser   string `json:"borg_user"`
+	BackupPath string `json:"backup_path"`
+	TLSCert    string `json:"tls_cert"` // PEM certificate issued from the CSR
+	CACert     string `json:"ca_cert"`  // PEM CA certificate
+}
+
+// Enroll registers the agent (see EnrollRequest). The request carries the
+// registration token in its body and no credentials.
+func (c *Client) Enroll(ctx context.Context, req *EnrollRequest) (*EnrollResponse, error) {
+	resp, err := c.doWithRetry(ctx, "POST", registerPath, req, callOptions{anonymous: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var enrollment EnrollResponse
+	if err := json.Unmarshal(resp.Data, &enrollment); err != nil {
+		return nil, fmt.Errorf("failed to parse enrollment response: %w", err)
+	}
+	if enrollment.Token == "" || enrollment.ExpiresAt.IsZero() {
+		return nil, errors.New("server returned an empty agent token")
+	}
+	enrollment.IssuedAt = time.Now().UTC()
+
+	return &enrollment, nil
+}
+
+// authorization returns the Authorization header value for an API request: the agent
+// token, the UUID on legacy setups, or nothing when mTLS alone identifies the agent.
+func (c *Client) authorization(ctx context.Context) (string, error) {
+	if c.tokens != nil {
+		token, err := c.tokens.bearer(ctx)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	if c.config.Auth.LegacyUUIDBearer {
+		return "Bearer " + c.config.Agent.UUID, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without contacting the server while the circuit breaker
+// is open (the server failed repeatedly and is given time to recover).
+var ErrCircuitOpen = errors.New("circuit breaker open: server unreachable, request not sent")
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// maxBreakerCooldown caps the cooldown, which doubles each time a probe fails
+const maxBreakerCooldown = 5 * time.Minute
+
+// breaker is a consecutive-failure circuit breaker. After threshold failures in a row
+// it opens and rejects requests for a cooldown; then a single probe request is let
+// through (half-open) and its outcome closes or re-opens the circuit.
+type breaker struct {
+	threshold    int
+	baseCooldown time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	cooldown time.Duration
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	exportBreakerState(BreakerClosed)
+	return &breaker{
+		threshold:    threshold,
+		baseCooldown: cooldown,
+		cooldown:     cooldown,
+		state:        BreakerClosed,
+	}
+}
+
+// allow reports whether a request may be sent now
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil // disabled
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen // one probe at a time
+		}
+		b.probing = true
+		return nil
+	}
+	return nil
+}
+
+// success records a request that reached a healthy server
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.cooldown = b.baseCooldown
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// failure records a transport error or a server-side (5xx) failure
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	switch b.state {
+	case BreakerHalfOpen:
+		// The probe failed: back off longer before the next one.
+		b.probing = false
+		b.cooldown *= 2
+		if b.cooldown > maxBreakerCooldown {
+			b.cooldown = maxBreakerCooldown
+		}
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	case BreakerClosed:
+		if b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			b.setState(BreakerOpen)
+		}
+	}
+}
+
+// release ends an allowed request whose outcome says nothing about the server
+// (e.g. cancelled by the caller), freeing the half-open probe slot.
+func (b *breaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// State returns the current breaker state
+func (b *breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState changes the state and logs the transition. Caller holds b.mu.
+func (b *breaker) setState(state string) {
+	switch state {
+	case BreakerOpen:
+		slog.Info("Circuit breaker OPEN, pausing requests", logging.ComponentKey, "API", "failures", b.failures, "cooldown", b.cooldown)
+	case BreakerHalfOpen:
+		slog.Info("Circuit breaker half-open, probing the server", logging.ComponentKey, "API")
+	case BreakerClosed:
+		slog.Info("Circuit breaker closed, server reachable again", logging.ComponentKey, "API")
+	}
+	b.state = state
+	exportBreakerState(state)
+}
+
+// exportBreakerState sets the breaker state gauge: 1 for state, 0 for the others
+func exportBreakerState(state string) {
+	for _, s := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		metrics.BreakerState.Set(value, s)
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// certWatchInterval is how often the certificate files are checked for changes
+const certWatchInterval = time.Minute
+
+// CertStore holds the mTLS client certificate and reloads it when the files change,
+// so a renewed certificate is used without restarting the agent.
+type CertStore struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertStore loads the key pair from certFile and keyFile
+func NewCertStore(certFile, keyFile string) (*CertStore, error) {
+	s := &CertStore{certFile: certFile, keyFile: keyFile}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (s *CertStore) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// Reload loads the key pair from disk. On error (e.g. files caught in the middle of a
+// swap) the current certificate is kept.
+func (s *CertStore) Reload() error {
+	certMod, keyMod := modTime(s.certFile), modTime(s.keyFile)
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.certMod, s.keyMod = certMod, keyMod
+	s.mu.Unlock()
+	return nil
+}
+
+// changed reports whether the files were modified since the last successful load
+func (s *CertStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !modTime(s.certFile).Equal(s.certMod) || !modTime(s.keyFile).Equal(s.keyMod)
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// ReloadCertificate reloads the client certificate (after a renewal) and drops idle
+// connections so the next requests handshake with the new one
+func (c *Client) ReloadCertificate() error {
+	if c.certs == nil {
+		return nil
+	}
+	if err := c.certs.Reload(); err != nil {
+		return err
+	}
+	c.transport.CloseIdleConnections()
+	slog.Info("Client certificate reloaded", logging.ComponentKey, "CERT")
+	return nil
+}
+
+// WatchCertificate picks up certificate files replaced by other tools (installer,
+// configuration management) until ctx is done
+func (c *Client) WatchCertificate(ctx context.Context) {
+	if c.certs == nil {
+		return
+	}
+
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.certs.changed() {
+				continue
+			}
+			if err := c.ReloadCertificate(); err != nil {
+				// Probably caught mid-swap: retried on the next tick.
+				slog.Warn("Certificate files changed but could not be loaded", logging.ComponentKey, "CERT", "error", err)
+			}
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/phpborg/phpborg-agent/internal/config"
@@ -18,55 +22,111 @@ import (
 type Client struct {
 	config     *config.Config
 	httpClient *http.Client
-	baseURL    string
+	// streamClient shares the transport but has no overall timeout: the task stream
+	// is a long-lived response (see StreamTasks).
+	streamClient *http.Client
+	// endpoints are the server API URLs, with failover (see endpoints)
+	endpoints *endpoints
+	// breaker stops hammering a server that keeps failing
+	breaker *breaker
+	// tokens provides the agent token (nil = mTLS or legacy UUID authentication)
+	tokens *tokenSource
+	// certs holds the mTLS client certificate (nil without mTLS)
+	certs     *CertStore
+	transport *http.Transport
+	// progressObserver sees progress updates (see SetProgressObserver)
+	progressObserver func(taskID int, progress int, info ProgressInfo)
+	// taskLogUnsupported is set once the server answered that it has no task log endpoint
+	taskLogUnsupported atomic.Bool
 }
 
 // NewClient creates a new API client with mTLS or simple HTTP
 func NewClient(cfg *config.Config) (*Client, error) {
-	var transport *http.Transport
+	var tlsConfig *tls.Config
+	var certs *CertStore
 
 	// Check if mTLS is configured
 	if cfg.UseTLS() {
-		// Load client certificate for mTLS authentication
-		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		// Load client certificate for mTLS authentication (reloaded after renewal)
+		var err error
+		certs, err = NewCertStore(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			return nil, err
 		}
 
-		// Note: We don't set RootCAs here because:
+		// Note: We don't set RootCAs from ca_file because:
 		// - RootCAs is for verifying the SERVER's SSL certificate
 		// - We want to use system CA trust store (for Let's Encrypt, Sectigo, etc.)
 		// - The mTLS CA is only for the SERVER to verify our CLIENT certificate
 		// - The server-side uses our CA to verify agent certs, not the other way around
+		// A private server CA goes in tls.server_ca_file instead (see applyServerTrust).
 
 		// Configure TLS with client certs (mTLS) but use system CAs for server verification
-		tlsConfig := &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			InsecureSkipVerify: cfg.Server.InsecureSkipVerify,
+		tlsConfig = &tls.Config{
+			GetClientCertificate: certs.GetClientCertificate,
+			InsecureSkipVerify:   cfg.Server.InsecureSkipVerify,
 			// RootCAs: nil = use system CA trust store
 		}
-
-		transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
-		}
 	} else {
 		// Simple transport without mTLS (uses Bearer token auth)
-		tlsConfig := &tls.Config{
+		tlsConfig = &tls.Config{
 			InsecureSkipVerify: cfg.Server.InsecureSkipVerify,
 		}
-		transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
+	}
+
+	if err := applyServerTrust(tlsConfig, cfg); err != nil {
+		return nil, err
+	}
+	proxy, err := proxyFunc(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           proxy,
+	}
+
+	if !cfg.UseTLS() && !cfg.Auth.LegacyUUIDBearer && cfg.Auth.EnrollmentToken == "" {
+		if _, err := os.Stat(cfg.TokenFilePath()); err != nil {
+			return nil, fmt.Errorf("no agent credentials: configure mTLS, auth.enrollment_token or an enrolled token in %s", cfg.TokenFilePath())
 		}
 	}
 
-	return &Client{
+	c := &Client{
 		config: cfg,
 		httpClient: &http.Client{
 			Transport: transport,
 			Timeout:   30 * time.Second,
 		},
-		baseURL: cfg.Server.URL,
-	}, nil
+		streamClient: &http.Client{
+			Transport: transport,
+		},
+		endpoints: newEndpoints(cfg.Server.URLList()),
+		breaker:   newBreaker(cfg.Server.Retry.BreakerThreshold, cfg.Server.Retry.BreakerCooldown),
+		certs:     certs,
+		transport: transport,
+	}
+
+	tokens, err := newTokenSource(c, cfg.TokenFilePath(), cfg.Auth.EnrollmentToken)
+	if err != nil {
+		return nil, err
+	}
+	c.tokens = tokens
+
+	return c, nil
+}
+
+// proxyFunc returns the proxy selection for API traffic: proxy.url (HTTP CONNECT or
+// SOCKS5) when set, otherwise the HTTPS_PROXY/NO_PROXY environment
+func proxyFunc(cfg *config.Config) (func(*http.Request) (*url.URL, error), error) {
+	if cfg.Proxy.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(cfg.Proxy.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	return http.ProxyURL(u), nil
 }
 
 // APIResponse represents a standard API response
@@ -81,16 +141,43 @@ type APIResponse struct {
 type APIError struct {
 	Message string `json:"message"`
 	Code    string `json:"code"`
+	// StatusCode is the HTTP status of the response (not part of the JSON body)
+	StatusCode int `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	return "API error: " + e.Message
+}
+
+// IsRejected reports whether err is a definitive refusal by the server (HTTP 4xx):
+// the request reached phpBorg and sending it again would not change the answer.
+// 408 and 429 are transient and do not count.
+func IsRejected(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return apiErr.StatusCode >= 400 && apiErr.StatusCode < 500
 }
 
 // Task represents a task from the API
 type Task struct {
-	ID             int                    `json:"id"`
-	Type           string                 `json:"type"`
-	Priority       string                 `json:"priority"`
-	Payload        map[string]interface{} `json:"payload"`
-	TimeoutSeconds int                    `json:"timeout_seconds"`
-	CreatedAt      string                 `json:"created_at"`
+	ID             int             `json:"id"`
+	Type           string          `json:"type"`
+	Priority       string          `json:"priority"`
+	Payload        json.RawMessage `json:"payload"`
+	TimeoutSeconds int             `json:"timeout_seconds"`
+	CreatedAt      string          `json:"created_at"`
+	// PayloadVersion is the payload protocol version (0 = sent by a server that
+	// predates versioning, read as 1)
+	PayloadVersion int `json:"payload_version,omitempty"`
+	// Attempt counts the previous failed runs of the task: a retry after a failure
+	// is a new attempt, a re-delivery of the same attempt is not
+	Attempt int `json:"attempt,omitempty"`
 }
 
 // TasksResponse represents the response from GET /agent/tasks
@@ -101,22 +188,33 @@ type TasksResponse struct {
 
 // HeartbeatResponse represents the response from POST /agent/heartbeat
 type HeartbeatResponse struct {
-	ServerTime        string `json:"server_time"`
-	NextHeartbeatIn   int    `json:"next_heartbeat_in"`
+	ServerTime      string `json:"server_time"`
+	NextHeartbeatIn int    `json:"next_heartbeat_in"`
+	// CapabilitiesHash echoes the hash sent once the server holds the agent's complete
+	// capability set (empty: send everything next time)
+	CapabilitiesHash string `json:"capabilities_hash,omitempty"`
+}
+
+// CapabilityUpdate is the capability part of a heartbeat
+type CapabilityUpdate struct {
+	// Sections to store; nil when nothing changed since the last acknowledged heartbeat
+	Sections map[string]interface{}
+	// Partial is set when Sections only holds the changed sections
+	Partial bool
+	// Hash of the complete capability set
+	Hash string
 }
 
-// doRequest performs an HTTP request with mTLS
-func (c *Client) doRequest(ctx context.Context, method, path string, body interface{}) (*APIResponse, error) {
+// doAttempt performs a single HTTP request with mTLS against the endpoint baseURL.
+// Transport failures are returned as *transportError so the retry policy can tell
+// them from API answers.
+func (c *Client) doAttempt(ctx context.Context, baseURL, method, path string, jsonBody []byte, authorization string) (*APIResponse, error) {
 	var bodyReader io.Reader
-	if body != nil {
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal request body: %w", err)
-		}
+	if jsonBody != nil {
 		bodyReader = bytes.NewReader(jsonBody)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+path, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -125,46 +223,83 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body interf
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("User-Agent", "phpborg-agent/1.0")
 
-	// For development/testing, use UUID as bearer token
-	req.Header.Set("Authorization", "Bearer "+c.config.Agent.UUID)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, &transportError{err: err}
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, &transportError{err: fmt.Errorf("failed to read response body: %w", err)}
 	}
 
 	var apiResp APIResponse
 	if err := json.Unmarshal(respBody, &apiResp); err != nil {
+		if resp.StatusCode >= 400 {
+			// Not our API answering (reverse proxy error page, ...)
+			return nil, &APIError{Message: fmt.Sprintf("unexpected HTTP %d response", resp.StatusCode), StatusCode: resp.StatusCode}
+		}
 		return nil, fmt.Errorf("failed to parse response: %w (body: %s)", err, string(respBody))
 	}
 
 	if !apiResp.Success {
-		errMsg := "unknown error"
-		if apiResp.Error != nil {
-			errMsg = apiResp.Error.Message
+		apiErr := apiResp.Error
+		if apiErr == nil {
+			apiErr = &APIError{Message: "unknown error"}
 		}
-		return nil, fmt.Errorf("API error: %s", errMsg)
+		apiErr.StatusCode = resp.StatusCode
+		return nil, apiErr
 	}
 
 	return &apiResp, nil
 }
 
+// HeartbeatRequest is what a heartbeat reports
+type HeartbeatRequest struct {
+	Version      string
+	OSInfo       string
+	Capabilities CapabilityUpdate
+	// TaskTypes the agent can run; the server only dispatches these
+	TaskTypes []string
+	// ClockSkew is the server clock minus the agent clock, measured on the previous
+	// heartbeat (nil = unknown)
+	ClockSkew *time.Duration
+	// BorgHost is the borg SSH host in use (empty = none configured)
+	BorgHost string
+}
+
 // SendHeartbeat sends a heartbeat to the server
-func (c *Client) SendHeartbeat(ctx context.Context, version string, capabilities map[string]interface{}, osInfo string) (*HeartbeatResponse, error) {
+func (c *Client) SendHeartbeat(ctx context.Context, req HeartbeatRequest) (*HeartbeatResponse, error) {
 	body := map[string]interface{}{
-		"version": version,
+		"version": req.Version,
+		// The endpoint in use when the heartbeat is sent (see endpoints)
+		"api_endpoint": c.endpoints.current(),
+	}
+	if req.Capabilities.Sections != nil {
+		body["capabilities"] = req.Capabilities.Sections
+		if req.Capabilities.Partial {
+			body["capabilities_partial"] = true
+		}
+	}
+	if req.Capabilities.Hash != "" {
+		body["capabilities_hash"] = req.Capabilities.Hash
+	}
+	if req.OSInfo != "" {
+		body["os_info"] = req.OSInfo
+	}
+	if len(req.TaskTypes) > 0 {
+		body["task_types"] = req.TaskTypes
 	}
-	if capabilities != nil {
-		body["capabilities"] = capabilities
+	if req.ClockSkew != nil {
+		body["clock_skew_seconds"] = req.ClockSkew.Seconds()
 	}
-	if osInfo != "" {
-		body["os_info"] = osInfo
+	if req.BorgHost != "" {
+		body["borg_host"] = req.BorgHost
 	}
 
 	resp, err := c.doRequest(ctx, "POST", "/agent/heartbeat", body)
@@ -195,10 +330,17 @@ func (c *Client) GetTasks(ctx context.Context) (*TasksResponse, error) {
 	return &tasks, nil
 }
 
-// StartTask marks a task as started
-func (c *Client) StartTask(ctx context.Context, taskID int) error {
-	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/agent/tasks/%d/start", taskID), nil)
-	return err
+// StartTask marks a task as started, claiming it with a lease of the given duration.
+// The returned lease is nil when the server does not grant leases (older phpBorg).
+func (c *Client) StartTask(ctx context.Context, taskID int, lease time.Duration) (*TaskLease, error) {
+	body := map[string]interface{}{
+		"lease_seconds": int(lease.Seconds()),
+	}
+	resp, err := c.doNonIdempotentRequest(ctx, "POST", fmt.Sprintf("/agent/tasks/%d/start", taskID), body)
+	if err != nil {
+		return nil, err
+	}
+	return parseLease(resp)
 }
 
 // UpdateProgress updates task progress with a simple message
@@ -210,10 +352,23 @@ func (c *Client) UpdateProgress(ctx context.Context, taskID int, progress int, m
 		body["message"] = message
 	}
 
+	c.observeProgress(taskID, progress, ProgressInfo{Message: message})
 	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/agent/tasks/%d/progress", taskID), body)
 	return err
 }
 
+// SetProgressObserver registers fn to see every progress update sent (local status
+// API). Must be called before the client is used.
+func (c *Client) SetProgressObserver(fn func(taskID int, progress int, info ProgressInfo)) {
+	c.progressObserver = fn
+}
+
+func (c *Client) observeProgress(taskID int, progress int, info ProgressInfo) {
+	if c.progressObserver != nil {
+		c.progressObserver(taskID, progress, info)
+	}
+}
+
 // ProgressInfo contains detailed progress information for borg backup
 type ProgressInfo struct {
 	FilesCount       int64  `json:"files_count"`
@@ -229,6 +384,7 @@ type ProgressInfo struct {
 
 // UpdateProgressWithInfo updates task progress with detailed borg statistics
 func (c *Client) UpdateProgressWithInfo(ctx context.Context, taskID int, progress int, info ProgressInfo) error {
+	c.observeProgress(taskID, progress, info)
 	body := map[string]interface{}{
 		"progress":          progress,
 		"files_count":       info.FilesCount,
@@ -327,12 +483,18 @@ func (c *Client) CheckUpdate(ctx context.Context, currentVersion string) (*Updat
 // DownloadUpdate downloads the agent binary to a temporary file
 // Returns the path to the downloaded file
 func (c *Client) DownloadUpdate(ctx context.Context, destPath string) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/agent/update/download", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.endpoints.current()+"/agent/update/download", nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.config.Agent.UUID)
+	authorization, err := c.authorization(ctx)
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
 	req.Header.Set("User-Agent", "phpborg-agent/1.0")
 
 	resp, err := c.httpClient.Do(req)
@@ -361,22 +523,25 @@ func (c *Client) DownloadUpdate(ctx context.Context, destPath string) error {
 	return nil
 }
 
-// CertificateRenewalResponse contains new certificates from renewal
+// CertificateRenewalResponse contains the certificate issued from a renewal CSR
 type CertificateRenewalResponse struct {
 	Cert      string `json:"cert"`       // Base64 encoded certificate
-	Key       string `json:"key"`        // Base64 encoded private key
 	CA        string `json:"ca"`         // Base64 encoded CA certificate
 	ExpiresAt string `json:"expires_at"` // Expiration date
 }
 
-// RenewCertificate requests a new certificate from the server
-func (c *Client) RenewCertificate(ctx context.Context) (*CertificateRenewalResponse, error) {
+// RenewCertificate sends a CSR for a locally generated key. signature is the SHA-256
+// signature of the CSR by the current certificate key, proving the request comes from
+// the holder of the certificate being renewed.
+func (c *Client) RenewCertificate(ctx context.Context, csrPEM, signature []byte) (*CertificateRenewalResponse, error) {
 	body := map[string]interface{}{
-		"agent_uuid": c.config.Agent.UUID,
-		"agent_name": c.config.Agent.Name,
+		"agent_uuid":    c.config.Agent.UUID,
+		"agent_name":    c.config.Agent.Name,
+		"csr":           string(csrPEM),
+		"csr_signature": base64.StdEncoding.EncodeToString(signature),
 	}
 
-	resp, err := c.doRequest(ctx, "POST", "/agent/certificate/renew", body)
+	resp, err := c.doNonIdempotentRequest(ctx, "POST", "/agent/certificate/renew", body)
 	if err != nil {
 		return nil, err
 	}
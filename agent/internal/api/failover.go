@@ -0,0 +1,69 @@
+package api
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// failoverThreshold is the number of consecutive failures (transport errors, 5xx) of
+// the active endpoint after which the client moves to the next one
+const failoverThreshold = 2
+
+// endpoints holds the API URLs of the server (server.url, server.urls) and the one in
+// use. The client stays on the active endpoint as long as it answers, and moves to
+// the next one once it keeps failing. It does not go back to the first endpoint on
+// its own: the endpoint that works is kept until it fails in turn.
+type endpoints struct {
+	urls []string
+
+	mu       sync.Mutex
+	active   int
+	failures int
+}
+
+func newEndpoints(urls []string) *endpoints {
+	return &endpoints{urls: urls}
+}
+
+// current returns the URL requests are sent to
+func (e *endpoints) current() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.urls) == 0 {
+		return ""
+	}
+	return e.urls[e.active]
+}
+
+// success records an answer of url
+func (e *endpoints) success(url string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.urls) > 0 && e.urls[e.active] == url {
+		e.failures = 0
+	}
+}
+
+// failure records a transport error or a 5xx of url. A failure of an endpoint that is
+// no longer active (request started before a failover) is ignored.
+func (e *endpoints) failure(url string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.urls) < 2 || e.urls[e.active] != url {
+		return
+	}
+	e.failures++
+	if e.failures < failoverThreshold {
+		return
+	}
+	e.active = (e.active + 1) % len(e.urls)
+	e.failures = 0
+	slog.Info("Endpoint failing, failing over", logging.ComponentKey, "API", "endpoint", url, "error", err, "next", e.urls[e.active])
+}
+
+// Endpoint returns the API endpoint in use
+func (c *Client) Endpoint() string {
+	return c.endpoints.current()
+}
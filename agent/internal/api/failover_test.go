@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEndpointsFailover(t *testing.T) {
+	const a, b, c = "https://a.example.com", "https://b.example.com", "https://c.example.com"
+	errDown := errors.New("connection refused")
+
+	// Each event is an answer of url (ok) or a failure; want is the endpoint in use after it
+	type event struct {
+		url  string
+		ok   bool
+		want string
+	}
+	tests := []struct {
+		name   string
+		urls   []string
+		events []event
+	}{
+		{"single failure keeps endpoint", []string{a, b}, []event{
+			{a, false, a},
+		}},
+		{"threshold fails over", []string{a, b}, []event{
+			{a, false, a},
+			{a, false, b},
+		}},
+		{"success resets failures", []string{a, b}, []event{
+			{a, false, a},
+			{a, true, a},
+			{a, false, a},
+		}},
+		{"stale failure ignored", []string{a, b}, []event{
+			{a, false, a},
+			{a, false, b},
+			{a, false, b},
+			{a, false, b},
+		}},
+		{"stale success does not reset", []string{a, b}, []event{
+			{a, false, a},
+			{a, false, b},
+			{b, false, b},
+			{a, true, b},
+			{b, false, a},
+		}},
+		{"working endpoint is kept", []string{a, b}, []event{
+			{a, false, a},
+			{a, false, b},
+			{b, true, b},
+			{b, true, b},
+		}},
+		{"wraps around", []string{a, b, c}, []event{
+			{a, false, a},
+			{a, false, b},
+			{b, false, b},
+			{b, false, c},
+			{c, false, c},
+			{c, false, a},
+		}},
+		{"single endpoint never fails over", []string{a}, []event{
+			{a, false, a},
+			{a, false, a},
+			{a, false, a},
+		}},
+		{"no endpoint", nil, []event{
+			{a, false, ""},
+			{a, true, ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEndpoints(tt.urls)
+			for i, ev := range tt.events {
+				if ev.ok {
+					e.success(ev.url)
+				} else {
+					e.failure(ev.url, errDown)
+				}
+				if got := e.current(); got != ev.want {
+					t.Fatalf("after event %d: current() = %q, want %q", i, got, ev.want)
+				}
+			}
+		})
+	}
+}
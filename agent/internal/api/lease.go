@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TaskLease is the claim of the agent on a running task. The server considers the
+// task abandoned once the lease expires without being renewed.
+type TaskLease struct {
+	Seconds   int       `json:"lease_seconds"`
+	ExpiresAt time.Time `json:"lease_expires_at"`
+}
+
+// parseLease reads the lease granted in a start or renew response (nil = none)
+func parseLease(resp *APIResponse) (*TaskLease, error) {
+	if len(resp.Data) == 0 || string(resp.Data) == "null" {
+		return nil, nil
+	}
+	var lease TaskLease
+	if err := json.Unmarshal(resp.Data, &lease); err != nil {
+		return nil, fmt.Errorf("failed to parse task lease: %w", err)
+	}
+	if lease.Seconds <= 0 {
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// IsLeaseLost reports whether a lease renewal failed because the server no longer
+// considers the task running on this agent: 409 LEASE_LOST, or 404 TASK_NOT_FOUND for
+// a deleted task. Any other error, 4xx included, may be temporary.
+func IsLeaseLost(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusConflict && apiErr.Code == "LEASE_LOST":
+		return true
+	case apiErr.StatusCode == http.StatusNotFound && apiErr.Code == "TASK_NOT_FOUND":
+		return true
+	}
+	return false
+}
+
+// RenewLease extends the lease on a running task. When it fails with IsLeaseLost the
+// lease is lost: the server no longer considers the task running on this agent.
+func (c *Client) RenewLease(ctx context.Context, taskID int, lease time.Duration) (*TaskLease, error) {
+	body := map[string]interface{}{
+		"lease_seconds": int(lease.Seconds()),
+	}
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/agent/tasks/%d/lease", taskID), body)
+	if err != nil {
+		return nil, err
+	}
+	return parseLease(resp)
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsLeaseLost(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"lease lost", &APIError{StatusCode: 409, Code: "LEASE_LOST"}, true},
+		{"wrapped lease lost", fmt.Errorf("renew: %w", &APIError{StatusCode: 409, Code: "LEASE_LOST"}), true},
+		{"task deleted", &APIError{StatusCode: 404, Code: "TASK_NOT_FOUND"}, true},
+		{"conflict without code", &APIError{StatusCode: 409}, false},
+		{"not found without code", &APIError{StatusCode: 404}, false},
+		{"forbidden", &APIError{StatusCode: 403}, false},
+		{"unauthorized", &APIError{StatusCode: 401, Code: "UNAUTHORIZED"}, false},
+		{"bad request", &APIError{StatusCode: 400, Code: "LEASE_LOST"}, false},
+		{"server error", &APIError{StatusCode: 500}, false},
+		{"transport error", errors.New("connection refused"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsLeaseLost(tt.err); got != tt.want {
+				t.Errorf("IsLeaseLost(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
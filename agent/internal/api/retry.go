@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/metrics"
+)
+
+// transportError is a request that got no HTTP answer (connection refused, timeout,
+// TLS failure, ...). It keeps the underlying error message.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// doRequest performs an idempotent API call (heartbeat, polling, progress, complete,
+// fail, ...): it is retried on any transport error and on 429/502/503/504.
+func (c *Client) doRequest(ctx context.Context, method, path string, body interface{}) (*APIResponse, error) {
+	return c.doWithRetry(ctx, method, path, body, callOptions{idempotent: true})
+}
+
+// doNonIdempotentRequest performs a call that must not run twice server-side (task
+// start, certificate renewal, ...). It is only retried when the request certainly did
+// not reach the application: connection not established, 429 or 503.
+func (c *Client) doNonIdempotentRequest(ctx context.Context, method, path string, body interface{}) (*APIResponse, error) {
+	return c.doWithRetry(ctx, method, path, body, callOptions{})
+}
+
+// callOptions tunes doWithRetry for one call
+type callOptions struct {
+	idempotent bool
+	// bearer replaces the agent credentials (enrollment and token refresh calls)
+	bearer string
+	// anonymous sends no credentials at all (registration, authenticated by the body)
+	anonymous bool
+}
+
+func (c *Client) doWithRetry(ctx context.Context, method, path string, body interface{}, opts callOptions) (*APIResponse, error) {
+	var jsonBody []byte
+	if body != nil {
+		var err error
+		jsonBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+	}
+
+	policy := c.config.Server.Retry
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var deadline time.Time
+	if policy.Budget > 0 {
+		deadline = time.Now().Add(policy.Budget)
+	}
+
+	reauthenticated := false
+	for attempt := 1; ; attempt++ {
+		authorization := ""
+		if opts.bearer != "" {
+			authorization = "Bearer " + opts.bearer
+		} else if !opts.anonymous {
+			var err error
+			if authorization, err = c.authorization(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		endpoint := metrics.Endpoint(path)
+		if err := c.breaker.allow(); err != nil {
+			metrics.APIErrors.Inc(endpoint, "circuit_open")
+			return nil, err
+		}
+
+		baseURL := c.endpoints.current()
+		start := time.Now()
+		resp, err := c.doAttempt(ctx, baseURL, method, path, jsonBody, authorization)
+		metrics.APIRequestDuration.Observe(time.Since(start).Seconds(), method, endpoint)
+		if err != nil {
+			metrics.APIErrors.Inc(endpoint, errorKind(err))
+		}
+		switch {
+		case err == nil:
+			c.breaker.success()
+			c.endpoints.success(baseURL)
+			return resp, nil
+		case ctx.Err() != nil:
+			c.breaker.release() // cancelled by the caller, says nothing about the server
+			return nil, err
+		case isServerFailure(err):
+			c.breaker.failure()
+			c.endpoints.failure(baseURL, err) // the next attempt may go to another endpoint
+		default:
+			c.breaker.success() // the server answered, even if it said no
+			c.endpoints.success(baseURL)
+		}
+
+		if isUnauthorized(err) && opts.bearer == "" && c.tokens != nil && !reauthenticated {
+			// Token revoked or expired early: refresh it and try once more.
+			logging.Component(ctx, "API").Info("Agent token rejected, refreshing it", "method", method, "path", path)
+			c.tokens.invalidate(strings.TrimPrefix(authorization, "Bearer "))
+			reauthenticated = true
+			attempt--
+			continue
+		}
+
+		if attempt >= attempts || !isRetryable(err, opts.idempotent) {
+			return nil, err
+		}
+
+		wait := backoffDelay(policy.InitialBackoff, policy.MaxBackoff, attempt)
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return nil, err // retry budget exhausted
+		}
+		logging.Component(ctx, "API").Info("Request failed, retrying", "method", method, "path", path, "attempt", attempt, "max_attempts", attempts, "error", err, "backoff", wait.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// BreakerState returns the circuit breaker state (BreakerClosed, BreakerOpen or
+// BreakerHalfOpen)
+func (c *Client) BreakerState() string {
+	return c.breaker.State()
+}
+
+// isServerFailure reports whether an error counts against the circuit breaker: no
+// answer at all, or a 5xx
+func isServerFailure(err error) bool {
+	var te *transportError
+	if errors.As(err, &te) {
+		return true
+	}
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode >= 500
+}
+
+// errorKind classifies a failed attempt for the API error metric
+func errorKind(err error) string {
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode >= 500:
+		return "http_5xx"
+	case errors.As(err, &apiErr) && apiErr.StatusCode >= 400:
+		return "http_4xx"
+	case errors.As(err, new(*transportError)):
+		return "transport"
+	}
+	return "other"
+}
+
+// isRetryable decides whether a failed attempt may be sent again
+func isRetryable(err error, idempotent bool) bool {
+	var te *transportError
+	if errors.As(err, &te) {
+		return idempotent || isDialError(te.err)
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false // request could not even be built
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		// The backend may have processed the request before the proxy gave up.
+		return idempotent
+	}
+	return false
+}
+
+// isUnauthorized reports whether the server rejected the request credentials
+func isUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized
+}
+
+// isDialError reports whether the connection could not be established, i.e. the
+// request was never sent
+func isDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoffDelay returns an exponential backoff with full jitter for the given attempt
+// (1 = first retry). The ceiling stops doubling once it reaches max (or before it
+// would overflow), so any attempt number is safe.
+func backoffDelay(initial, max time.Duration, attempt int) time.Duration {
+	if initial <= 0 {
+		initial = 500 * time.Millisecond
+	}
+	ceiling := initial
+	for i := 1; i < attempt && (max <= 0 || ceiling < max) && ceiling <= math.MaxInt64/2; i++ {
+		ceiling *= 2
+	}
+	if max > 0 && ceiling > max {
+		ceiling = max
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
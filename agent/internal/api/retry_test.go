@@ -0,0 +1,36 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  time.Duration
+		max      time.Duration
+		attempt  int
+		wantUpTo time.Duration
+	}{
+		{"first retry", time.Second, 10 * time.Second, 1, time.Second},
+		{"doubles", time.Second, 10 * time.Second, 3, 4 * time.Second},
+		{"capped by max", time.Second, 10 * time.Second, 5, 10 * time.Second},
+		{"large attempt stays capped", time.Second, 10 * time.Second, 1000, 10 * time.Second},
+		{"shift past 63 bits", 500 * time.Millisecond, time.Minute, 64, time.Minute},
+		{"no max does not overflow", time.Second, 0, 200, math.MaxInt64},
+		{"default initial", 0, 0, 1, 500 * time.Millisecond},
+		{"max below initial", 2 * time.Second, time.Second, 1, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := backoffDelay(tt.initial, tt.max, tt.attempt)
+				if got < 1 || got > tt.wantUpTo {
+					t.Fatalf("backoffDelay(%v, %v, %d) = %v, want 1ns..%v", tt.initial, tt.max, tt.attempt, got, tt.wantUpTo)
+				}
+			}
+		})
+	}
+}
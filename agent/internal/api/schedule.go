@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Schedule is the backup schedule of the agent's servers, from GET /agent/schedule
+type Schedule struct {
+	// IANA time zone of the schedule times (the server's)
+	Timezone string         `json:"timezone"`
+	Jobs     []ScheduledJob `json:"jobs"`
+	// Version of the backup payloads (see Task.PayloadVersion)
+	PayloadVersion int       `json:"payload_version,omitempty"`
+	GeneratedAt    time.Time `json:"generated_at"`
+}
+
+// ScheduledJob is a scheduled backup job of the server
+type ScheduledJob struct {
+	ID       int         `json:"id"`
+	Name     string      `json:"name"`
+	Schedule JobSchedule `json:"schedule"`
+	// Last run started by the server, nil if never
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	// Archives are named <archive_prefix>_<date>, as the server names them
+	ArchivePrefix string `json:"archive_prefix"`
+	// backup_create payload without archive_name and passphrase
+	Backup json.RawMessage `json:"backup"`
+	// Encrypted repositories need the passphrase, sent only to agents with a
+	// secret store
+	Encrypted  bool   `json:"encrypted"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// JobSchedule is when a job runs, as set on the server
+type JobSchedule struct {
+	Type       string `json:"type"` // daily, weekly, monthly, custom
+	Time       string `json:"time"` // HH:MM[:SS]
+	DayOfWeek  int    `json:"day_of_week,omitempty"`
+	DayOfMonth int    `json:"day_of_month,omitempty"`
+	Cron       string `json:"cron,omitempty"`
+}
+
+// GetSchedule fetches the backup schedule. Passphrases are only asked for withSecrets,
+// when the agent keeps them in its secret store.
+func (c *Client) GetSchedule(ctx context.Context, withSecrets bool) (*Schedule, error) {
+	path := "/agent/schedule"
+	if withSecrets {
+		path += "?secrets=1"
+	}
+	resp, err := c.doRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule Schedule
+	if err := json.Unmarshal(resp.Data, &schedule); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule response: %w", err)
+	}
+	return &schedule, nil
+}
+
+// OfflineRun is a backup the agent ran on its own while the server was unreachable
+type OfflineRun struct {
+	// Generated by the agent; the server ignores a run it already has
+	RunID       string                 `json:"run_id"`
+	JobID       int                    `json:"backup_job_id"`
+	ArchiveName string                 `json:"archive_name"`
+	Status      string                 `json:"status"` // completed, failed
+	Result      map[string]interface{} `json:"result,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	ExitCode    int                    `json:"exit_code"`
+	StartedAt   time.Time              `json:"started_at"`
+	FinishedAt  time.Time              `json:"finished_at"`
+	// Scheduled time the job was due at: the server cancels the backups of the job it
+	// queued for the same window
+	ScheduledAt time.Time `json:"scheduled_at"`
+}
+
+// UploadOfflineRun reports an offline run to the server
+func (c *Client) UploadOfflineRun(ctx context.Context, run OfflineRun) error {
+	_, err := c.doRequest(ctx, "POST", "/agent/offline-runs", run)
+	return err
+}
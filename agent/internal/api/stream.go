@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStreamUnsupported is returned by StreamTasks when the server does not offer the
+// push channel (older phpBorg). The agent then stays on plain polling.
+var ErrStreamUnsupported = errors.New("server does not support the task stream")
+
+// streamIdleTimeout bounds how long the stream may stay silent. The server sends a
+// "ping" event well within this window, so a silent stream is a dead one (half-open
+// TCP behind a NAT or a reverse proxy that swallowed the connection).
+const streamIdleTimeout = 90 * time.Second
+
+// Task stream event types
+const (
+	StreamEventTask   = "task"
+	StreamEventCancel = "cancel"
+	StreamEventPing   = "ping"
+)
+
+// TaskEvent is a message pushed by the server on the task stream
+type TaskEvent struct {
+	Type   string
+	Task   *Task
+	TaskID int
+}
+
+// cancelEvent is the data of a "cancel" stream event
+type cancelEvent struct {
+	TaskID int `json:"task_id"`
+}
+
+// StreamTasks opens the server-sent-events channel GET /agent/tasks/stream and calls
+// onEvent for every task or cancellation the server pushes. It blocks until the
+// stream ends and always returns a non-nil error: the context error on shutdown,
+// ErrStreamUnsupported when the server has no push channel, or the reason the
+// connection dropped. onConnected is called once the stream is established.
+func (c *Client) StreamTasks(ctx context.Context, onConnected func(), onEvent func(TaskEvent)) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(streamCtx, "GET", c.endpoints.current()+"/agent/tasks/stream", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("User-Agent", "phpborg-agent/1.0")
+	authorization, err := c.authorization(ctx)
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := c.streamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("stream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return ErrStreamUnsupported
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("stream failed with status: %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		// A router that answers unknown routes with a JSON error page.
+		return ErrStreamUnsupported
+	}
+
+	if onConnected != nil {
+		onConnected()
+	}
+
+	// Watchdog: any line (event or comment) proves the stream is alive.
+	var watchdogMu sync.Mutex
+	watchdog := time.AfterFunc(streamIdleTimeout, cancel)
+	defer watchdog.Stop()
+	touch := func() {
+		watchdogMu.Lock()
+		watchdog.Reset(streamIdleTimeout)
+		watchdogMu.Unlock()
+	}
+
+	var eventType string
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		touch()
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// Blank line => dispatch the accumulated event
+			if data.Len() > 0 || eventType != "" {
+				c.dispatchStreamEvent(eventType, data.String(), onEvent)
+			}
+			eventType = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// Comment (keepalive)
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if streamCtx.Err() != nil {
+		return fmt.Errorf("stream idle for more than %v", streamIdleTimeout)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("stream read failed: %w", err)
+	}
+	return errors.New("stream closed by server")
+}
+
+// dispatchStreamEvent decodes one SSE event and hands it to onEvent
+func (c *Client) dispatchStreamEvent(eventType, data string, onEvent func(TaskEvent)) {
+	switch eventType {
+	case StreamEventTask:
+		var task Task
+		if err := json.Unmarshal([]byte(data), &task); err != nil {
+			return
+		}
+		onEvent(TaskEvent{Type: StreamEventTask, Task: &task, TaskID: task.ID})
+	case StreamEventCancel:
+		var ev cancelEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil || ev.TaskID == 0 {
+			return
+		}
+		onEvent(TaskEvent{Type: StreamEventCancel, TaskID: ev.TaskID})
+	case StreamEventPing:
+		onEvent(TaskEvent{Type: StreamEventPing})
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// Task log levels
+const (
+	TaskLogDebug   = "debug"
+	TaskLogInfo    = "info"
+	TaskLogWarning = "warning"
+	TaskLogError   = "error"
+)
+
+// Task log sources
+const (
+	TaskLogSourceAgent = "agent" // decisions taken by the agent (retries, launch mode, ...)
+	TaskLogSourceBorg  = "borg"  // borg log messages and other command output
+)
+
+const (
+	taskLogBatchSize     = 100             // entries per request
+	taskLogFlushInterval = 2 * time.Second // max delay before an entry is sent
+	taskLogMaxPending    = 2000            // entries kept while the server is unreachable
+	taskLogRate          = 20              // sustained entries per second
+	taskLogBurst         = 200             // entries accepted at once above the rate
+	taskLogMaxMessage    = 4096            // bytes per message
+	taskLogCloseTimeout  = 10 * time.Second
+)
+
+// TaskLogEntry is one line of a task log. Seq increases by one per entry of a task, so
+// the server can order entries and ignore the duplicates of a retried batch.
+type TaskLogEntry struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// TaskLog ships the log of one running task to the server while it runs
+// (POST /agent/tasks/{id}/log), in batches and rate-limited: entries above the rate
+// are dropped and counted in a notice. All methods are no-ops on a nil TaskLog.
+type TaskLog struct {
+	client *Client
+	taskID int
+
+	mu       sync.Mutex
+	pending  []TaskLogEntry
+	seq      int64
+	dropped  int
+	tokens   float64
+	refillAt time.Time
+	closed   bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// OpenTaskLog starts the log channel of a task. Close it when the task ends.
+func (c *Client) OpenTaskLog(taskID int) *TaskLog {
+	l := &TaskLog{
+		client:   c,
+		taskID:   taskID,
+		tokens:   taskLogBurst,
+		refillAt: time.Now(),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Add queues a log entry
+func (l *TaskLog) Add(level, source, message string) {
+	if l == nil {
+		return
+	}
+	if len(message) > taskLogMaxMessage {
+		message = message[:taskLogMaxMessage] + "...[truncated]"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.client.taskLogUnsupported.Load() {
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.refillAt).Seconds() * taskLogRate
+	if l.tokens > taskLogBurst {
+		l.tokens = taskLogBurst
+	}
+	l.refillAt = now
+	if l.tokens < 1 || len(l.pending) >= taskLogMaxPending {
+		l.dropped++
+		return
+	}
+	l.tokens--
+
+	l.seq++
+	l.pending = append(l.pending, TaskLogEntry{Seq: l.seq, Time: now.UTC(), Level: level, Source: source, Message: message})
+	if len(l.pending) >= taskLogBatchSize {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Logf queues an agent entry
+func (l *TaskLog) Logf(level, format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.Add(level, TaskLogSourceAgent, fmt.Sprintf(format, args...))
+}
+
+// Close sends what is left (waiting at most a few seconds) and stops the channel
+func (l *TaskLog) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.wake)
+	<-l.done
+}
+
+func (l *TaskLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(taskLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case _, ok := <-l.wake:
+			if !ok {
+				ctx, cancel := context.WithTimeout(context.Background(), taskLogCloseTimeout)
+				l.flush(ctx)
+				cancel()
+				if n := len(l.pending); n > 0 {
+					slog.Warn("Task log entries could not be sent", logging.ComponentKey, "API", "task_id", l.taskID, "entries", n)
+				}
+				return
+			}
+		case <-ticker.C:
+		}
+		l.flush(context.Background())
+	}
+}
+
+// flush sends the pending entries batch by batch. Entries stay queued when the server
+// cannot be reached and are dropped when it rejects them.
+func (l *TaskLog) flush(ctx context.Context) {
+	for {
+		l.mu.Lock()
+		if l.dropped > 0 {
+			l.seq++
+			l.pending = append(l.pending, TaskLogEntry{
+				Seq: l.seq, Time: time.Now().UTC(), Level: TaskLogWarning, Source: TaskLogSourceAgent,
+				Message: fmt.Sprintf("%d log line(s) dropped (rate limit)", l.dropped),
+			})
+			l.dropped = 0
+		}
+		n := len(l.pending)
+		if n > taskLogBatchSize {
+			n = taskLogBatchSize
+		}
+		batch := append([]TaskLogEntry(nil), l.pending[:n]...)
+		l.mu.Unlock()
+
+		if len(batch) == 0 || l.client.taskLogUnsupported.Load() {
+			return
+		}
+
+		err := l.client.AppendTaskLog(ctx, l.taskID, batch)
+		var apiErr *APIError
+		switch {
+		case err == nil, IsRejected(err):
+			if errors.As(err, &apiErr) && apiErr.Code != "TASK_NOT_FOUND" &&
+				(apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusMethodNotAllowed) {
+				if !l.client.taskLogUnsupported.Swap(true) {
+					slog.Info("Server has no task log endpoint, task logs are not streamed", logging.ComponentKey, "API")
+				}
+			} else if err != nil {
+				slog.Warn("Task log batch rejected", logging.ComponentKey, "API", "task_id", l.taskID, "error", err)
+			}
+			l.mu.Lock()
+			l.pending = l.pending[len(batch):]
+			l.mu.Unlock()
+		default:
+			return // server unreachable: keep the entries for the next flush
+		}
+	}
+}
+
+// AppendTaskLog sends log entries of a running task. Sequence numbers make the call
+// safe to retry.
+func (c *Client) AppendTaskLog(ctx context.Context, taskID int, entries []TaskLogEntry) error {
+	body := map[string]interface{}{
+		"entries": entries,
+	}
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/agent/tasks/%d/log", taskID), body)
+	return err
+}
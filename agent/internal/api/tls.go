@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/phpborg/phpborg-agent/internal/config"
+)
+
+// PinPrefix starts a server public key pin: "sha256//" followed by the base64 SHA-256
+// of the certificate's SubjectPublicKeyInfo (same format as curl --pinnedpubkey)
+const PinPrefix = "sha256//"
+
+// applyServerTrust configures how the server certificate is verified: the system
+// roots by default, tls.server_ca_file for a private PKI, and optionally public key
+// pins checked on top of the chain verification.
+func applyServerTrust(tlsConfig *tls.Config, cfg *config.Config) error {
+	if cfg.TLS.ServerCAFile != "" {
+		pemData, err := os.ReadFile(cfg.TLS.ServerCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read server CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return fmt.Errorf("no certificate found in server CA file %s", cfg.TLS.ServerCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cfg.TLS.ServerPins) > 0 {
+		pins := make(map[string]bool, len(cfg.TLS.ServerPins))
+		for _, pin := range cfg.TLS.ServerPins {
+			pins[strings.TrimPrefix(pin, PinPrefix)] = true
+		}
+		// VerifyConnection also runs with insecure_skip_verify, which then trusts the
+		// pinned leaf key alone.
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return nil
+}
+
+// verifyPins accepts the connection if a certificate of a verified chain (leaf,
+// intermediate or root) has a pinned public key. The certificates the server sent are
+// not trusted as such: a MITM could append the pinned CA to its own chain. Without
+// chain verification (insecure_skip_verify) only the leaf, whose key the handshake
+// proved the server holds, is checked.
+func verifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	candidates := cs.VerifiedChains
+	if len(candidates) == 0 && len(cs.PeerCertificates) > 0 {
+		candidates = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+	}
+
+	var presented []string
+	seen := make(map[string]bool)
+	for _, chain := range candidates {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			if pins[pin] {
+				return nil
+			}
+			if !seen[pin] {
+				seen[pin] = true
+				presented = append(presented, PinPrefix+pin)
+			}
+		}
+	}
+	return fmt.Errorf("server certificate pin mismatch for %s: server presented %s, none of them is in tls.server_pins",
+		cs.ServerName, strings.Join(presented, ", "))
+}
+
+// SPKIPin returns the base64 SHA-256 of a certificate's public key (without PinPrefix)
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
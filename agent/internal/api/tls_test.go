@@ -0,0 +1,68 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPins(t *testing.T) {
+	cert := func(key string) *x509.Certificate {
+		return &x509.Certificate{RawSubjectPublicKeyInfo: []byte(key)}
+	}
+	leaf, intermediate, root, rogue := cert("leaf"), cert("intermediate"), cert("root"), cert("rogue")
+	pinsOf := func(certs ...*x509.Certificate) map[string]bool {
+		pins := make(map[string]bool)
+		for _, c := range certs {
+			pins[SPKIPin(c)] = true
+		}
+		return pins
+	}
+
+	tests := []struct {
+		name     string
+		verified [][]*x509.Certificate
+		peer     []*x509.Certificate
+		pins     map[string]bool
+		wantErr  string
+	}{
+		{"leaf pinned", [][]*x509.Certificate{{leaf, intermediate, root}}, []*x509.Certificate{leaf, intermediate}, pinsOf(leaf), ""},
+		{"intermediate pinned", [][]*x509.Certificate{{leaf, intermediate, root}}, []*x509.Certificate{leaf, intermediate}, pinsOf(intermediate), ""},
+		{"root pinned", [][]*x509.Certificate{{leaf, intermediate, root}}, []*x509.Certificate{leaf, intermediate}, pinsOf(root), ""},
+		{"pinned in second chain", [][]*x509.Certificate{{leaf, rogue}, {leaf, intermediate, root}}, []*x509.Certificate{leaf}, pinsOf(root), ""},
+		{"one of several pins", [][]*x509.Certificate{{leaf, intermediate, root}}, []*x509.Certificate{leaf}, pinsOf(rogue, intermediate), ""},
+		{"no pinned key", [][]*x509.Certificate{{leaf, intermediate, root}}, []*x509.Certificate{leaf, intermediate}, pinsOf(rogue), "pin mismatch"},
+		{"pinned cert appended outside verified chain", [][]*x509.Certificate{{rogue, root}}, []*x509.Certificate{rogue, intermediate}, pinsOf(intermediate), "pin mismatch"},
+		{"unverified leaf pinned", nil, []*x509.Certificate{leaf, intermediate}, pinsOf(leaf), ""},
+		{"unverified intermediate not trusted", nil, []*x509.Certificate{rogue, intermediate}, pinsOf(intermediate), "pin mismatch"},
+		{"no certificate", nil, nil, pinsOf(leaf), "pin mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := tls.ConnectionState{ServerName: "phpborg.example.com", VerifiedChains: tt.verified, PeerCertificates: tt.peer}
+			err := verifyPins(cs, tt.pins)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("verifyPins() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("verifyPins() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyPinsReportsPresentedKeys(t *testing.T) {
+	leaf := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("leaf")}
+	root := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("root")}
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, root}, {leaf, root}}}
+	err := verifyPins(cs, map[string]bool{"other": true})
+	if err == nil {
+		t.Fatal("verifyPins() accepted an unpinned chain")
+	}
+	for _, c := range []*x509.Certificate{leaf, root} {
+		if n := strings.Count(err.Error(), PinPrefix+SPKIPin(c)); n != 1 {
+			t.Errorf("error %q lists pin of %s %d times, want once", err, c.RawSubjectPublicKeyInfo, n)
+		}
+	}
+}
@@ -2,6 +2,10 @@ package cert
 
 import (
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
@@ -98,6 +102,11 @@ func (r *Renewer) checkAndRenew(ctx context.Context) {
 	}
 
 	log.Println("[CERT] Certificate renewed successfully")
+
+	// Present the new certificate from now on, not after the next restart
+	if err := r.client.ReloadCertificate(); err != nil {
+		log.Printf("[CERT] Failed to load the renewed certificate, will retry: %v", err)
+	}
 }
 
 // getCertificateExpiry reads the current certificate and returns its expiration time
@@ -120,10 +129,39 @@ func (r *Renewer) getCertificateExpiry() (time.Time, error) {
 	return cert.NotAfter, nil
 }
 
-// renewCertificate requests and installs new certificates
+// renewCertificate generates a new key locally, has the server sign a CSR for it and
+// installs the result. The private key never leaves the host.
 func (r *Renewer) renewCertificate(ctx context.Context) error {
+	// The CSR is signed with the current key so the server knows who is asking.
+	current, err := tls.LoadX509KeyPair(r.config.TLS.CertFile, r.config.TLS.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load current certificate: %w", err)
+	}
+	signer, ok := current.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported current key type %T", current.PrivateKey)
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	keyData, err := EncodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	csr, err := CreateCSR(key, r.config.Agent.UUID)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(csr)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign CSR: %w", err)
+	}
+
 	// Request new certificate from server
-	renewal, err := r.client.RenewCertificate(ctx)
+	renewal, err := r.client.RenewCertificate(ctx, csr, signature)
 	if err != nil {
 		return fmt.Errorf("failed to request certificate renewal: %w", err)
 	}
@@ -134,16 +172,16 @@ func (r *Renewer) renewCertificate(ctx context.Context) error {
 		return fmt.Errorf("failed to decode certificate: %w", err)
 	}
 
-	keyData, err := base64.StdEncoding.DecodeString(renewal.Key)
-	if err != nil {
-		return fmt.Errorf("failed to decode key: %w", err)
-	}
-
 	caData, err := base64.StdEncoding.DecodeString(renewal.CA)
 	if err != nil {
 		return fmt.Errorf("failed to decode CA: %w", err)
 	}
 
+	// Never install a certificate that does not belong to the new key
+	if err := VerifyKeyPair(certData, keyData); err != nil {
+		return fmt.Errorf("server returned an unusable certificate: %w", err)
+	}
+
 	// Create backup of current certificates
 	backupDir := filepath.Join(filepath.Dir(r.config.TLS.CertFile), "backup")
 	if err := os.MkdirAll(backupDir, 0700); err != nil {
@@ -223,6 +261,14 @@ func (r *Renewer) writeFileAtomic(path string, data []byte, perm os.FileMode) er
 	return nil
 }
 
+// CertificateExpiry returns when the client certificate expires (for external use)
+func (r *Renewer) CertificateExpiry() (time.Time, error) {
+	if !r.config.UseTLS() {
+		return time.Time{}, fmt.Errorf("mTLS not configured")
+	}
+	return r.getCertificateExpiry()
+}
+
 // NeedsRenewal checks if certificate needs renewal (for external use)
 func (r *Renewer) NeedsRenewal() bool {
 	if !r.config.UseTLS() {
@@ -1,15 +1,22 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// MaxRetryAttempts bounds server.retry.max_attempts
+const MaxRetryAttempts = 20
+
 // GetDefaultConfigPath returns the platform-specific default config path
 func GetDefaultConfigPath() string {
 	if runtime.GOOS == "windows" {
@@ -46,6 +53,18 @@ func GetDefaultDataDir() string {
 	return "/var/lib/phpborg-agent"
 }
 
+// GetDefaultHooksDir returns the platform-specific default backup hook directory
+func GetDefaultHooksDir() string {
+	return filepath.Join(filepath.Dir(GetDefaultConfigPath()), "hooks.d")
+}
+
+// GetDefaultSecretKeyFile returns the platform-specific default key of the local
+// secret store. It lives in the data directory, which the agent may write under the
+// systemd unit (/etc is read-only there).
+func GetDefaultSecretKeyFile() string {
+	return filepath.Join(GetDefaultDataDir(), "secrets.key")
+}
+
 // GetDefaultTempDir returns the platform-specific temp directory
 func GetDefaultTempDir() string {
 	if runtime.GOOS == "windows" {
@@ -80,6 +99,68 @@ type Config struct {
 
 	// TLS/mTLS configuration
 	TLS TLSConfig `yaml:"tls"`
+
+	// Agent token authentication
+	Auth AuthConfig `yaml:"auth"`
+
+	// Egress proxy for API and borg SSH traffic
+	Proxy ProxyConfig `yaml:"proxy"`
+
+	// Prometheus metrics endpoint
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// Backup hooks
+	Hooks HooksConfig `yaml:"hooks"`
+
+	// Local run of the backup schedule while the server is unreachable
+	Offline OfflineConfig `yaml:"offline"`
+}
+
+// OfflineConfig holds the offline schedule settings. The agent keeps a copy of the
+// backup schedule of its server; once the server has been unreachable for a while it
+// runs the due backups itself and uploads their outcome when the server is back.
+type OfflineConfig struct {
+	// Sync the schedule and run due backups during outages (default: false)
+	Enabled bool `yaml:"enabled"`
+
+	// How long the server must be unreachable before the agent runs backups itself
+	After time.Duration `yaml:"after"`
+
+	// How often the schedule is synced from the server
+	SyncInterval time.Duration `yaml:"sync_interval"`
+
+	// Key of the local secret store holding the repository passphrases, created on
+	// first use (default /var/lib/phpborg-agent/secrets.key). Empty = passphrases are
+	// not synced and encrypted repositories are not backed up during outages.
+	SecretKeyFile string `yaml:"secret_key_file"`
+}
+
+// HooksConfig holds the backup hook settings. A backup task names the hooks to run;
+// only executables of the hook directory can be named, so the server cannot make the
+// agent run arbitrary commands.
+type HooksConfig struct {
+	// Directory of the allowed hooks (default /etc/phpborg-agent/hooks.d). It and its
+	// hooks must be owned by root or the agent user and not writable by group or others.
+	Dir string `yaml:"dir"`
+
+	// Timeout of a hook that does not set its own
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// AuthConfig holds the agent token settings. A one-time enrollment token is exchanged
+// for a signed, expiring agent token that is refreshed automatically. It can be combined
+// with mTLS; with mTLS alone no token is needed.
+type AuthConfig struct {
+	// File storing the agent token (default: <data_dir>/agent-token.json)
+	TokenFile string `yaml:"token_file"`
+
+	// One-time enrollment token from the server, used on first start only
+	EnrollmentToken string `yaml:"enrollment_token"`
+
+	// Send the agent UUID as bearer token, for servers without token support. The
+	// server only accepts it from agents registered before agent tokens that have not
+	// enrolled since. Insecure: anyone knowing the UUID can impersonate the agent.
+	LegacyUUIDBearer bool `yaml:"legacy_uuid_bearer"`
 }
 
 // ServerConfig holds phpBorg server connection details
@@ -87,8 +168,41 @@ type ServerConfig struct {
 	// API endpoint URL (e.g., https://phpborg.example.com/api)
 	URL string `yaml:"url"`
 
+	// Further API endpoints of the same server (e.g. a second front-end). The agent
+	// uses the first that works and fails over to the next when it stops answering;
+	// it then stays on the new one. url, when set, comes first.
+	URLs []string `yaml:"urls,omitempty"`
+
 	// Skip TLS verification (for development only)
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+
+	// Retry policy and circuit breaker for API calls
+	Retry RetryConfig `yaml:"retry"`
+}
+
+// RetryConfig holds the API retry policy. Idempotent calls (heartbeat, progress,
+// complete, ...) are retried on transport errors and 429/502/503/504; calls that must not
+// run twice (task start, certificate renewal) only when the request was not delivered.
+type RetryConfig struct {
+	// Maximum attempts per call, including the first one (1 = no retry, at most
+	// MaxRetryAttempts)
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// Backoff before the first retry, doubled each time (with full jitter)
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+
+	// Upper bound of a single backoff
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// Total time a call may spend retrying (0 = bounded by max_attempts only)
+	Budget time.Duration `yaml:"budget"`
+
+	// Consecutive failures (transport errors, 5xx) that open the circuit breaker (0 = disabled)
+	BreakerThreshold int `yaml:"breaker_threshold"`
+
+	// How long the open breaker rejects calls before probing the server, doubled
+	// after each failed probe (max 5m)
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
 }
 
 // AgentConfig holds agent identity information
@@ -102,6 +216,23 @@ type AgentConfig struct {
 	// Maximum concurrent tasks
 	MaxConcurrentTasks int `yaml:"max_concurrent_tasks"`
 
+	// On shutdown, how long running tasks may continue before being stopped (0 = stop
+	// them at once). The systemd unit the agent writes (install, self-update) stops it
+	// after this plus platform.SystemdStopMargin.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+
+	// Concurrency limits per task type (e.g. backup_create: 1) or per concurrency
+	// class (borg, system, update); each at least 1, types and classes not listed are
+	// only bounded by max_concurrent_tasks. Default backup_create: 1, which keeps the
+	// other workers for restores and light tasks; entries of the file are added to it.
+	TaskLimits map[string]int `yaml:"task_limits"`
+
+	// Directory for the agent's persistent state (task queue, ledger, spool)
+	DataDir string `yaml:"data_dir"`
+
+	// Unix socket of the local read-only status API (default: <data_dir>/status.sock)
+	StatusSocket string `yaml:"status_socket"`
+
 	// Agent version (set at runtime from main.go)
 	Version string `yaml:"-"`
 }
@@ -111,6 +242,11 @@ type BorgSSHConfig struct {
 	// phpBorg server hostname for borg connections
 	Host string `yaml:"host"`
 
+	// Further hostnames of the borg SSH server, tried in order when the active one
+	// is unreachable. Repositories on any of them are reached through the active one.
+	// host, when set, comes first.
+	Hosts []string `yaml:"hosts,omitempty"`
+
 	// SSH port for borg (default: 2222)
 	Port int `yaml:"port"`
 
@@ -129,8 +265,38 @@ type PollingConfig struct {
 	// Task polling interval
 	Interval time.Duration `yaml:"interval"`
 
-	// Heartbeat interval
+	// Heartbeat interval. The server's agent.heartbeat_interval setting, when set,
+	// overrides it.
 	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+
+	// Receive tasks over the server push channel; polling is only used while the
+	// channel is down (default: true)
+	Stream bool `yaml:"stream"`
+}
+
+// ProxyConfig holds the egress proxy settings. API traffic goes through URL (HTTP
+// CONNECT or SOCKS5); borg SSH through a jump host or a ProxyCommand.
+type ProxyConfig struct {
+	// Proxy for API traffic: http://[user:pass@]host:port or socks5://host:port.
+	// Empty = HTTPS_PROXY/NO_PROXY from the environment.
+	URL string `yaml:"url"`
+
+	// Tunnel borg SSH through URL as well (netcat-style ProxyCommand, needs OpenBSD nc)
+	SSHThroughProxy bool `yaml:"ssh_through_proxy"`
+
+	// SSH jump host for borg connections ([user@]host[:port], ssh -J)
+	SSHJump string `yaml:"ssh_jump"`
+
+	// Custom ssh ProxyCommand for borg connections (e.g. "corkscrew proxy 3128 %h %p"),
+	// takes precedence over ssh_through_proxy and ssh_jump
+	SSHProxyCommand string `yaml:"ssh_proxy_command"`
+}
+
+// MetricsConfig holds the Prometheus metrics endpoint settings
+type MetricsConfig struct {
+	// Listen address of the /metrics endpoint, e.g. "127.0.0.1:9469" (empty = disabled).
+	// The metrics are unauthenticated: bind to localhost or a monitoring network.
+	Listen string `yaml:"listen"`
 }
 
 // LoggingConfig holds logging settings
@@ -138,8 +304,24 @@ type LoggingConfig struct {
 	// Log level (debug, info, warn, error)
 	Level string `yaml:"level"`
 
-	// Log file path (empty = stdout)
+	// Log file path (empty = stderr)
 	File string `yaml:"file"`
+
+	// Output format: text, json or journald (empty = journald when started by systemd
+	// without a log file, text otherwise)
+	Format string `yaml:"format"`
+
+	// Rotate the log file once it reaches this size in MB (0 = never, e.g. logrotate)
+	MaxSizeMB int `yaml:"max_size_mb"`
+
+	// Also rotate the log file once it has been written for this long (0 = never)
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+
+	// Rotated files kept (0 = all)
+	MaxBackups int `yaml:"max_backups"`
+
+	// Delete rotated files older than this (0 = never)
+	MaxAge time.Duration `yaml:"max_age"`
 }
 
 // TLSConfig holds mTLS certificate paths
@@ -152,6 +334,13 @@ type TLSConfig struct {
 
 	// Path to CA certificate
 	CAFile string `yaml:"ca_file"`
+
+	// CA bundle used to verify the server instead of the system roots (private PKI)
+	ServerCAFile string `yaml:"server_ca_file"`
+
+	// Pinned server public keys ("sha256//<base64 SPKI hash>"); the server must present
+	// one of them in its chain
+	ServerPins []string `yaml:"server_pins"`
 }
 
 // DefaultConfig returns a config with sensible defaults
@@ -159,9 +348,20 @@ func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
 			InsecureSkipVerify: false,
+			Retry: RetryConfig{
+				MaxAttempts:      4,
+				InitialBackoff:   500 * time.Millisecond,
+				MaxBackoff:       10 * time.Second,
+				Budget:           60 * time.Second,
+				BreakerThreshold: 5,
+				BreakerCooldown:  30 * time.Second,
+			},
 		},
 		Agent: AgentConfig{
-			MaxConcurrentTasks: 2,
+			MaxConcurrentTasks:  2,
+			ShutdownGracePeriod: 5 * time.Minute,
+			TaskLimits:          map[string]int{"backup_create": 1},
+			DataDir:             GetDefaultDataDir(),
 		},
 		BorgSSH: BorgSSHConfig{
 			Port: 2222,
@@ -170,9 +370,22 @@ func DefaultConfig() *Config {
 		Polling: PollingConfig{
 			Interval:          5 * time.Second,
 			HeartbeatInterval: 60 * time.Second,
+			Stream:            true,
 		},
 		Logging: LoggingConfig{
-			Level: "info",
+			Level:      "info",
+			MaxSizeMB:  50,
+			MaxBackups: 5,
+			MaxAge:     30 * 24 * time.Hour,
+		},
+		Hooks: HooksConfig{
+			Dir:     GetDefaultHooksDir(),
+			Timeout: 5 * time.Minute,
+		},
+		Offline: OfflineConfig{
+			After:         1 * time.Hour,
+			SyncInterval:  15 * time.Minute,
+			SecretKeyFile: GetDefaultSecretKeyFile(),
 		},
 	}
 }
@@ -199,8 +412,24 @@ func LoadFromFile(path string) (*Config, error) {
 
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
-	if c.Server.URL == "" {
-		return fmt.Errorf("server.url is required")
+	if len(c.Server.URLList()) == 0 {
+		return fmt.Errorf("server.url or server.urls is required")
+	}
+	for _, u := range c.Server.URLList() {
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+			return fmt.Errorf("server.urls: invalid URL %q", u)
+		}
+	}
+
+	retry := c.Server.Retry
+	if retry.MaxAttempts < 1 || retry.MaxAttempts > MaxRetryAttempts {
+		return fmt.Errorf("server.retry.max_attempts must be between 1 and %d", MaxRetryAttempts)
+	}
+	if retry.InitialBackoff <= 0 {
+		return fmt.Errorf("server.retry.initial_backoff must be positive")
+	}
+	if retry.MaxBackoff < retry.InitialBackoff {
+		return fmt.Errorf("server.retry.max_backoff must not be below initial_backoff")
 	}
 
 	if c.Agent.UUID == "" {
@@ -211,6 +440,70 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("agent.name is required")
 	}
 
+	if c.Agent.MaxConcurrentTasks < 1 {
+		return fmt.Errorf("agent.max_concurrent_tasks must be at least 1")
+	}
+
+	for taskType, limit := range c.Agent.TaskLimits {
+		if limit < 1 {
+			return fmt.Errorf("agent.task_limits.%s must be at least 1 (remove the entry for no limit)", taskType)
+		}
+	}
+
+	if c.Proxy.URL != "" {
+		u, err := url.Parse(c.Proxy.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("proxy.url: invalid URL %q", c.Proxy.URL)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("proxy.url: unsupported scheme %q (http, https, socks5)", u.Scheme)
+		}
+		if c.Proxy.SSHThroughProxy && u.Scheme == "https" {
+			return fmt.Errorf("proxy.ssh_through_proxy: not supported with an https:// proxy")
+		}
+	} else if c.Proxy.SSHThroughProxy {
+		return fmt.Errorf("proxy.ssh_through_proxy requires proxy.url")
+	}
+
+	for _, pin := range c.TLS.ServerPins {
+		raw := strings.TrimPrefix(pin, "sha256//")
+		if decoded, err := base64.StdEncoding.DecodeString(raw); err != nil || len(decoded) != 32 || raw == pin {
+			return fmt.Errorf("tls.server_pins: invalid pin %q (expected sha256//<base64 SHA-256>)", pin)
+		}
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "", "debug", "info", "warn", "warning", "error":
+	default:
+		return fmt.Errorf("logging.level: unknown level %q (debug, info, warn, error)", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "", "text", "json", "journald":
+	default:
+		return fmt.Errorf("logging.format: unknown format %q (text, json, journald)", c.Logging.Format)
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics.listen: invalid address %q (expected host:port)", c.Metrics.Listen)
+		}
+	}
+
+	if c.Hooks.Timeout < 0 {
+		return fmt.Errorf("hooks.timeout must not be negative")
+	}
+
+	if c.Offline.Enabled {
+		if c.Offline.After < time.Minute {
+			return fmt.Errorf("offline.after must be at least 1m")
+		}
+		if c.Offline.SyncInterval < time.Minute {
+			return fmt.Errorf("offline.sync_interval must be at least 1m")
+		}
+	}
+
 	// TLS is optional - if not configured, use Bearer token auth
 	// Only validate TLS if any TLS field is set
 	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" || c.TLS.CAFile != "" {
@@ -228,6 +521,47 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// URLList returns the API endpoints in failover order: url, then urls
+func (s ServerConfig) URLList() []string {
+	return uniqueNonEmpty(append([]string{s.URL}, s.URLs...))
+}
+
+// HostList returns the borg SSH hosts in failover order: host, then hosts
+func (b BorgSSHConfig) HostList() []string {
+	return uniqueNonEmpty(append([]string{b.Host}, b.Hosts...))
+}
+
+// uniqueNonEmpty returns values without blanks and duplicates, in order
+func uniqueNonEmpty(values []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	return out
+}
+
+// TokenFilePath returns where the agent token is stored
+func (c *Config) TokenFilePath() string {
+	if c.Auth.TokenFile != "" {
+		return c.Auth.TokenFile
+	}
+	return filepath.Join(c.Agent.DataDir, "agent-token.json")
+}
+
+// StatusSocketPath returns the Unix socket of the local status API
+func (c *Config) StatusSocketPath() string {
+	if c.Agent.StatusSocket != "" {
+		return c.Agent.StatusSocket
+	}
+	return filepath.Join(c.Agent.DataDir, "status.sock")
+}
+
 // UseTLS returns true if mTLS is configured
 func (c *Config) UseTLS() bool {
 	return c.TLS.CertFile != "" && c.TLS.KeyFile != "" && c.TLS.CAFile != ""
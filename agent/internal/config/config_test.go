@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a configuration that passes Validate
+func validConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Server.URL = "https://phpborg.example.com/api"
+	cfg.Agent.UUID = "0f1e2d3c-4b5a-4697-8877-665544332211"
+	cfg.Agent.Name = "test"
+	return cfg
+}
+
+func TestValidateRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(r *RetryConfig)
+		wantErr string
+	}{
+		{"defaults", func(r *RetryConfig) {}, ""},
+		{"single attempt", func(r *RetryConfig) { r.MaxAttempts = 1 }, ""},
+		{"zero attempts", func(r *RetryConfig) { r.MaxAttempts = 0 }, "max_attempts"},
+		{"too many attempts", func(r *RetryConfig) { r.MaxAttempts = MaxRetryAttempts + 1 }, "max_attempts"},
+		{"zero initial backoff", func(r *RetryConfig) { r.InitialBackoff = 0 }, "initial_backoff"},
+		{"negative initial backoff", func(r *RetryConfig) { r.InitialBackoff = -time.Second }, "initial_backoff"},
+		{"max below initial", func(r *RetryConfig) { r.MaxBackoff = r.InitialBackoff / 2 }, "max_backoff"},
+		{"max equal to initial", func(r *RetryConfig) { r.MaxBackoff = r.InitialBackoff }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(&cfg.Server.Retry)
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateTaskLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  map[string]int
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"class", map[string]int{"borg": 1}, ""},
+		{"type and class", map[string]int{"backup_create": 1, "borg": 2}, ""},
+		{"zero", map[string]int{"borg": 0}, "agent.task_limits.borg"},
+		{"negative", map[string]int{"stats_collect": -1}, "agent.task_limits.stats_collect"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Agent.TaskLimits = tt.limits
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadTaskLimits(t *testing.T) {
+	base := "server:\n  url: https://phpborg.example.com/api\nagent:\n  uuid: 0f1e2d3c-4b5a-4697-8877-665544332211\n  name: test\n"
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]int
+	}{
+		{"default", "", map[string]int{"backup_create": 1}},
+		{"added to the default", "  task_limits:\n    stats_collect: 2\n", map[string]int{"backup_create": 1, "stats_collect": 2}},
+		{"default raised", "  task_limits:\n    backup_create: 3\n", map[string]int{"backup_create": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(base+tt.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadFromFile(path)
+			if err != nil {
+				t.Fatalf("LoadFromFile() = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Agent.TaskLimits, tt.want) {
+				t.Errorf("task_limits = %v, want %v", cfg.Agent.TaskLimits, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is a setting that differs between two configurations
+type Change struct {
+	// Path is the YAML path of the setting (e.g. "polling.interval")
+	Path string
+	Old  string
+	New  string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// Diff lists the settings that differ between two configurations, by YAML path.
+// Secret values are not shown.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	diffValue("", reflect.ValueOf(*old), reflect.ValueOf(*new), &changes)
+	return changes
+}
+
+func diffValue(path string, a, b reflect.Value, changes *[]Change) {
+	if a.Kind() == reflect.Struct {
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValue(name, a.Field(i), b.Field(i), changes)
+		}
+		return
+	}
+
+	if reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return
+	}
+	c := Change{Path: path, Old: fmt.Sprintf("%v", a.Interface()), New: fmt.Sprintf("%v", b.Interface())}
+	if isSecret(path) {
+		c.Old, c.New = "(hidden)", "(hidden)"
+	}
+	*changes = append(*changes, c)
+}
+
+// isSecret reports whether a setting must not be logged (the proxy URL may hold
+// credentials)
+func isSecret(path string) bool {
+	return path == "proxy.url" || strings.Contains(path, "token") || strings.Contains(path, "passphrase") || strings.Contains(path, "password")
+}
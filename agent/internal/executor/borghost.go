@@ -0,0 +1,139 @@
+package executor
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// borgHostCheckInterval is how long the active borg host is trusted to be reachable
+// before the next borg run checks it again
+const borgHostCheckInterval = time.Minute
+
+// borgHostState is the borg SSH host in use among borg_ssh.host and borg_ssh.hosts
+type borgHostState struct {
+	mu          sync.Mutex
+	active      string
+	checkedAt   time.Time
+	checkedPort int
+}
+
+// BorgHost returns the borg SSH host in use: the first configured one until a borg
+// run found it unreachable (empty when none is configured)
+func (e *Executor) BorgHost() string {
+	borgSSH, _ := e.sshConfig()
+	hosts := borgSSH.HostList()
+	e.borgHost.mu.Lock()
+	defer e.borgHost.mu.Unlock()
+	for _, host := range hosts {
+		if host == e.borgHost.active {
+			return host
+		}
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	return hosts[0]
+}
+
+// selectBorgHost returns the host borg connects to. The active host is kept while it
+// accepts TCP connections on port (the port of the repository URL, borg_ssh.port when
+// it has none); otherwise the first reachable host, in configuration order, takes over
+// and stays active. Through a jump host or a ProxyCommand the hosts cannot be dialled
+// directly and the active one is kept.
+func (e *Executor) selectBorgHost(ctx context.Context, port int) string {
+	borgSSH, proxy := e.sshConfig()
+	hosts := borgSSH.HostList()
+	current := e.BorgHost()
+	if len(hosts) < 2 || proxy.SSHProxyCommand != "" || proxy.SSHThroughProxy || proxy.SSHJump != "" {
+		return current
+	}
+	if port <= 0 {
+		port = borgSSH.Port
+	}
+
+	e.borgHost.mu.Lock()
+	fresh := e.borgHost.active == current && e.borgHost.checkedPort == port &&
+		time.Since(e.borgHost.checkedAt) < borgHostCheckInterval
+	e.borgHost.mu.Unlock()
+	if fresh {
+		return current
+	}
+
+	// Dial without holding the lock: an unreachable host takes up to the dial timeout
+	// and BorgHost is read by the heartbeat meanwhile
+	candidates := []string{current}
+	for _, host := range hosts {
+		if host != current {
+			candidates = append(candidates, host)
+		}
+	}
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	for _, host := range candidates {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			slog.Warn("SSH host unreachable", logging.ComponentKey, "BORG", "host", host, "port", port, "error", err)
+			continue
+		}
+		conn.Close()
+		if host != current {
+			slog.Info("Failing over to another SSH host", logging.ComponentKey, "BORG", "from", current, "to", host)
+		}
+		e.borgHost.mu.Lock()
+		e.borgHost.active, e.borgHost.checkedAt, e.borgHost.checkedPort = host, time.Now(), port
+		e.borgHost.mu.Unlock()
+		return host
+	}
+	slog.Warn("No SSH host reachable, keeping the active one", logging.ComponentKey, "BORG", "hosts", strings.Join(hosts, ", "), "port", port, "active", current)
+	return current
+}
+
+// borgRepo returns repoPath pointing at the active borg host when it names one of the
+// configured hosts (ssh://user@host:port/path or user@host:path). Repositories on
+// other hosts are left alone.
+func (e *Executor) borgRepo(ctx context.Context, repoPath string) string {
+	borgSSH, _ := e.sshConfig()
+	hosts := borgSSH.HostList()
+	if len(hosts) < 2 {
+		return repoPath
+	}
+	configured := func(host string) bool {
+		for _, h := range hosts {
+			if h == host {
+				return true
+			}
+		}
+		return false
+	}
+
+	if strings.HasPrefix(repoPath, "ssh://") {
+		u, err := url.Parse(repoPath)
+		if err != nil || !configured(u.Hostname()) {
+			return repoPath
+		}
+		port, _ := strconv.Atoi(u.Port())
+		host := e.selectBorgHost(ctx, port)
+		if host == u.Hostname() {
+			return repoPath
+		}
+		if port := u.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		u.Host = host
+		return u.String()
+	}
+
+	at := strings.Index(repoPath, "@")
+	colon := strings.Index(repoPath[at+1:], ":")
+	if colon < 0 || !configured(repoPath[at+1:at+1+colon]) {
+		return repoPath
+	}
+	return repoPath[:at+1] + e.selectBorgHost(ctx, 0) + repoPath[at+1+colon:]
+}
@@ -0,0 +1,53 @@
+package executor
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/phpborg/phpborg-agent/internal/config"
+)
+
+func TestBorgRepo(t *testing.T) {
+	// The second host listens, the first does not: borg has to fail over to it
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	p := strconv.Itoa(port)
+	tests := []struct {
+		name     string
+		hosts    []string
+		sshPort  int
+		repoPath string
+		want     string
+	}{
+		{"repo URL port", []string{"127.0.0.1", "127.0.0.2"}, closedPort, "ssh://borg@127.0.0.1:" + p + "/repo", "ssh://borg@127.0.0.2:" + p + "/repo"},
+		{"borg_ssh.port without URL port", []string{"127.0.0.1", "127.0.0.2"}, port, "ssh://borg@127.0.0.1/repo", "ssh://borg@127.0.0.2/repo"},
+		{"scp-like path", []string{"127.0.0.1", "127.0.0.2"}, port, "borg@127.0.0.1:repo", "borg@127.0.0.2:repo"},
+		{"active host reachable", []string{"127.0.0.2", "127.0.0.1"}, port, "borg@127.0.0.1:repo", "borg@127.0.0.2:repo"},
+		{"none reachable", []string{"127.0.0.1", "127.0.0.2"}, closedPort, "borg@127.0.0.1:repo", "borg@127.0.0.1:repo"},
+		{"other host", []string{"127.0.0.1", "127.0.0.2"}, port, "ssh://borg@backup.example.com:" + p + "/repo", "ssh://borg@backup.example.com:" + p + "/repo"},
+		{"single host", []string{"127.0.0.1"}, port, "borg@127.0.0.1:repo", "borg@127.0.0.1:repo"},
+		{"local path", []string{"127.0.0.1", "127.0.0.2"}, port, "/srv/borg/repo", "/srv/borg/repo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Executor{}
+			e.SetSSHConfig(config.BorgSSHConfig{Hosts: tt.hosts, Port: tt.sshPort}, config.ProxyConfig{})
+			if got := e.borgRepo(context.Background(), tt.repoPath); got != tt.want {
+				t.Errorf("borgRepo(%s) = %s, want %s", tt.repoPath, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// capabilitySection is one part of the capability report. A detection is reused until
+// its TTL expires, or earlier when a trigger marks the section dirty.
+type capabilitySection struct {
+	name   string
+	ttl    time.Duration
+	detect func(e *Executor, ctx context.Context) interface{}
+	// fingerprint is a cheap snapshot (no fork) of the state the section depends on:
+	// a change triggers a detection. nil or "" = TTL only.
+	fingerprint func() string
+}
+
+var capabilitySections = []capabilitySection{
+	{"snapshots", 6 * time.Hour, func(e *Executor, ctx context.Context) interface{} { return e.detectSnapshots(ctx) }, nil},
+	// Database daemons starting or stopping re-trigger the scan (du -sb on datadirs included)
+	{"databases", time.Hour, func(e *Executor, ctx context.Context) interface{} { return e.detectDatabases(ctx) }, databaseProcesses},
+	// Also invalidated by docker events (see WatchCapabilityTriggers)
+	{"docker", time.Hour, func(e *Executor, ctx context.Context) interface{} { return e.detectDocker(ctx) }, nil},
+	{"filesystem", time.Hour, func(e *Executor, ctx context.Context) interface{} { return e.detectFilesystem(ctx) }, mountTable},
+	{"proxy", 5 * time.Minute, func(e *Executor, ctx context.Context) interface{} { return e.detectProxy(ctx) }, nil},
+}
+
+// osInfoTTL is how long the OS description is reused
+const osInfoTTL = 6 * time.Hour
+
+// CapabilityReport is the current capability set with content hashes. Hashes are the
+// SHA-256 of each section's JSON; Hash covers all sections.
+type CapabilityReport struct {
+	Sections map[string]interface{}
+	Hashes   map[string]string
+	Hash     string
+}
+
+type capabilityEntry struct {
+	value       interface{}
+	hash        string
+	detectedAt  time.Time
+	fingerprint string
+	dirty       bool
+}
+
+// capabilityCache holds the last detection of each section
+type capabilityCache struct {
+	// detectMu serializes detections (heartbeat and capabilities_detect task)
+	detectMu sync.Mutex
+
+	mu      sync.Mutex
+	entries map[string]*capabilityEntry
+
+	osInfo   string
+	osInfoAt time.Time
+}
+
+// Capabilities returns the capability report, re-detecting only the sections that are
+// stale, dirty or whose trigger fired. force re-detects everything.
+func (e *Executor) Capabilities(ctx context.Context, force bool) CapabilityReport {
+	c := &e.caps
+	c.detectMu.Lock()
+	defer c.detectMu.Unlock()
+
+	for _, s := range capabilitySections {
+		fingerprint := ""
+		if s.fingerprint != nil {
+			fingerprint = s.fingerprint()
+		}
+
+		c.mu.Lock()
+		entry := c.entries[s.name]
+		stale := force || entry == nil || entry.dirty || time.Since(entry.detectedAt) >= s.ttl ||
+			(fingerprint != "" && fingerprint != entry.fingerprint)
+		c.mu.Unlock()
+		if !stale {
+			continue
+		}
+
+		start := time.Now()
+		value := s.detect(e, ctx)
+		if ctx.Err() != nil {
+			break // interrupted: partial results must not replace good ones
+		}
+		hash := hashJSON(value)
+
+		c.mu.Lock()
+		if c.entries == nil {
+			c.entries = make(map[string]*capabilityEntry)
+		}
+		if entry != nil && entry.hash != hash {
+			slog.Info("Section changed", logging.ComponentKey, "CAPS", "section", s.name, "detected_in", time.Since(start).Round(time.Millisecond))
+		}
+		c.entries[s.name] = &capabilityEntry{value: value, hash: hash, detectedAt: time.Now(), fingerprint: fingerprint}
+		c.mu.Unlock()
+	}
+
+	return c.report()
+}
+
+func (c *capabilityCache) report() CapabilityReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := CapabilityReport{Sections: make(map[string]interface{}), Hashes: make(map[string]string)}
+	names := make([]string, 0, len(c.entries))
+	for name, entry := range c.entries {
+		r.Sections[name] = entry.value
+		r.Hashes[name] = entry.hash
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name + ":" + r.Hashes[name] + "\n"))
+	}
+	r.Hash = hex.EncodeToString(h.Sum(nil))
+	return r
+}
+
+// InvalidateCapabilities marks a section for re-detection at the next report
+func (e *Executor) InvalidateCapabilities(section string) {
+	e.caps.mu.Lock()
+	defer e.caps.mu.Unlock()
+	if entry, ok := e.caps.entries[section]; ok {
+		entry.dirty = true
+	}
+}
+
+// OSInfo returns GetOSInfo, cached for a few hours
+func (e *Executor) OSInfo(ctx context.Context) string {
+	c := &e.caps
+	c.mu.Lock()
+	if c.osInfo != "" && time.Since(c.osInfoAt) < osInfoTTL {
+		defer c.mu.Unlock()
+		return c.osInfo
+	}
+	c.mu.Unlock()
+
+	info := e.GetOSInfo(ctx)
+	c.mu.Lock()
+	c.osInfo, c.osInfoAt = info, time.Now()
+	c.mu.Unlock()
+	return info
+}
+
+// WatchCapabilityTriggers follows `docker events` and invalidates the docker section
+// when containers, networks or volumes change. It returns when ctx is done; without
+// docker it returns immediately.
+func (e *Executor) WatchCapabilityTriggers(ctx context.Context) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return
+	}
+
+	args := []string{"events", "--format", "{{.Type}} {{.Action}}",
+		"--filter", "type=container", "--filter", "type=network", "--filter", "type=volume"}
+	useSudo := false
+	backoff := 10 * time.Second
+
+	for {
+		command, cmdArgs := "docker", args
+		if useSudo {
+			command, cmdArgs = "sudo", append([]string{"-n", "docker"}, args...)
+		}
+		started := time.Now()
+		err := e.followDockerEvents(ctx, command, cmdArgs)
+		if ctx.Err() != nil {
+			return
+		}
+		// A quick failure without sudo is most likely a permission problem on the
+		// socket (user not in the docker group): retry through sudo like detectDocker.
+		if time.Since(started) < 5*time.Second && !useSudo && os.Geteuid() != 0 {
+			useSudo = true
+			continue
+		}
+		if time.Since(started) > time.Minute {
+			backoff = 10 * time.Second
+		} else if backoff < 10*time.Minute {
+			backoff *= 2
+		}
+		slog.Warn("docker events stopped", logging.ComponentKey, "CAPS", "error", err, "retry_in", backoff)
+		// Events may have been missed meanwhile.
+		e.InvalidateCapabilities("docker")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (e *Executor) followDockerEvents(ctx context.Context, command string, args []string) error {
+	cmd := exec.CommandContext(ctx, command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// exec_* and health_status fire constantly and change nothing we report
+		action := fields[1]
+		if strings.HasPrefix(action, "exec_") || strings.HasPrefix(action, "health_status") {
+			continue
+		}
+		e.InvalidateCapabilities("docker")
+	}
+	return cmd.Wait()
+}
+
+// databaseProcesses lists the database daemons running, read from /proc
+func databaseProcesses() string {
+	daemons := map[string]bool{
+		"mysqld": true, "mariadbd": true, "postgres": true, "mongod": true, "redis-server": true,
+	}
+
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "" // not Linux: TTL only
+	}
+	found := map[string]bool{}
+	for _, d := range dirs {
+		if !d.IsDir() || d.Name()[0] < '0' || d.Name()[0] > '9' {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", d.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if name := strings.TrimSpace(string(comm)); daemons[name] {
+			found[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "running:" + strings.Join(names, ",")
+}
+
+// mountTable fingerprints the mounted filesystems
+func mountTable() string {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
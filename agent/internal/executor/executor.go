@@ -13,6 +13,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/phpborg/phpborg-agent/internal/config"
@@ -21,11 +22,41 @@ import (
 // Executor handles command execution for backup tasks
 type Executor struct {
 	config *config.Config
+
+	// SSH settings for borg, replaceable at runtime (SetSSHConfig)
+	sshMu   sync.RWMutex
+	borgSSH config.BorgSSHConfig
+	proxy   config.ProxyConfig
+
+	// Last probed borg launch mode, for diagnostics (see BorgMode)
+	borgMode borgModeState
+
+	// Borg SSH host in use, with failover (see selectBorgHost)
+	borgHost borgHostState
+
+	// Cached capability detections (see Capabilities)
+	caps capabilityCache
 }
 
 // NewExecutor creates a new command executor
 func NewExecutor(cfg *config.Config) *Executor {
-	return &Executor{config: cfg}
+	return &Executor{config: cfg, borgSSH: cfg.BorgSSH, proxy: cfg.Proxy}
+}
+
+// SetSSHConfig replaces the borg SSH and proxy settings used by the next borg runs
+// (configuration reload). Running borg processes keep their connection.
+func (e *Executor) SetSSHConfig(borgSSH config.BorgSSHConfig, proxy config.ProxyConfig) {
+	e.sshMu.Lock()
+	e.borgSSH, e.proxy = borgSSH, proxy
+	e.sshMu.Unlock()
+	e.InvalidateCapabilities("proxy")
+}
+
+// sshConfig returns the current borg SSH and proxy settings
+func (e *Executor) sshConfig() (config.BorgSSHConfig, config.ProxyConfig) {
+	e.sshMu.RLock()
+	defer e.sshMu.RUnlock()
+	return e.borgSSH, e.proxy
 }
 
 // CommandResult holds the result of a command execution
@@ -42,6 +73,12 @@ type CommandResult struct {
 
 // Run executes a command with timeout and returns the result
 func (e *Executor) Run(ctx context.Context, command string, args []string, timeout time.Duration) *CommandResult {
+	return e.RunEnv(ctx, command, args, nil, timeout)
+}
+
+// RunEnv executes a command with timeout, adding env (KEY=VALUE) to the agent's
+// environment
+func (e *Executor) RunEnv(ctx context.Context, command string, args []string, env []string, timeout time.Duration) *CommandResult {
 	start := time.Now()
 
 	// Create context with timeout
@@ -49,6 +86,9 @@ func (e *Executor) Run(ctx context.Context, command string, args []string, timeo
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -57,7 +97,12 @@ func (e *Executor) Run(ctx context.Context, command string, args []string, timeo
 	// Set process group for proper cleanup (platform-specific)
 	SetProcessGroup(cmd)
 
-	err := cmd.Run()
+	err := cmd.Start()
+	if err == nil {
+		exited := notifyStarted(ctx, cmd)
+		err = cmd.Wait()
+		exited()
+	}
 	duration := time.Since(start)
 
 	result := &CommandResult{
@@ -160,8 +205,18 @@ type BorgProgress struct {
 	Time             float64 `json:"time"`
 	Message          string  `json:"message"`
 	Msgid            string  `json:"msgid"`
+	LevelName        string  `json:"levelname"` // log_message only (DEBUG, INFO, WARNING, ERROR, CRITICAL)
 }
 
+// Events passed to a ProgressCallback
+const (
+	BorgEventProgress   = "archive_progress"
+	BorgEventLogMessage = "log_message"
+	// BorgEventOutput is a stderr line that is not borg JSON (sudo, ssh, shell errors);
+	// the line is in Message
+	BorgEventOutput = "output"
+)
+
 // ProgressCallback is called with progress updates during backup
 type ProgressCallback func(progress BorgProgress)
 
@@ -172,6 +227,7 @@ func (e *Executor) BorgCreate(ctx context.Context, repoPath string, archiveName
 
 // BorgCreateWithProgress executes a borg create command with real-time progress streaming
 func (e *Executor) BorgCreateWithProgress(ctx context.Context, repoPath string, archiveName string, paths []string, excludes []string, compression string, passphrase string, oneFileSystem bool, allowUnencrypted bool, progressCallback ProgressCallback) *CommandResult {
+	repoPath = e.borgRepo(ctx, repoPath)
 	args := []string{
 		"create",
 		"--verbose",
@@ -239,6 +295,13 @@ const (
 // probeBorgMode determines how borg can be launched with root privileges using cheap,
 // deterministic probes (a failing sudo exits in milliseconds, long before borg starts).
 func (e *Executor) probeBorgMode(ctx context.Context) string {
+	mode := e.runBorgProbes(ctx)
+	e.borgMode.set(mode) // remembered for the status API
+	return mode
+}
+
+// runBorgProbes runs the probes of probeBorgMode
+func (e *Executor) runBorgProbes(ctx context.Context) string {
 	// Inline env (requires SETENV: on the borg sudoers rule)
 	if r := e.runWithEnv(ctx, "sudo", []string{"-n", "BORG_PROBE=1", "/usr/bin/borg", "--version"}, os.Environ(), 20*time.Second); r.ExitCode == 0 {
 		return borgModeSudoInline
@@ -286,7 +349,7 @@ func (e *Executor) runBorgAs(ctx context.Context, mode string, borgVars []string
 func (e *Executor) BorgArchiveExists(ctx context.Context, repoPath, archiveName, passphrase string, allowUnencrypted bool) (bool, *CommandResult) {
 	borgVars := e.borgVarList(passphrase, allowUnencrypted)
 	mode := e.probeBorgMode(ctx)
-	args := []string{"list", "--format", "{name}{NL}", repoPath}
+	args := []string{"list", "--format", "{name}{NL}", e.borgRepo(ctx, repoPath)}
 	result := e.runBorgAs(ctx, mode, borgVars, args, 15*time.Minute, nil)
 	if result.ExitCode != 0 {
 		return false, result
@@ -302,11 +365,7 @@ func (e *Executor) BorgArchiveExists(ctx context.Context, repoPath, archiveName,
 // borgVarList builds the BORG_* environment variables for a backup run, as KEY=VALUE
 // strings suitable both for inline sudo args (SETENV) and for a process environment.
 func (e *Executor) borgVarList(passphrase string, allowUnencrypted bool) []string {
-	sshCmd := fmt.Sprintf(
-		"ssh -p %d -i %s -o StrictHostKeyChecking=no -o ServerAliveInterval=30 -o ServerAliveCountMax=6 -o TCPKeepAlive=yes",
-		e.config.BorgSSH.Port,
-		e.config.BorgSSH.PrivateKeyPath,
-	)
+	sshCmd := e.sshCommand()
 
 	// Pin cache/config/security to the agent home so the hot chunk cache and the
 	// security db (known unencrypted repos) survive the switch to root (Bug 31).
@@ -391,6 +450,7 @@ func (e *Executor) runWithEnvAndProgress(ctx context.Context, command string, ar
 			Error:    fmt.Errorf("failed to start command: %w", err),
 		}
 	}
+	defer notifyStarted(ctx, cmd)()
 
 	// Read stderr line by line and parse JSON progress
 	var stderrBuf bytes.Buffer
@@ -402,10 +462,12 @@ func (e *Executor) runWithEnvAndProgress(ctx context.Context, command string, ar
 		// Try to parse as JSON progress
 		var progress BorgProgress
 		if err := json.Unmarshal([]byte(line), &progress); err == nil {
-			// Only send archive_progress events (not file_status)
-			if progress.Type == "archive_progress" {
+			// Progress and log messages only (not file_status, one per file)
+			if progress.Type == BorgEventProgress || progress.Type == BorgEventLogMessage {
 				progressCallback(progress)
 			}
+		} else if strings.TrimSpace(line) != "" {
+			progressCallback(BorgProgress{Type: BorgEventOutput, Message: line})
 		}
 	}
 
@@ -435,16 +497,16 @@ func (e *Executor) runWithEnvAndProgress(ctx context.Context, command string, ar
 
 // BorgList lists archives in a repository
 func (e *Executor) BorgList(ctx context.Context, repoPath string) *CommandResult {
-	args := []string{"list", "--json", repoPath}
+	args := []string{"list", "--json", e.borgRepo(ctx, repoPath)}
 	env := e.getBorgEnv()
 	return e.runWithEnv(ctx, "borg", args, env, 5*time.Minute)
 }
 
 // BorgInfo gets information about a repository or archive
 func (e *Executor) BorgInfo(ctx context.Context, repoPath string, archiveName string) *CommandResult {
-	target := repoPath
+	target := e.borgRepo(ctx, repoPath)
 	if archiveName != "" {
-		target = fmt.Sprintf("%s::%s", repoPath, archiveName)
+		target = fmt.Sprintf("%s::%s", target, archiveName)
 	}
 
 	args := []string{"info", "--json", target}
@@ -461,7 +523,7 @@ func (e *Executor) BorgExtract(ctx context.Context, repoPath string, archiveName
 	}
 
 	// Add repository and archive
-	args = append(args, fmt.Sprintf("%s::%s", repoPath, archiveName))
+	args = append(args, fmt.Sprintf("%s::%s", e.borgRepo(ctx, repoPath), archiveName))
 
 	// Add patterns if specified
 	args = append(args, patterns...)
@@ -479,22 +541,15 @@ func (e *Executor) BorgExtract(ctx context.Context, repoPath string, archiveName
 func (e *Executor) getBorgEnv() []string {
 	env := os.Environ()
 
-	// SSH command with custom port and key. P1: keepalives so a stalled/flaky link
-	// (failing HBA, NAT idle timeout) does not silently drop the borg transfer —
-	// ServerAliveInterval=30 with CountMax=6 tolerates ~3 min of no response before
-	// giving up, and TCPKeepAlive keeps NAT mappings alive.
-	sshCmd := fmt.Sprintf(
-		"ssh -p %d -i %s -o StrictHostKeyChecking=no -o ServerAliveInterval=30 -o ServerAliveCountMax=6 -o TCPKeepAlive=yes",
-		e.config.BorgSSH.Port,
-		e.config.BorgSSH.PrivateKeyPath,
-	)
-	env = append(env, "BORG_RSH="+sshCmd)
+	// SSH command with custom port, key, keepalives and proxy (see sshCommand)
+	env = append(env, "BORG_RSH="+e.sshCommand())
 
 	// Remote path format for phpBorg server
+	borgSSH, _ := e.sshConfig()
 	remotePath := fmt.Sprintf("%s@%s:%s",
-		e.config.BorgSSH.User,
-		e.config.BorgSSH.Host,
-		e.config.BorgSSH.BackupPath,
+		borgSSH.User,
+		e.BorgHost(),
+		borgSSH.BackupPath,
 	)
 	env = append(env, "BORG_REPO="+remotePath)
 
@@ -534,7 +589,12 @@ func (e *Executor) runWithEnvAndDir(ctx context.Context, command string, args []
 	cmd.Cancel = func() error { return TermProcessGroup(cmd) }
 	cmd.WaitDelay = 45 * time.Second
 
-	err := cmd.Run()
+	err := cmd.Start()
+	if err == nil {
+		exited := notifyStarted(ctx, cmd)
+		err = cmd.Wait()
+		exited()
+	}
 	duration := time.Since(start)
 
 	result := &CommandResult{
@@ -561,21 +621,9 @@ func (e *Executor) runWithEnvAndDir(ctx context.Context, command string, args []
 // DetectCapabilities detects system capabilities for backup operations
 // Returns a structure compatible with phpBorg server expectations
 func (e *Executor) DetectCapabilities(ctx context.Context) map[string]interface{} {
-	caps := make(map[string]interface{})
-
-	// Detect snapshot capabilities
-	caps["snapshots"] = e.detectSnapshots(ctx)
-
-	// Detect databases with full details
-	caps["databases"] = e.detectDatabases(ctx)
-
-	// Detect Docker with full details
-	caps["docker"] = e.detectDocker(ctx)
-
-	// Get filesystem info
-	caps["filesystem"] = e.detectFilesystem(ctx)
-
-	return caps
+	// Full scan of every section (snapshots, databases, docker, filesystem, proxy),
+	// which also refreshes the cache used by heartbeats
+	return e.Capabilities(ctx, true).Sections
 }
 
 // detectSnapshots detects available snapshot methods (LVM, ZFS, Btrfs)
@@ -0,0 +1,52 @@
+package executor
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ProcessObserver is told about the external process a task is running: called with
+// its PID and command name once started, then with 0 and "" once it exited.
+type ProcessObserver func(pid int, command string)
+
+type observerKey struct{}
+
+// WithProcessObserver returns a context under which the commands started by the
+// executor are reported to fn (local status API).
+func WithProcessObserver(ctx context.Context, fn ProcessObserver) context.Context {
+	return context.WithValue(ctx, observerKey{}, fn)
+}
+
+// notifyStarted reports a started command; the returned func reports its exit
+func notifyStarted(ctx context.Context, cmd *exec.Cmd) func() {
+	fn, ok := ctx.Value(observerKey{}).(ProcessObserver)
+	if !ok || cmd.Process == nil {
+		return func() {}
+	}
+	fn(cmd.Process.Pid, filepath.Base(cmd.Path))
+	return func() { fn(0, "") }
+}
+
+// borgModeState remembers the last probed borg launch mode
+type borgModeState struct {
+	mu       sync.Mutex
+	mode     string
+	probedAt time.Time
+}
+
+func (s *borgModeState) set(mode string) {
+	s.mu.Lock()
+	s.mode, s.probedAt = mode, time.Now()
+	s.mu.Unlock()
+}
+
+// BorgMode returns the borg launch mode found by the last probe ("sudo-inline",
+// "sudo-shell" or "direct") and when it was probed; empty before the first borg run.
+func (e *Executor) BorgMode() (string, time.Time) {
+	e.borgMode.mu.Lock()
+	defer e.borgMode.mu.Unlock()
+	return e.borgMode.mode, e.borgMode.probedAt
+}
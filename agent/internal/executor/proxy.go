@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sshCommand returns the ssh command used by borg (BORG_RSH). It is parsed by borg with
+// shell-like splitting, so options containing spaces are single-quoted.
+//
+// P1: keepalives so a stalled/flaky link (failing HBA, NAT idle timeout) does not
+// silently drop the borg transfer — ServerAliveInterval=30 with CountMax=6 tolerates
+// ~3 min of no response before giving up, and TCPKeepAlive keeps NAT mappings alive.
+func (e *Executor) sshCommand() string {
+	borgSSH, proxy := e.sshConfig()
+	cmd := fmt.Sprintf(
+		"ssh -p %d -i %s -o StrictHostKeyChecking=no -o ServerAliveInterval=30 -o ServerAliveCountMax=6 -o TCPKeepAlive=yes",
+		borgSSH.Port,
+		borgSSH.PrivateKeyPath,
+	)
+
+	switch {
+	case proxy.SSHProxyCommand != "":
+		cmd += " -o " + singleQuote("ProxyCommand="+proxy.SSHProxyCommand)
+	case proxy.SSHThroughProxy:
+		if pc := netcatProxyCommand(proxy.URL); pc != "" {
+			cmd += " -o " + singleQuote("ProxyCommand="+pc)
+		}
+	case proxy.SSHJump != "":
+		cmd += " -J " + singleQuote(proxy.SSHJump)
+	}
+
+	return cmd
+}
+
+// netcatProxyCommand builds an OpenBSD nc ProxyCommand tunnelling through the API proxy
+// (HTTP CONNECT or SOCKS5). Proxy credentials are not supported by nc.
+func netcatProxyCommand(proxyURL string) string {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	protocol := "connect"
+	if strings.HasPrefix(u.Scheme, "socks5") {
+		protocol = "5"
+	}
+	return fmt.Sprintf("nc -X %s -x %s %%h %%p", protocol, proxyHostPort(u))
+}
+
+// proxyHostPort returns host:port of a proxy URL. Without a port it defaults by
+// scheme, as the API client (net/http) does: 80 for http, 443 for https, 1080 for
+// socks5 and socks5h.
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// singleQuote quotes s for shell-like splitting
+func singleQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// detectProxy reports the configured proxies and whether they accept TCP connections
+func (e *Executor) detectProxy(ctx context.Context) map[string]interface{} {
+	_, proxy := e.sshConfig()
+	info := map[string]interface{}{
+		"configured": proxy.URL != "" || proxy.SSHJump != "" || proxy.SSHProxyCommand != "",
+	}
+
+	if proxy.URL != "" {
+		if u, err := url.Parse(proxy.URL); err == nil {
+			u.User = nil // never report credentials
+			info["api"] = checkReachable(ctx, u.Redacted(), proxyHostPort(u))
+		}
+	}
+
+	switch {
+	case proxy.SSHProxyCommand != "":
+		info["ssh"] = map[string]interface{}{"type": "proxy_command", "command": proxy.SSHProxyCommand}
+	case proxy.SSHThroughProxy:
+		info["ssh"] = map[string]interface{}{"type": "api_proxy"}
+	case proxy.SSHJump != "":
+		hostPort := proxy.SSHJump
+		if i := strings.LastIndex(hostPort, "@"); i >= 0 {
+			hostPort = hostPort[i+1:]
+		}
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(hostPort, "22")
+		}
+		status := checkReachable(ctx, proxy.SSHJump, hostPort)
+		status["type"] = "jump"
+		info["ssh"] = status
+	}
+
+	return info
+}
+
+// checkReachable opens (and closes) a TCP connection to address
+func checkReachable(ctx context.Context, name, address string) map[string]interface{} {
+	status := map[string]interface{}{"address": name}
+
+	start := time.Now()
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		status["reachable"] = false
+		status["error"] = err.Error()
+		return status
+	}
+	conn.Close()
+
+	status["reachable"] = true
+	status["latency_ms"] = time.Since(start).Milliseconds()
+	return status
+}
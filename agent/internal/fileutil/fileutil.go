@@ -0,0 +1,55 @@
+// Package fileutil holds small file helpers shared by the agent's on-disk stores.
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteAtomic writes data to path through a temp file in the same directory and a
+// rename, so readers (and a restarted agent) never see a partially written file.
+func WriteAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	// Clean up temp file on error
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+
+	// Atomic rename
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	tmpPath = "" // Prevent cleanup
+	return nil
+}
+
+// IsTempFile reports whether name is a leftover temp file of an interrupted
+// WriteAtomic, which a store may safely delete when it loads its directory.
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".tmp-")
+}
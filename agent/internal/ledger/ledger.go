@@ -0,0 +1,147 @@
+// Package ledger keeps, on disk, the outcome of the tasks the agent recently executed.
+// The server may deliver a task again (lost start or outcome response, network blip);
+// the ledger lets the agent answer with the stored outcome instead of running the
+// same backup twice.
+package ledger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// Outcome kinds
+const (
+	KindComplete = "complete"
+	KindFail     = "fail"
+)
+
+// Record is the outcome of one executed task attempt
+type Record struct {
+	TaskID   int                    `json:"task_id"`
+	Attempt  int                    `json:"attempt"`
+	Type     string                 `json:"type"`
+	Kind     string                 `json:"kind"`
+	Result   map[string]interface{} `json:"result,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	ExitCode int                    `json:"exit_code"`
+	// Final progress message of a completed task
+	Message    string    `json:"message,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Ledger is the on-disk record of executed tasks, one JSON file per task under dir.
+// Records older than the retention are pruned.
+type Ledger struct {
+	dir       string
+	retention time.Duration
+
+	mu      sync.Mutex
+	records map[int]*Record
+}
+
+// Open loads the ledger stored in dir, creating the directory if needed, and prunes
+// the records older than retention
+func Open(dir string, retention time.Duration) (*Ledger, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ledger directory: %w", err)
+	}
+
+	l := &Ledger{
+		dir:       dir,
+		retention: retention,
+		records:   make(map[int]*Record),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger directory: %w", err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if fileutil.IsTempFile(name) {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			slog.Warn("Skipping unreadable record", logging.ComponentKey, "LEDGER", "file", name, "error", err)
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(data, &r); err != nil {
+			slog.Warn("Removing corrupt record", logging.ComponentKey, "LEDGER", "file", name, "error", err)
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		l.records[r.TaskID] = &r
+	}
+
+	l.mu.Lock()
+	l.prune()
+	l.mu.Unlock()
+
+	return l, nil
+}
+
+// Add stores the outcome of a task attempt, replacing the one of an earlier attempt
+func (l *Ledger) Add(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r.FinishedAt.IsZero() {
+		r.FinishedAt = time.Now().UTC()
+	}
+	l.records[r.TaskID] = &r
+	l.prune()
+
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return fileutil.WriteAtomic(l.path(r.TaskID), data, 0600)
+}
+
+// Get returns the stored outcome of this attempt of a task, if it was executed
+func (l *Ledger) Get(taskID, attempt int) (Record, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r, ok := l.records[taskID]
+	if !ok || r.Attempt != attempt {
+		return Record{}, false
+	}
+	return *r, true
+}
+
+// prune drops the records older than the retention. Caller holds l.mu.
+func (l *Ledger) prune() {
+	if l.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-l.retention)
+	for id, r := range l.records {
+		if r.FinishedAt.Before(cutoff) {
+			delete(l.records, id)
+			if err := os.Remove(l.path(id)); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Failed to remove record", logging.ComponentKey, "LEDGER", "task_id", id, "type", r.Type, "error", err)
+			}
+		}
+	}
+}
+
+func (l *Ledger) path(taskID int) string {
+	return filepath.Join(l.dir, strconv.Itoa(taskID)+".json")
+}
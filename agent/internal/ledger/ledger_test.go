@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	tests := []struct {
+		name     string
+		records  []Record
+		reopen   bool
+		taskID   int
+		attempt  int
+		wantOK   bool
+		wantKind string
+	}{
+		{"executed", []Record{{TaskID: 1, Kind: KindComplete}}, false, 1, 0, true, KindComplete},
+		{"not executed", []Record{{TaskID: 1, Kind: KindComplete}}, false, 2, 0, false, ""},
+		{"other attempt", []Record{{TaskID: 1, Kind: KindFail}}, false, 1, 1, false, ""},
+		{"later attempt replaces", []Record{{TaskID: 1, Kind: KindFail}, {TaskID: 1, Attempt: 1, Kind: KindComplete}}, false, 1, 1, true, KindComplete},
+		{"earlier attempt replaced", []Record{{TaskID: 1, Kind: KindFail}, {TaskID: 1, Attempt: 1, Kind: KindComplete}}, false, 1, 0, false, ""},
+		{"survives restart", []Record{{TaskID: 1, Attempt: 2, Kind: KindFail}}, true, 1, 2, true, KindFail},
+		{"expired", []Record{{TaskID: 1, Kind: KindComplete, FinishedAt: old}}, false, 1, 0, false, ""},
+		{"expired while stopped", []Record{{TaskID: 1, Kind: KindComplete, FinishedAt: old}}, true, 1, 0, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tt.records {
+				if err := l.Add(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.reopen {
+				if l, err = Open(dir, 24*time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, ok := l.Get(tt.taskID, tt.attempt)
+			if ok != tt.wantOK || r.Kind != tt.wantKind {
+				t.Errorf("Get(%d, %d) = %q, %v, want %q, %v", tt.taskID, tt.attempt, r.Kind, ok, tt.wantKind, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOpenSkipsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"1.json":      "{not json",
+		".tmp-2.json": "{}",
+		"notes.txt":   "kept",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := Open(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Get(1, 0); ok {
+		t.Error("corrupt record loaded")
+	}
+	for name, want := range map[string]bool{"1.json": false, ".tmp-2.json": false, "notes.txt": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", name, got, want)
+		}
+	}
+}
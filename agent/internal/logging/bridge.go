@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// legacyWriter receives the output of the standard log package. The leading [TAG]
+// becomes the component and the level is INFO unless the message starts with a level
+// marker; code that needs a precise level or fields logs through slog directly.
+type legacyWriter struct {
+	logger *slog.Logger
+}
+
+func (w *legacyWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	component, msg := splitTag(msg)
+
+	var args []any
+	if component != "" {
+		args = append(args, ComponentKey, component)
+	}
+	w.logger.Log(context.Background(), legacyLevel(msg), msg, args...)
+	return len(p), nil
+}
+
+// splitTag separates "[TAG] message"
+func splitTag(line string) (string, string) {
+	if !strings.HasPrefix(line, "[") {
+		return "", line
+	}
+	end := strings.Index(line, "] ")
+	if end < 2 || end > 32 || strings.ContainsAny(line[1:end], " []") {
+		return "", line
+	}
+	return line[1:end], line[end+2:]
+}
+
+// legacyLevel honours an explicit leading marker ("WARNING: ...", "CRITICAL: ...");
+// any other legacy line is INFO. The wording is not guessed from: "failing over" or
+// "retrying" are routine.
+func legacyLevel(msg string) slog.Level {
+	marker, _, found := strings.Cut(msg, ":")
+	if !found {
+		return slog.LevelInfo
+	}
+	switch strings.ToUpper(marker) {
+	case "CRITICAL", "FATAL", "ERROR":
+		return slog.LevelError
+	case "WARNING", "WARN":
+		return slog.LevelWarn
+	case "DEBUG":
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
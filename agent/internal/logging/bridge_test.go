@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestLegacyLevel(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want slog.Level
+	}{
+		{"Endpoint https://a failing (timeout), failing over to https://b", slog.LevelInfo},
+		{"GET /agent/tasks failed (attempt 1/3): EOF, retrying in 1s", slog.LevelInfo},
+		{"Circuit breaker OPEN after 5 consecutive failure(s)", slog.LevelInfo},
+		{"Could not renew: error 500", slog.LevelInfo},
+		{"WARNING: local clock is 5m ahead of the server clock", slog.LevelWarn},
+		{"Warning: failed to create backup directory: EACCES", slog.LevelWarn},
+		{"CRITICAL: run of job \"db\" could not be saved", slog.LevelError},
+		{"Error: disk full", slog.LevelError},
+		{"debug: raw response", slog.LevelDebug},
+		{"Agent started", slog.LevelInfo},
+		{"", slog.LevelInfo},
+	}
+	for _, tt := range tests {
+		if got := legacyLevel(tt.msg); got != tt.want {
+			t.Errorf("legacyLevel(%q) = %v, want %v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTag(t *testing.T) {
+	tests := []struct {
+		line, tag, msg string
+	}{
+		{"[API] Request failed", "API", "Request failed"},
+		{"[WORKER-2] Started", "WORKER-2", "Started"},
+		{"no tag here", "", "no tag here"},
+		{"[not a tag] x", "", "[not a tag] x"},
+		{"[] empty", "", "[] empty"},
+	}
+	for _, tt := range tests {
+		tag, msg := splitTag(tt.line)
+		if tag != tt.tag || msg != tt.msg {
+			t.Errorf("splitTag(%q) = %q, %q, want %q, %q", tt.line, tag, msg, tt.tag, tt.msg)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lineHandler writes one human-readable line per record, keeping the agent's
+// historical layout: "2006/01/02 15:04:05 INFO [COMPONENT] message key=value".
+// In journald mode the timestamp is left to the journal and the line starts with a
+// "<N>" syslog priority, which journald turns into the entry level.
+type lineHandler struct {
+	mu       *sync.Mutex
+	w        io.Writer
+	level    slog.Leveler
+	journald bool
+
+	component string
+	prefix    string // group prefix for attribute keys
+	attrs     []byte // pre-rendered " key=value" pairs
+}
+
+func newLineHandler(w io.Writer, level slog.Leveler, journald bool) *lineHandler {
+	return &lineHandler{mu: &sync.Mutex{}, w: w, level: level, journald: journald}
+}
+
+func (h *lineHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if h.journald {
+		buf.WriteString("<" + strconv.Itoa(syslogPriority(r.Level)) + ">")
+	} else {
+		if !r.Time.IsZero() {
+			buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+		}
+		buf.WriteString(levelName(r.Level) + " ")
+	}
+
+	component := h.component
+	var attrs bytes.Buffer
+	attrs.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == ComponentKey && h.prefix == "" {
+			component = a.Value.String()
+			return true
+		}
+		appendAttr(&attrs, h.prefix, a)
+		return true
+	})
+
+	if component != "" {
+		buf.WriteString("[" + component + "] ")
+	}
+	buf.WriteString(r.Message)
+	buf.Write(attrs.Bytes())
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]byte(nil), h.attrs...)
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		if a.Key == ComponentKey && h.prefix == "" {
+			c.component = a.Value.String()
+			continue
+		}
+		appendAttr(&buf, h.prefix, a)
+	}
+	c.attrs = append(c.attrs, buf.Bytes()...)
+	return &c
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range group {
+			appendAttr(buf, prefix, ga)
+		}
+		return
+	}
+	buf.WriteString(" " + prefix + a.Key + "=")
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	buf.WriteString(value)
+}
+
+func levelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARN"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// syslogPriority maps a level to the sd-daemon(3) priority prefix
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
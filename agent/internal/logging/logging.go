@@ -0,0 +1,187 @@
+// Package logging sets up the agent's leveled, structured logger (log/slog): text,
+// JSON or journald output, file rotation, per-task fields, and a bridge that routes
+// the legacy log.Printf("[TAG] ...") calls through the same handler.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/phpborg/phpborg-agent/internal/config"
+)
+
+// ComponentKey is the attribute naming the subsystem (the historical [TAG])
+const ComponentKey = "component"
+
+// Output formats
+const (
+	FormatText     = "text"
+	FormatJSON     = "json"
+	FormatJournald = "journald"
+)
+
+// Manager owns the log destination and format. Apply can change both at any time:
+// loggers created earlier (e.g. held by running tasks) follow.
+type Manager struct {
+	level slog.LevelVar
+
+	mu   sync.RWMutex
+	base slog.Handler
+	file *rotatingFile
+}
+
+// Setup applies cfg and installs the logger as the slog default and as the output of
+// the standard log package
+func Setup(cfg config.LoggingConfig) (*Manager, error) {
+	m := &Manager{}
+	if err := m.Apply(cfg); err != nil {
+		return nil, err
+	}
+	logger := slog.New(&switchHandler{m: m})
+	// slog.SetDefault redirects the log package too; the bridge replaces that
+	// redirection to keep the [TAG] and the level of legacy messages.
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetOutput(&legacyWriter{logger: logger})
+	return m, nil
+}
+
+// Apply switches to the level, format and file of cfg. On error the current
+// configuration is kept.
+func (m *Manager) Apply(cfg config.LoggingConfig) error {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stderr
+	var file *rotatingFile
+	if cfg.File != "" {
+		file, err = openRotatingFile(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.RotateInterval, cfg.MaxBackups, cfg.MaxAge)
+		if err != nil {
+			return err
+		}
+		w = file
+	}
+
+	var h slog.Handler
+	switch resolveFormat(cfg) {
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: &m.level})
+	case FormatJournald:
+		h = newLineHandler(w, &m.level, true)
+	default:
+		h = newLineHandler(w, &m.level, false)
+	}
+
+	m.mu.Lock()
+	old := m.file
+	m.base, m.file = h, file
+	m.mu.Unlock()
+	m.level.Set(level)
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Close closes the log file and sends the log package back to stderr
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+	if m.file != nil {
+		m.file.Close()
+		m.file = nil
+	}
+	m.base = newLineHandler(os.Stderr, &m.level, false)
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// resolveFormat picks journald for an agent started by systemd that logs to stderr
+// (JOURNAL_STREAM is set by systemd for journal-connected output)
+func resolveFormat(cfg config.LoggingConfig) string {
+	if cfg.Format != "" {
+		return cfg.Format
+	}
+	if cfg.File == "" && os.Getenv("JOURNAL_STREAM") != "" {
+		return FormatJournald
+	}
+	return FormatText
+}
+
+// switchHandler forwards to the Manager's current handler, replaying the attributes
+// and groups added with With/WithGroup
+type switchHandler struct {
+	m   *Manager
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *switchHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.m.level.Level()
+}
+
+func (h *switchHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.m.mu.RLock()
+	defer h.m.mu.RUnlock()
+	target := h.m.base
+	for _, op := range h.ops {
+		target = op(target)
+	}
+	return target.Handle(ctx, r)
+}
+
+func (h *switchHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(t slog.Handler) slog.Handler { return t.WithAttrs(attrs) })
+}
+
+func (h *switchHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(t slog.Handler) slog.Handler { return t.WithGroup(name) })
+}
+
+func (h *switchHandler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &switchHandler{m: h.m, ops: append(ops, op)}
+}
+
+type contextKey struct{}
+
+// WithTask returns a context whose logger adds the task fields to every record
+func WithTask(ctx context.Context, taskID int, taskType string) context.Context {
+	return context.WithValue(ctx, contextKey{}, FromContext(ctx).With("task_id", taskID, "task_type", taskType))
+}
+
+// FromContext returns the logger of ctx (the default logger when none was attached)
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Component returns the logger of ctx tagged with a component name
+func Component(ctx context.Context, name string) *slog.Logger {
+	return FromContext(ctx).With(ComponentKey, name)
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupLayout is the timestamp suffix of rotated files (agent.log.20260102-150405.000)
+const backupLayout = "20060102-150405.000"
+
+// rotatingFile is a log file rotated by size and age. Rotated files are renamed with a
+// timestamp suffix and pruned by count and age.
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // 0 = no size limit
+	interval   time.Duration // 0 = no time-based rotation
+	maxBackups int           // 0 = keep all
+	maxAge     time.Duration // 0 = keep all
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	r.file, r.size, r.openedAt = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p, rotating the file first when it is full or too old
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing messages.
+			fmt.Fprintf(os.Stderr, "[LOG] Rotation of %s failed: %v\n", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) due(next int) bool {
+	if r.maxSize > 0 && r.size+int64(next) > r.maxSize {
+		return true
+	}
+	return r.interval > 0 && time.Since(r.openedAt) >= r.interval
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	backup := r.path + "." + time.Now().Format(backupLayout)
+	renameErr := os.Rename(r.path, backup)
+	// Reopen whatever happened, the writer must stay usable.
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("failed to rename log file: %w", renameErr)
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes the rotated files beyond maxBackups or older than maxAge
+func (r *rotatingFile) prune() {
+	matches, _ := filepath.Glob(r.path + ".*")
+
+	type backup struct {
+		path string
+		at   time.Time
+	}
+	var backups []backup
+	for _, m := range matches {
+		at, err := time.ParseInLocation(backupLayout, strings.TrimPrefix(m, r.path+"."), time.Local)
+		if err != nil {
+			continue // not one of ours (agent.log.gz from logrotate, ...)
+		}
+		backups = append(backups, backup{m, at})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+
+	for i, b := range backups {
+		if (r.maxBackups > 0 && i >= r.maxBackups) || (r.maxAge > 0 && time.Since(b.at) > r.maxAge) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// Close closes the file
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
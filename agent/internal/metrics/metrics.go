@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Default is the registry the agent metrics are registered in
+var Default = NewRegistry()
+
+// Buckets (seconds) for tasks, which run from seconds to many hours
+var taskBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// Buckets (seconds) for API calls
+var apiBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	// TasksTotal counts finished tasks by type and outcome (success, failure)
+	TasksTotal = Default.NewCounter("phpborg_agent_tasks_total",
+		"Tasks processed, by type and outcome.", "type", "outcome")
+
+	// TaskDuration records how long tasks ran
+	TaskDuration = Default.NewHistogram("phpborg_agent_task_duration_seconds",
+		"Task run time, by type and outcome.", taskBuckets, "type", "outcome")
+
+	// BorgBytes counts bytes reported by borg create (kind: original, compressed, deduplicated)
+	BorgBytes = Default.NewCounter("phpborg_agent_borg_bytes_total",
+		"Bytes processed by successful backups, as reported by borg.", "kind")
+
+	// SkippedPermissionDenied counts files borg could not read
+	SkippedPermissionDenied = Default.NewCounter("phpborg_agent_borg_files_skipped_permission_denied_total",
+		"Files skipped by backups because of permission errors.")
+
+	// LastBackupSuccess is the time of the last successful backup per repository
+	LastBackupSuccess = Default.NewGauge("phpborg_agent_last_backup_success_timestamp_seconds",
+		"Unix time of the last successful backup, by repository.", "repository")
+
+	// Heartbeats counts heartbeats by outcome (success, failure)
+	Heartbeats = Default.NewCounter("phpborg_agent_heartbeats_total",
+		"Heartbeats sent, by outcome.", "outcome")
+
+	// LastHeartbeatSuccess is the time of the last accepted heartbeat
+	LastHeartbeatSuccess = Default.NewGauge("phpborg_agent_last_heartbeat_success_timestamp_seconds",
+		"Unix time of the last successful heartbeat.")
+
+	// ClockSkew is the server clock minus the agent clock, measured on heartbeats
+	ClockSkew = Default.NewGauge("phpborg_agent_clock_skew_seconds",
+		"Server clock minus agent clock, measured on the last heartbeat.")
+
+	// APIRequestDuration records each HTTP attempt to the server
+	APIRequestDuration = Default.NewHistogram("phpborg_agent_api_request_duration_seconds",
+		"Latency of API requests (each attempt), by method and endpoint.", apiBuckets, "method", "endpoint")
+
+	// APIErrors counts failed API attempts (kind: transport, http_4xx, http_5xx, circuit_open)
+	APIErrors = Default.NewCounter("phpborg_agent_api_errors_total",
+		"Failed API requests, by endpoint and kind.", "endpoint", "kind")
+
+	// BreakerState is 1 for the current circuit breaker state
+	BreakerState = Default.NewGauge("phpborg_agent_api_circuit_breaker_state",
+		"Current API circuit breaker state (1 for the active state).", "state")
+
+	// Info carries the agent version
+	Info = Default.NewGauge("phpborg_agent_info",
+		"Agent build information.", "version")
+)
+
+// Endpoint turns an API path into a low-cardinality label by replacing numeric
+// and UUID-like segments with {id}, e.g. /agent/tasks/42/progress -> /agent/tasks/{id}/progress
+func Endpoint(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isID(s) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isID(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'a' && r <= 'f', r >= 'A' && r <= 'F', r == '-':
+		default:
+			return false
+		}
+	}
+	// Plain numbers, or hex/UUID strings long enough not to be a word like "feed"
+	return digits == len(s) || (digits > 0 && len(s) >= 16)
+}
+
+// Serve exposes the registry on http://addr/metrics until ctx is done
+func Serve(ctx context.Context, addr string, registry *Registry) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := registry.Write(w); err != nil {
+			log.Printf("[METRICS] Failed to write response: %v", err)
+		}
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("[METRICS] Listening on http://%s/metrics", listener.Addr())
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+// Package metrics implements the agent's Prometheus metrics: a small registry that
+// writes the Prometheus text exposition format, and the agent metric definitions.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metric families and renders them
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64 // histograms only
+	fn         func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) register(f *family) *family {
+	f.series = make(map[string]*series)
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+// Counter is a monotonically increasing value per label set
+type Counter struct{ f *family }
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, typ: typeCounter, labelNames: labelNames})}
+}
+
+// Inc adds 1
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Add adds v (must be >= 0)
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Gauge is a value that can go up and down per label set
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, typ: typeGauge, labelNames: labelNames})}
+}
+
+// Set sets the value
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value = v })
+}
+
+// NewGaugeFunc registers an unlabelled gauge whose value is read from fn at scrape
+// time. A NaN value is not exported.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, typ: typeGauge, fn: fn})
+}
+
+// Histogram counts observations in cumulative buckets per label set
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with the given upper bounds (sorted ascending)
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{r.register(&family{name: name, help: help, typ: typeHistogram, labelNames: labelNames, buckets: buckets})}
+}
+
+// Observe records one observation
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.f.buckets))
+		}
+		for i, upper := range h.f.buckets {
+			if v <= upper {
+				s.counts[i]++
+			}
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+func (f *family) update(labelValues []string, fn func(*series)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label value(s), got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// Write renders all metrics in the Prometheus text format (version 0.0.4)
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	if f.fn != nil {
+		v := f.fn()
+		if math.IsNaN(v) {
+			return
+		}
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		fmt.Fprintf(b, "%s %s\n", f.name, formatValue(v))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		labels := formatLabels(f.labelNames, s.labelValues)
+		if f.typ != typeHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, wrapLabels(labels), formatValue(s.value))
+			continue
+		}
+		for i, upper := range f.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, wrapLabels(joinLabels(labels, `le="`+formatValue(upper)+`"`)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, wrapLabels(joinLabels(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, wrapLabels(labels), formatValue(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, wrapLabels(labels), s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
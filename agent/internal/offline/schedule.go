@@ -0,0 +1,94 @@
+package offline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// Next returns the first run of a schedule strictly after after, computed in loc the
+// way the server computes next_run_at. It reports false for schedules the agent does
+// not run on its own (manual, custom cron, invalid).
+func Next(s api.JobSchedule, after time.Time, loc *time.Location) (time.Time, bool) {
+	hour, minute, err := parseClock(s.Time)
+	if err != nil {
+		return time.Time{}, false
+	}
+	after = after.In(loc)
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, minute, 0, 0, loc)
+	}
+
+	switch s.Type {
+	case "daily":
+		next := at(after.Year(), after.Month(), after.Day())
+		if !next.After(after) {
+			next = at(after.Year(), after.Month(), after.Day()+1)
+		}
+		return next, true
+
+	case "weekly":
+		day := s.DayOfWeek
+		if day < 1 || day > 7 {
+			day = 1
+		}
+		current := int(after.Weekday()) // 0 = Sunday
+		if current == 0 {
+			current = 7
+		}
+		until := (day - current + 7) % 7
+		next := at(after.Year(), after.Month(), after.Day()+until)
+		if !next.After(after) {
+			next = at(after.Year(), after.Month(), after.Day()+until+7)
+		}
+		return next, true
+
+	case "monthly":
+		day := s.DayOfMonth
+		if day < 1 {
+			day = 1
+		}
+		next := at(after.Year(), after.Month(), clampDay(after.Year(), after.Month(), day))
+		if !next.After(after) {
+			y, m := after.Year(), after.Month()+1
+			if m > time.December {
+				y, m = y+1, time.January
+			}
+			next = at(y, m, clampDay(y, m, day))
+		}
+		return next, true
+	}
+	return time.Time{}, false
+}
+
+// clampDay returns day, or the last day of the month when it has fewer days
+func clampDay(year int, month time.Month, day int) int {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day > last {
+		return last
+	}
+	return day
+}
+
+// parseClock reads a HH:MM[:SS] schedule time (empty = midnight, as on the server)
+func parseClock(clock string) (int, int, error) {
+	if clock == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, fmt.Errorf("invalid schedule time %q", clock)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, 0, fmt.Errorf("invalid schedule time %q", clock)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("invalid schedule time %q", clock)
+	}
+	return hour, minute, nil
+}
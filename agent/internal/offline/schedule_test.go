@@ -0,0 +1,58 @@
+package offline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+func TestNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no tz database: %v", err)
+	}
+	utc := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+
+	// 2026-03-10 is a Tuesday, 2026-03-15 a Sunday
+	tests := []struct {
+		name     string
+		schedule api.JobSchedule
+		after    time.Time
+		loc      *time.Location
+		want     time.Time
+		wantOK   bool
+	}{
+		{"daily later today", api.JobSchedule{Type: "daily", Time: "02:00"}, utc(2026, 3, 10, 1, 0), time.UTC, utc(2026, 3, 10, 2, 0), true},
+		{"daily at the run itself", api.JobSchedule{Type: "daily", Time: "02:00"}, utc(2026, 3, 10, 2, 0), time.UTC, utc(2026, 3, 11, 2, 0), true},
+		{"daily seconds ignored", api.JobSchedule{Type: "daily", Time: "02:30:15"}, utc(2026, 3, 10, 3, 0), time.UTC, utc(2026, 3, 11, 2, 30), true},
+		{"daily midnight by default", api.JobSchedule{Type: "daily"}, utc(2026, 3, 10, 1, 0), time.UTC, utc(2026, 3, 11, 0, 0), true},
+		{"daily end of month", api.JobSchedule{Type: "daily", Time: "23:00"}, utc(2026, 3, 31, 23, 30), time.UTC, utc(2026, 4, 1, 23, 0), true},
+		{"daily in schedule time zone", api.JobSchedule{Type: "daily", Time: "01:00"}, utc(2026, 1, 10, 0, 30), paris, utc(2026, 1, 11, 0, 0), true},
+		{"weekly later this week", api.JobSchedule{Type: "weekly", Time: "03:00", DayOfWeek: 5}, utc(2026, 3, 10, 12, 0), time.UTC, utc(2026, 3, 13, 3, 0), true},
+		{"weekly next week", api.JobSchedule{Type: "weekly", Time: "03:00", DayOfWeek: 1}, utc(2026, 3, 10, 12, 0), time.UTC, utc(2026, 3, 16, 3, 0), true},
+		{"weekly sunday later today", api.JobSchedule{Type: "weekly", Time: "03:00", DayOfWeek: 7}, utc(2026, 3, 15, 1, 0), time.UTC, utc(2026, 3, 15, 3, 0), true},
+		{"weekly same day passed", api.JobSchedule{Type: "weekly", Time: "03:00", DayOfWeek: 7}, utc(2026, 3, 15, 4, 0), time.UTC, utc(2026, 3, 22, 3, 0), true},
+		{"weekly invalid day is monday", api.JobSchedule{Type: "weekly", Time: "03:00"}, utc(2026, 3, 10, 12, 0), time.UTC, utc(2026, 3, 16, 3, 0), true},
+		{"monthly this month", api.JobSchedule{Type: "monthly", Time: "04:00", DayOfMonth: 15}, utc(2026, 3, 10, 0, 0), time.UTC, utc(2026, 3, 15, 4, 0), true},
+		{"monthly next month", api.JobSchedule{Type: "monthly", Time: "04:00", DayOfMonth: 15}, utc(2026, 3, 20, 0, 0), time.UTC, utc(2026, 4, 15, 4, 0), true},
+		{"monthly short month", api.JobSchedule{Type: "monthly", Time: "04:00", DayOfMonth: 31}, utc(2026, 2, 1, 0, 0), time.UTC, utc(2026, 2, 28, 4, 0), true},
+		{"monthly after clamped day", api.JobSchedule{Type: "monthly", Time: "04:00", DayOfMonth: 31}, utc(2026, 2, 28, 5, 0), time.UTC, utc(2026, 3, 31, 4, 0), true},
+		{"monthly year end", api.JobSchedule{Type: "monthly", Time: "04:00", DayOfMonth: 5}, utc(2026, 12, 10, 0, 0), time.UTC, utc(2027, 1, 5, 4, 0), true},
+		{"monthly invalid day is first", api.JobSchedule{Type: "monthly", Time: "04:00"}, utc(2026, 3, 10, 0, 0), time.UTC, utc(2026, 4, 1, 4, 0), true},
+		{"manual", api.JobSchedule{Type: "manual", Time: "02:00"}, utc(2026, 3, 10, 0, 0), time.UTC, time.Time{}, false},
+		{"custom cron", api.JobSchedule{Type: "custom", Cron: "0 2 * * *"}, utc(2026, 3, 10, 0, 0), time.UTC, time.Time{}, false},
+		{"invalid hour", api.JobSchedule{Type: "daily", Time: "24:00"}, utc(2026, 3, 10, 0, 0), time.UTC, time.Time{}, false},
+		{"invalid time", api.JobSchedule{Type: "daily", Time: "2am"}, utc(2026, 3, 10, 0, 0), time.UTC, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Next(tt.schedule, tt.after, tt.loc)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+// Package offline lets the agent run the backup schedule of its server on its own while
+// the server is unreachable. The schedule is synced while the server is reachable;
+// once it has been unreachable for offline.after, due backups run locally and their
+// outcome is uploaded when the server is back.
+package offline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/config"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/queue"
+	"github.com/phpborg/phpborg-agent/internal/secrets"
+)
+
+// checkInterval is how often due jobs, schedule sync and uploads are checked
+const checkInterval = time.Minute
+
+// Runner runs a backup_create task outside the task queue
+type Runner interface {
+	RunOffline(ctx context.Context, t api.Task) (map[string]interface{}, int, error)
+}
+
+// Scheduler syncs the schedule, runs due jobs during outages and uploads their runs
+type Scheduler struct {
+	cfg     config.OfflineConfig
+	client  *api.Client
+	store   *Store
+	secrets *secrets.Store // nil = no secret store, passphrases are not synced
+	runner  Runner
+	queue   *queue.Queue
+
+	mu          sync.Mutex
+	lastContact time.Time
+	lastSync    time.Time
+	active      bool // running the schedule itself
+	noSchedule  bool // "nothing synced yet" logged for this outage
+	wake        chan struct{}
+}
+
+// NewScheduler creates the scheduler. secretStore may be nil.
+func NewScheduler(cfg config.OfflineConfig, client *api.Client, store *Store, secretStore *secrets.Store, runner Runner, q *queue.Queue) *Scheduler {
+	return &Scheduler{
+		cfg:         cfg,
+		client:      client,
+		store:       store,
+		secrets:     secretStore,
+		runner:      runner,
+		queue:       q,
+		lastContact: time.Now(),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// ServerReached records a response of the server (heartbeat). The agent only runs the
+// schedule itself once the server has not answered for offline.after.
+func (s *Scheduler) ServerReached() {
+	s.mu.Lock()
+	wasActive := s.active
+	s.lastContact = time.Now()
+	s.active = false
+	s.noSchedule = false
+	s.mu.Unlock()
+
+	if wasActive {
+		slog.Info("Server reachable again, leaving the schedule to the server", logging.ComponentKey, "OFFLINE", "runs_to_upload", s.store.PendingRuns())
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// State returns when the schedule was last synced, whether the agent runs it itself
+// and the number of runs waiting to be uploaded
+func (s *Scheduler) State() (syncedAt time.Time, active bool, pending int) {
+	_, syncedAt, _ = s.store.Schedule()
+	s.mu.Lock()
+	active = s.active
+	s.mu.Unlock()
+	return syncedAt, active, s.store.PendingRuns()
+}
+
+// Run checks the schedule every minute until intake is done (drain: no new job
+// starts). A running job goes on until ctx is done.
+func (s *Scheduler) Run(ctx, intake context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		s.check(ctx, intake)
+		select {
+		case <-intake.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// check syncs and uploads while the server answers, runs due jobs once it has not
+// answered for offline.after
+func (s *Scheduler) check(ctx, intake context.Context) {
+	now := time.Now()
+	s.mu.Lock()
+	unreachable := now.Sub(s.lastContact)
+	syncDue := now.Sub(s.lastSync) >= s.cfg.SyncInterval
+	s.mu.Unlock()
+
+	if unreachable < s.cfg.After {
+		s.upload(intake)
+		if syncDue {
+			s.sync(intake, now)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	if !s.active {
+		s.active = true
+		slog.Warn("Server unreachable, running the synced schedule locally", logging.ComponentKey, "OFFLINE", "unreachable_for", unreachable.Round(time.Second))
+	}
+	s.mu.Unlock()
+	s.runDue(ctx, intake, now)
+}
+
+// sync fetches the schedule, keeping the passphrases in the secret store only
+func (s *Scheduler) sync(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	s.lastSync = now
+	s.mu.Unlock()
+
+	schedule, err := s.client.GetSchedule(ctx, s.secrets != nil)
+	if err != nil {
+		if api.IsRejected(err) {
+			slog.Warn("Server refused the schedule sync", logging.ComponentKey, "OFFLINE", "error", err, "retry_in", s.cfg.SyncInterval)
+		} else {
+			slog.Warn("Schedule sync failed", logging.ComponentKey, "OFFLINE", "error", err)
+		}
+		return
+	}
+
+	if s.secrets != nil {
+		passphrases := make(map[string]string)
+		for _, job := range schedule.Jobs {
+			if job.Passphrase != "" {
+				passphrases[jobSecret(job.ID)] = job.Passphrase
+			}
+		}
+		if !s.secretsEqual(passphrases) {
+			if err := s.secrets.Replace(passphrases); err != nil {
+				slog.Error("Could not update the secret store", logging.ComponentKey, "OFFLINE", "error", err)
+			}
+		}
+	}
+
+	previous, _, synced := s.store.Schedule()
+	if err := s.store.SetSchedule(*schedule, now); err != nil {
+		slog.Error("Could not save the schedule", logging.ComponentKey, "OFFLINE", "error", err)
+		return
+	}
+	if !synced || len(previous.Jobs) != len(schedule.Jobs) {
+		slog.Info("Schedule synced", logging.ComponentKey, "OFFLINE", "jobs", len(schedule.Jobs))
+	}
+}
+
+// secretsEqual reports whether the secret store already holds exactly values
+func (s *Scheduler) secretsEqual(values map[string]string) bool {
+	if s.secrets.Len() != len(values) {
+		return false
+	}
+	for name, v := range values {
+		if cur, ok := s.secrets.Get(name); !ok || cur != v {
+			return false
+		}
+	}
+	return true
+}
+
+// runDue runs, one after the other, the jobs whose next run has come. No job starts
+// once intake is done.
+func (s *Scheduler) runDue(ctx, intake context.Context, now time.Time) {
+	schedule, syncedAt, ok := s.store.Schedule()
+	if !ok {
+		s.mu.Lock()
+		if !s.noSchedule {
+			s.noSchedule = true
+			slog.Warn("No schedule synced yet, nothing to run", logging.ComponentKey, "OFFLINE")
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	loc := scheduleLocation(schedule)
+	for _, job := range schedule.Jobs {
+		if intake.Err() != nil {
+			return
+		}
+		last := s.store.LastRun(job.ID)
+		if job.LastRunAt != nil && job.LastRunAt.After(last) {
+			last = *job.LastRunAt
+		}
+		if last.IsZero() {
+			last = syncedAt
+		}
+		next, ok := Next(job.Schedule, last, loc)
+		if !ok || next.After(now) {
+			continue
+		}
+		s.runJob(ctx, schedule, job, next, loc)
+	}
+}
+
+// RanOffline reports whether the agent already ran a job on its own in the schedule
+// window of a task the server created at createdAt (server time zone, as sent in the
+// task): the server queued that task while it could not reach the agent, and running
+// it would back up the same window twice. It also returns when the offline run started.
+func (s *Scheduler) RanOffline(jobID int, createdAt string) (time.Time, bool) {
+	ranAt := s.store.LastRun(jobID)
+	schedule, _, ok := s.store.Schedule()
+	if ranAt.IsZero() || !ok {
+		return time.Time{}, false
+	}
+	loc := scheduleLocation(schedule)
+	created, err := time.ParseInLocation("2006-01-02 15:04:05", createdAt, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, job := range schedule.Jobs {
+		if job.ID != jobID {
+			continue
+		}
+		// Same window: the next scheduled run after either is the same
+		ranWindow, ok := Next(job.Schedule, ranAt, loc)
+		if !ok {
+			return time.Time{}, false
+		}
+		createdWindow, _ := Next(job.Schedule, created, loc)
+		return ranAt, createdWindow.Equal(ranWindow)
+	}
+	return time.Time{}, false
+}
+
+// runJob runs a job due at due and keeps its outcome for upload
+func (s *Scheduler) runJob(ctx context.Context, schedule api.Schedule, job api.ScheduledJob, due time.Time, loc *time.Location) {
+	startedAt := time.Now()
+	prefix := job.ArchivePrefix
+	if prefix == "" {
+		prefix = "backup"
+	}
+	run := api.OfflineRun{
+		RunID:       fmt.Sprintf("job%d-%d", job.ID, startedAt.Unix()),
+		JobID:       job.ID,
+		ArchiveName: prefix + "_" + startedAt.In(loc).Format("2006-01-02_15-04-05"),
+		StartedAt:   startedAt.UTC(),
+		ScheduledAt: due.UTC(),
+	}
+
+	t, err := s.buildTask(job, run.ArchiveName, schedule.PayloadVersion)
+	if err == nil && !s.queue.Reserve(t) {
+		slog.Info("Job due but a task runs on its repository or the task limits are reached, retrying later", logging.ComponentKey, "OFFLINE", "job_id", job.ID, "job", job.Name)
+		return
+	}
+	// Recorded before running: a crash mid-backup does not rerun the job in a loop
+	if err := s.store.SetLastRun(job.ID, startedAt); err != nil {
+		slog.Error("Could not record the run of the job", logging.ComponentKey, "OFFLINE", "job_id", job.ID, "job", job.Name, "error", err)
+	}
+
+	var result map[string]interface{}
+	exitCode := 1
+	if err == nil {
+		slog.Info("Running job", logging.ComponentKey, "OFFLINE", "job_id", job.ID, "job", job.Name, "type", t.Type, "archive", run.ArchiveName)
+		result, exitCode, err = s.runner.RunOffline(ctx, t)
+		s.queue.Release(t)
+	}
+
+	run.FinishedAt = time.Now().UTC()
+	run.ExitCode = exitCode
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		slog.Error("Job failed", logging.ComponentKey, "OFFLINE", "job_id", job.ID, "job", job.Name, "exit_code", exitCode, "error", err)
+	} else {
+		run.Status = "completed"
+		run.Result = result
+		slog.Info("Job completed", logging.ComponentKey, "OFFLINE", "job_id", job.ID, "job", job.Name, "duration", run.FinishedAt.Sub(run.StartedAt).Round(time.Second))
+	}
+	if err := s.store.AddRun(run); err != nil {
+		slog.Error("Run of the job could not be saved for upload", logging.ComponentKey, "OFFLINE", "job_id", job.ID, "job", job.Name, "run_id", run.RunID, "error", err)
+	}
+}
+
+// buildTask builds the backup_create task of a job: its payload with the archive name
+// and, for an encrypted repository, the passphrase from the secret store
+func (s *Scheduler) buildTask(job api.ScheduledJob, archiveName string, payloadVersion int) (api.Task, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(job.Backup, &fields); err != nil {
+		return api.Task{}, fmt.Errorf("invalid backup definition: %w", err)
+	}
+	fields["archive_name"], _ = json.Marshal(archiveName)
+
+	if job.Encrypted {
+		if s.secrets == nil {
+			return api.Task{}, fmt.Errorf("repository passphrase unavailable: no local secret store (offline.secret_key_file)")
+		}
+		passphrase, ok := s.secrets.Get(jobSecret(job.ID))
+		if !ok {
+			return api.Task{}, fmt.Errorf("repository passphrase not in the local secret store")
+		}
+		fields["passphrase"], _ = json.Marshal(passphrase)
+	}
+
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return api.Task{}, err
+	}
+	return api.Task{Type: "backup_create", Payload: payload, PayloadVersion: payloadVersion}, nil
+}
+
+// upload sends the offline runs, oldest first, stopping at the first transport error
+func (s *Scheduler) upload(ctx context.Context) {
+	for _, run := range s.store.Runs() {
+		err := s.client.UploadOfflineRun(ctx, run)
+		switch {
+		case err == nil:
+			slog.Info("Uploaded run", logging.ComponentKey, "OFFLINE", "run_id", run.RunID, "job_id", run.JobID, "status", run.Status)
+			s.store.RemoveRun(run.RunID)
+		case api.IsRejected(err):
+			slog.Warn("Dropping run rejected by server", logging.ComponentKey, "OFFLINE", "run_id", run.RunID, "job_id", run.JobID, "error", err)
+			s.store.RemoveRun(run.RunID)
+		default:
+			slog.Warn("Upload of run failed, will retry", logging.ComponentKey, "OFFLINE", "run_id", run.RunID, "job_id", run.JobID, "error", err)
+			return
+		}
+	}
+}
+
+// scheduleLocation returns the time zone the schedule is computed in (the server's),
+// the local one when unknown
+func scheduleLocation(schedule api.Schedule) *time.Location {
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// jobSecret names the passphrase of a job in the secret store
+func jobSecret(jobID int) string {
+	return "job:" + strconv.Itoa(jobID)
+}
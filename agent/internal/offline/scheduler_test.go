@@ -0,0 +1,145 @@
+package offline
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/queue"
+)
+
+// fakeRunner counts the offline backups it is asked to run
+type fakeRunner struct {
+	runs []api.Task
+}
+
+func (r *fakeRunner) RunOffline(ctx context.Context, t api.Task) (map[string]interface{}, int, error) {
+	r.runs = append(r.runs, t)
+	return map[string]interface{}{}, 0, nil
+}
+
+func TestRunDue(t *testing.T) {
+	job := api.ScheduledJob{
+		ID:       7,
+		Name:     "nightly",
+		Schedule: api.JobSchedule{Type: "daily", Time: "02:00"},
+		Backup:   json.RawMessage(`{"repo_path":"/srv/repo","paths":["/etc"]}`),
+	}
+	sameRepo := api.Task{ID: 1, Type: "backup_create", Payload: json.RawMessage(`{"repo_path":"/srv/repo"}`)}
+	otherRepo := api.Task{ID: 2, Type: "backup_restore", Payload: json.RawMessage(`{"repo_path":"/srv/other"}`)}
+
+	tests := []struct {
+		name     string
+		draining bool
+		limits   map[string]int
+		running  []api.Task // held outside the scheduler
+		wantRuns int
+	}{
+		{"due job runs", false, nil, nil, 1},
+		{"draining", true, nil, nil, 0},
+		{"repository busy", false, nil, []api.Task{sameRepo}, 0},
+		{"class limit reached", false, map[string]int{"borg": 1}, []api.Task{otherRepo}, 0},
+		{"class limit free", false, map[string]int{"borg": 2}, []api.Task{otherRepo}, 1},
+		{"type limit reached", false, map[string]int{"backup_create": 1}, []api.Task{{ID: 3, Type: "backup_create"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := OpenStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Synced two days ago: the job's run of last night is due
+			if err := store.SetSchedule(api.Schedule{Timezone: "UTC", Jobs: []api.ScheduledJob{job}}, time.Now().Add(-48*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			q, _, err := queue.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.SetClasses(map[string]string{"backup_create": "borg", "backup_restore": "borg"})
+			q.SetSerialKey(func(task api.Task) string {
+				var p struct {
+					RepoPath string `json:"repo_path"`
+				}
+				_ = json.Unmarshal(task.Payload, &p)
+				return p.RepoPath
+			})
+			q.SetLimits(tt.limits)
+			for _, task := range tt.running {
+				if !q.Reserve(task) {
+					t.Fatalf("Reserve(#%d) failed", task.ID)
+				}
+			}
+			runner := &fakeRunner{}
+			s := &Scheduler{store: store, runner: runner, queue: q}
+
+			intake, stopIntake := context.WithCancel(context.Background())
+			defer stopIntake()
+			if tt.draining {
+				stopIntake()
+			}
+			s.runDue(context.Background(), intake, time.Now())
+
+			if len(runner.runs) != tt.wantRuns {
+				t.Fatalf("ran %d backup(s), want %d", len(runner.runs), tt.wantRuns)
+			}
+			if ran := !store.LastRun(job.ID).IsZero(); ran != (tt.wantRuns > 0) {
+				t.Errorf("last run recorded = %v, want %v", ran, tt.wantRuns > 0)
+			}
+			if tt.wantRuns > 0 && !q.Reserve(api.Task{ID: 9, Type: "backup_create", Payload: job.Backup}) {
+				t.Error("slot of the offline backup not released")
+			}
+		})
+	}
+}
+
+func TestRanOffline(t *testing.T) {
+	daily := api.JobSchedule{Type: "daily", Time: "02:00"}
+	tests := []struct {
+		name      string
+		timezone  string
+		job       api.ScheduledJob
+		ranAt     time.Time // zero = never ran offline
+		jobID     int
+		createdAt string
+		want      bool
+	}{
+		{"same window", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 7, "2026-03-10 02:00:00", true},
+		{"created later in the window", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 7, "2026-03-10 18:00:00", true},
+		{"previous window", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 7, "2026-03-10 01:59:00", false},
+		{"next window", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 7, "2026-03-11 02:00:00", false},
+		{"server time zone", "Europe/Paris", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 1, 0, 30, 0, time.UTC), 7, "2026-03-10 02:00:00", true},
+		{"other job", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 8, "2026-03-10 02:00:00", false},
+		{"never ran offline", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Time{}, 7, "2026-03-10 02:00:00", false},
+		{"custom schedule", "UTC", api.ScheduledJob{ID: 7, Schedule: api.JobSchedule{Type: "custom", Cron: "0 2 * * *"}}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 7, "2026-03-10 02:00:00", false},
+		{"invalid creation time", "UTC", api.ScheduledJob{ID: 7, Schedule: daily}, time.Date(2026, 3, 10, 2, 0, 30, 0, time.UTC), 7, "2026-03-10T02:00:00Z", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := OpenStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			schedule := api.Schedule{Timezone: tt.timezone, Jobs: []api.ScheduledJob{tt.job}}
+			if err := store.SetSchedule(schedule, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ranAt.IsZero() {
+				if err := store.SetLastRun(tt.job.ID, tt.ranAt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := &Scheduler{store: store}
+
+			startedAt, got := s.RanOffline(tt.jobID, tt.createdAt)
+			if got != tt.want {
+				t.Errorf("RanOffline(%d, %s) = %v, want %v", tt.jobID, tt.createdAt, got, tt.want)
+			}
+			if got && !startedAt.Equal(tt.ranAt) {
+				t.Errorf("RanOffline() started at %v, want %v", startedAt, tt.ranAt)
+			}
+		})
+	}
+}
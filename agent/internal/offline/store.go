@@ -0,0 +1,184 @@
+package offline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// syncedSchedule is the last schedule received from the server, without passphrases
+type syncedSchedule struct {
+	Schedule api.Schedule `json:"schedule"`
+	SyncedAt time.Time    `json:"synced_at"`
+}
+
+// Store keeps on disk, under dir, the synced schedule, the last offline run of each
+// job and the offline runs not yet uploaded (one JSON file per run under runs/).
+type Store struct {
+	dir string
+
+	mu       sync.Mutex
+	schedule *syncedSchedule
+	lastRuns map[int]time.Time
+	runs     map[string]*api.OfflineRun
+}
+
+// OpenStore loads the store kept in dir, creating the directories if needed
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "runs"), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create offline directory: %w", err)
+	}
+
+	s := &Store{
+		dir:      dir,
+		lastRuns: make(map[int]time.Time),
+		runs:     make(map[string]*api.OfflineRun),
+	}
+
+	var synced syncedSchedule
+	switch err := readJSON(filepath.Join(dir, "schedule.json"), &synced); {
+	case err == nil:
+		s.schedule = &synced
+	case !os.IsNotExist(err):
+		slog.Warn("Ignoring unreadable schedule (synced again once the server is reachable)", logging.ComponentKey, "OFFLINE", "error", err)
+	}
+	if err := readJSON(filepath.Join(dir, "state.json"), &s.lastRuns); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Ignoring unreadable run state", logging.ComponentKey, "OFFLINE", "error", err)
+	}
+
+	runsDir := filepath.Join(dir, "runs")
+	files, err := os.ReadDir(runsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read offline runs directory: %w", err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if fileutil.IsTempFile(name) {
+			_ = os.Remove(filepath.Join(runsDir, name))
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		var run api.OfflineRun
+		if err := readJSON(filepath.Join(runsDir, name), &run); err != nil {
+			slog.Warn("Removing corrupt run", logging.ComponentKey, "OFFLINE", "file", name, "error", err)
+			_ = os.Remove(filepath.Join(runsDir, name))
+			continue
+		}
+		s.runs[run.RunID] = &run
+	}
+
+	if len(s.runs) > 0 {
+		slog.Info("Offline runs waiting to be uploaded", logging.ComponentKey, "OFFLINE", "count", len(s.runs))
+	}
+	return s, nil
+}
+
+// Schedule returns the synced schedule and when it was synced, false if none yet
+func (s *Store) Schedule() (api.Schedule, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schedule == nil {
+		return api.Schedule{}, time.Time{}, false
+	}
+	return s.schedule.Schedule, s.schedule.SyncedAt, true
+}
+
+// SetSchedule replaces the synced schedule. Passphrases are not written.
+func (s *Store) SetSchedule(schedule api.Schedule, syncedAt time.Time) error {
+	jobs := make([]api.ScheduledJob, len(schedule.Jobs))
+	for i, job := range schedule.Jobs {
+		job.Passphrase = ""
+		jobs[i] = job
+	}
+	schedule.Jobs = jobs
+	synced := &syncedSchedule{Schedule: schedule, SyncedAt: syncedAt.UTC()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule = synced
+	return writeJSON(filepath.Join(s.dir, "schedule.json"), synced)
+}
+
+// LastRun returns when the agent last ran a job on its own (zero = never)
+func (s *Store) LastRun(jobID int) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRuns[jobID]
+}
+
+// SetLastRun records that the agent started a job on its own
+func (s *Store) SetLastRun(jobID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRuns[jobID] = at.UTC()
+	return writeJSON(filepath.Join(s.dir, "state.json"), s.lastRuns)
+}
+
+// AddRun keeps an offline run until it is uploaded
+func (s *Store) AddRun(run api.OfflineRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.RunID] = &run
+	return writeJSON(s.runPath(run.RunID), &run)
+}
+
+// RemoveRun forgets an uploaded run
+func (s *Store) RemoveRun(runID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runs, runID)
+	if err := os.Remove(s.runPath(runID)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove run", logging.ComponentKey, "OFFLINE", "run_id", runID, "error", err)
+	}
+}
+
+// Runs returns the runs waiting to be uploaded, oldest first
+func (s *Store) Runs() []api.OfflineRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]api.OfflineRun, 0, len(s.runs))
+	for _, run := range s.runs {
+		out = append(out, *run)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// PendingRuns returns the number of runs waiting to be uploaded
+func (s *Store) PendingRuns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.runs)
+}
+
+func (s *Store) runPath(runID string) string {
+	return filepath.Join(s.dir, "runs", runID+".json")
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", filepath.Base(path), err)
+	}
+	return fileutil.WriteAtomic(path, data, 0600)
+}
@@ -0,0 +1,34 @@
+package platform
+
+import (
+	_ "embed"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdUnitTemplate is the agent unit. The server installer
+// (AgentInstallService::buildInstallScript) renders the same file.
+//
+//go:embed phpborg-agent.service
+var systemdUnitTemplate string
+
+// SystemdStopMargin is the time systemd gives the agent on top of the shutdown grace
+// period before killing it, to report the outcome of the tasks it stopped
+const SystemdStopMargin = 2 * time.Minute
+
+// SystemdUnit renders the agent unit for user, running execStart. TimeoutStopSec is
+// SystemdStopTimeout of the shutdown grace period.
+func SystemdUnit(user, execStart string, gracePeriod time.Duration) string {
+	return strings.NewReplacer(
+		"@USER@", user,
+		"@EXEC_START@", execStart,
+		"@TIMEOUT_STOP_SEC@", strconv.Itoa(SystemdStopTimeout(gracePeriod)),
+	).Replace(systemdUnitTemplate)
+}
+
+// SystemdStopTimeout returns the TimeoutStopSec of a unit running the agent: the
+// shutdown grace period plus SystemdStopMargin, in seconds
+func SystemdStopTimeout(gracePeriod time.Duration) int {
+	return int((gracePeriod + SystemdStopMargin + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,251 @@
+// Package queue provides the agent's durable local task queue. Every task received
+// from the server is written to disk before it is acknowledged to a worker, so a full
+// worker pool or an agent restart never loses it.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// Entry states
+const (
+	StatePending = "pending" // received, waiting for a worker
+	StateRunning = "running" // handed to a worker
+)
+
+// Entry is a task as recorded in the queue
+type Entry struct {
+	Task       api.Task  `json:"task"`
+	State      string    `json:"state"`
+	Seq        uint64    `json:"seq"`
+	ReceivedAt time.Time `json:"received_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Queue is a persistent priority queue of tasks, one JSON file per task under dir
+type Queue struct {
+	dir string
+
+	mu      sync.Mutex
+	entries map[int]*Entry
+	seq     uint64
+	// running counts running tasks per type and per concurrency class, limits caps
+	// them (see SetLimits and SetClasses)
+	running      map[string]int
+	runningClass map[string]int
+	limits       map[string]int
+	classes      map[string]string
+	// serialKey returns the resource a task works on ("" = none); two tasks with the
+	// same key never run together (see SetSerialKey)
+	serialKey func(api.Task) string
+	busyKeys  map[string]bool
+	// wake is signalled whenever a task may have become runnable
+	wake chan struct{}
+}
+
+// Open loads the queue stored in dir, creating the directory if needed. Tasks that
+// were running when the agent stopped are returned as interrupted and removed from the
+// queue: they may have been started on the server, which is told about them
+// separately (see task.Handler.FailInterrupted). Pending tasks are kept and run again.
+func Open(dir string) (*Queue, []Entry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &Queue{
+		dir:          dir,
+		entries:      make(map[int]*Entry),
+		running:      make(map[string]int),
+		runningClass: make(map[string]int),
+		limits:       make(map[string]int),
+		classes:      make(map[string]string),
+		busyKeys:     make(map[string]bool),
+		wake:         make(chan struct{}, 1),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	var interrupted []Entry
+	for _, f := range files {
+		name := f.Name()
+		if fileutil.IsTempFile(name) {
+			_ = os.Remove(filepath.Join(dir, name)) // leftover of an interrupted write
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("Skipping unreadable entry", logging.ComponentKey, "QUEUE", "entry", name, "error", err)
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			slog.Warn("Removing corrupt entry", logging.ComponentKey, "QUEUE", "entry", name, "error", err)
+			_ = os.Remove(path)
+			continue
+		}
+		if e.State == StateRunning {
+			interrupted = append(interrupted, e)
+			_ = os.Remove(path)
+			continue
+		}
+		if e.Seq > q.seq {
+			q.seq = e.Seq
+		}
+		q.entries[e.Task.ID] = &e
+	}
+
+	if len(q.entries) > 0 {
+		slog.Info("Restored pending tasks", logging.ComponentKey, "QUEUE", "count", len(q.entries), "dir", dir)
+		q.signal()
+	}
+
+	return q, interrupted, nil
+}
+
+// Push records a task. It reports false when the task is already queued or running
+// (the server re-offers a task until it is started).
+func (q *Queue) Push(task api.Task) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, exists := q.entries[task.ID]; exists {
+		return false, nil
+	}
+
+	q.seq++
+	now := time.Now().UTC()
+	e := &Entry{
+		Task:       task,
+		State:      StatePending,
+		Seq:        q.seq,
+		ReceivedAt: now,
+		UpdatedAt:  now,
+	}
+	q.entries[task.ID] = e
+	q.signal()
+
+	// Keep the task in memory even if the disk write fails: it still runs, it just
+	// would not survive a restart.
+	if err := q.save(e); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// Next blocks until a task may run (see nextRunnable), marks it running and returns it.
+// Once ctx is done it returns ctx.Err() even when tasks are runnable: a draining or
+// removed worker takes no new task.
+func (q *Queue) Next(ctx context.Context) (api.Task, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			q.signal() // hand a wake-up this worker may have taken to another one
+			return api.Task{}, err
+		}
+		q.mu.Lock()
+		e := q.nextRunnable()
+		if e != nil {
+			e.State = StateRunning
+			e.UpdatedAt = time.Now().UTC()
+			q.take(e.Task)
+			if err := q.save(e); err != nil {
+				slog.Error("Failed to persist task state", logging.ComponentKey, "QUEUE", "task_id", e.Task.ID, "error", err)
+			}
+			if q.nextRunnable() != nil {
+				q.signal() // let another worker pick the next one
+			}
+			q.mu.Unlock()
+			return e.Task, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return api.Task{}, ctx.Err()
+		case <-q.wake:
+		}
+	}
+}
+
+// Done removes a task once it has been processed (successfully or not)
+func (q *Queue) Done(taskID int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e, ok := q.entries[taskID]; ok && e.State == StateRunning {
+		q.free(e.Task)
+		q.signal() // a slot of this type is free again
+	}
+	delete(q.entries, taskID)
+	if err := os.Remove(q.path(taskID)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove task", logging.ComponentKey, "QUEUE", "task_id", taskID, "error", err)
+	}
+}
+
+// Len returns the number of pending tasks
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, e := range q.entries {
+		if e.State == StatePending {
+			n++
+		}
+	}
+	return n
+}
+
+// Entries returns a snapshot of all queued and running tasks, oldest first
+func (q *Queue) Entries() []Entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := make([]Entry, 0, len(q.entries))
+	for _, e := range q.entries {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out
+}
+
+// signal wakes one waiting worker without blocking
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) path(taskID int) string {
+	return filepath.Join(q.dir, strconv.Itoa(taskID)+".json")
+}
+
+// save writes an entry atomically. Caller holds q.mu.
+func (q *Queue) save(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %w", err)
+	}
+	return fileutil.WriteAtomic(q.path(e.Task.ID), data, 0600)
+}
@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+func TestNextAfterCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		tasks   []api.Task
+		cancel  bool
+		wantID  int
+		wantErr error
+		wantLen int // pending tasks left
+	}{
+		{"runnable task", []api.Task{{ID: 1}, {ID: 2}}, false, 1, nil, 1},
+		{"cancelled with tasks queued", []api.Task{{ID: 1}, {ID: 2}}, true, 0, context.Canceled, 2},
+		{"cancelled with empty queue", nil, true, 0, context.Canceled, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := openQueue(t, tt.tasks)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			task, err := q.Next(ctx)
+			if !errors.Is(err, tt.wantErr) || task.ID != tt.wantID {
+				t.Errorf("Next() = #%d, %v, want #%d, %v", task.ID, err, tt.wantID, tt.wantErr)
+			}
+			if got := q.Len(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestNextStopsWaitingWorker(t *testing.T) {
+	q := openQueue(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := q.Next(ctx)
+		errc <- err
+	}()
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Next() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next() still waiting after cancel")
+	}
+}
+
+func TestShrinkPool(t *testing.T) {
+	// Workers 1 and 2 of a pool of 3 are removed (max_concurrent_tasks lowered) while
+	// tasks are queued: only worker 0 keeps taking them
+	q := openQueue(t, []api.Task{{ID: 1}, {ID: 2}, {ID: 3}})
+	intake := context.Background()
+	var stops []context.CancelFunc
+	var workers []context.Context
+	for i := 0; i < 3; i++ {
+		ctx, stop := context.WithCancel(intake)
+		workers, stops = append(workers, ctx), append(stops, stop)
+	}
+	defer stops[0]()
+	stops[2]()
+	stops[1]()
+
+	tests := []struct {
+		worker  int
+		wantID  int
+		wantErr error
+	}{
+		{2, 0, context.Canceled},
+		{1, 0, context.Canceled},
+		{0, 1, nil},
+		{1, 0, context.Canceled},
+		{0, 2, nil},
+	}
+	for _, tt := range tests {
+		task, err := q.Next(workers[tt.worker])
+		if !errors.Is(err, tt.wantErr) || task.ID != tt.wantID {
+			t.Errorf("worker %d: Next() = #%d, %v, want #%d, %v", tt.worker, task.ID, err, tt.wantID, tt.wantErr)
+		}
+	}
+	if got := q.Len(); got != 1 {
+		t.Errorf("Len() = %d, want 1", got)
+	}
+}
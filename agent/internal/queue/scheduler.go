@@ -0,0 +1,148 @@
+package queue
+
+import "github.com/phpborg/phpborg-agent/internal/api"
+
+// priorityRank orders the server's task priorities (agent_tasks.priority). Unknown or
+// empty values rank as "normal".
+func priorityRank(priority string) int {
+	switch priority {
+	case "critical":
+		return 3
+	case "high":
+		return 2
+	case "low":
+		return 0
+	default:
+		return 1
+	}
+}
+
+// SetLimits sets the maximum number of tasks of a given type or concurrency class that
+// may run at the same time (e.g. backup_create: 1, borg: 1). Types without a limit, or
+// with a limit <= 0, are only bounded by the number of workers.
+func (q *Queue) SetLimits(limits map[string]int) {
+	q.mu.Lock()
+	q.limits = make(map[string]int, len(limits))
+	for taskType, n := range limits {
+		if n > 0 {
+			q.limits[taskType] = n
+		}
+	}
+	q.mu.Unlock()
+	// A raised limit may unblock a waiting task.
+	q.signal()
+}
+
+// SetClasses sets the concurrency class of each task type. The tasks of a class share
+// the limit set for the class name. Call it before the workers start.
+func (q *Queue) SetClasses(classes map[string]string) {
+	q.mu.Lock()
+	q.classes = make(map[string]string, len(classes))
+	for taskType, class := range classes {
+		q.classes[taskType] = class
+	}
+	q.mu.Unlock()
+}
+
+// SetSerialKey sets the function naming the resource a task works on (e.g. its borg
+// repository). Tasks with the same non-empty key run one at a time, in queue order.
+// Call it before the workers start.
+func (q *Queue) SetSerialKey(fn func(api.Task) string) {
+	q.mu.Lock()
+	q.serialKey = fn
+	q.mu.Unlock()
+}
+
+// keyOf returns the serial key of a task ("" = none). Caller holds q.mu.
+func (q *Queue) keyOf(task api.Task) string {
+	if q.serialKey == nil {
+		return ""
+	}
+	return q.serialKey(task)
+}
+
+// hasSlot reports whether one more task of this type may start: neither the type nor
+// its class has used all its slots. Caller holds q.mu.
+func (q *Queue) hasSlot(taskType string) bool {
+	if limit, ok := q.limits[taskType]; ok && q.running[taskType] >= limit {
+		return false
+	}
+	class, ok := q.classes[taskType]
+	if !ok {
+		return true
+	}
+	limit, ok := q.limits[class]
+	return !ok || q.runningClass[class] < limit
+}
+
+// take counts task as running: a slot of its type and class, and its serial key.
+// Caller holds q.mu.
+func (q *Queue) take(task api.Task) {
+	q.running[task.Type]++
+	if class, ok := q.classes[task.Type]; ok {
+		q.runningClass[class]++
+	}
+	if key := q.keyOf(task); key != "" {
+		q.busyKeys[key] = true
+	}
+}
+
+// free gives back what take counted. Caller holds q.mu.
+func (q *Queue) free(task api.Task) {
+	q.running[task.Type]--
+	if class, ok := q.classes[task.Type]; ok {
+		q.runningClass[class]--
+	}
+	if key := q.keyOf(task); key != "" {
+		delete(q.busyKeys, key)
+	}
+}
+
+// nextRunnable returns the pending entry to run next: highest priority first, then
+// oldest first, skipping types that have used all their slots. Caller holds q.mu.
+func (q *Queue) nextRunnable() *Entry {
+	var best *Entry
+	for _, e := range q.entries {
+		if e.State != StatePending || !q.hasSlot(e.Task.Type) {
+			continue
+		}
+		if key := q.keyOf(e.Task); key != "" && q.busyKeys[key] {
+			continue // another task works on the same repository
+		}
+		if best == nil {
+			best = e
+			continue
+		}
+		rank, bestRank := priorityRank(e.Task.Priority), priorityRank(best.Task.Priority)
+		if rank > bestRank || (rank == bestRank && e.Seq < best.Seq) {
+			best = e
+		}
+	}
+	return best
+}
+
+// Reserve takes a slot for a task that runs outside the queue (a backup of the offline
+// schedule): its type and class count against agent.task_limits and its serial key is
+// busy, so no queued task on the same repository starts meanwhile. It reports false
+// when the limits are reached or a task on that key is already running. Release gives
+// the slot back.
+func (q *Queue) Reserve(task api.Task) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if key := q.keyOf(task); key != "" && q.busyKeys[key] {
+		return false
+	}
+	if !q.hasSlot(task.Type) {
+		return false
+	}
+	q.take(task)
+	return true
+}
+
+// Release gives back a slot taken by Reserve
+func (q *Queue) Release(task api.Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.free(task)
+	q.signal() // a task waiting on this repository or slot may start
+}
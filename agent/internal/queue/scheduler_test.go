@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// openQueue returns an empty queue holding tasks, pushed in order
+func openQueue(t *testing.T, tasks []api.Task) *Queue {
+	t.Helper()
+	q, _, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		if _, err := q.Push(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return q
+}
+
+// startAll starts every task that may run now, as idle workers would, and returns
+// their IDs in start order
+func startAll(t *testing.T, q *Queue) []int {
+	t.Helper()
+	var ids []int
+	for {
+		q.mu.Lock()
+		runnable := q.nextRunnable() != nil
+		q.mu.Unlock()
+		if !runnable {
+			return ids
+		}
+		task, err := q.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, task.ID)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks []api.Task
+		want  []int
+	}{
+		{"fifo", []api.Task{{ID: 1}, {ID: 2}, {ID: 3}}, []int{1, 2, 3}},
+		{"priorities", []api.Task{
+			{ID: 1, Priority: "low"},
+			{ID: 2, Priority: "normal"},
+			{ID: 3, Priority: "critical"},
+			{ID: 4, Priority: "high"},
+		}, []int{3, 4, 2, 1}},
+		{"same priority oldest first", []api.Task{
+			{ID: 1, Priority: "high"},
+			{ID: 2, Priority: "low"},
+			{ID: 3, Priority: "high"},
+		}, []int{1, 3, 2}},
+		{"unknown priority is normal", []api.Task{
+			{ID: 1, Priority: "low"},
+			{ID: 2, Priority: "urgent"},
+			{ID: 3},
+			{ID: 4, Priority: "normal"},
+		}, []int{2, 3, 4, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := openQueue(t, tt.tasks)
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("start order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits map[string]int
+		tasks  []api.Task
+		want   []int // started at once
+		done   []int // then finished
+		after  []int // then started
+	}{
+		{"no limit", nil,
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "backup_create"}},
+			[]int{1, 2}, nil, nil},
+		{"type limit", map[string]int{"backup_create": 1},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "backup_create"}, {ID: 3, Type: "status"}},
+			[]int{1, 3}, []int{1}, []int{2}},
+		{"limit of two", map[string]int{"backup_create": 2},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "backup_create"}, {ID: 3, Type: "backup_create"}},
+			[]int{1, 2}, []int{2}, []int{3}},
+		{"limited type skipped for lower priority", map[string]int{"backup_create": 1},
+			[]api.Task{
+				{ID: 1, Type: "backup_create", Priority: "high"},
+				{ID: 2, Type: "backup_create", Priority: "critical"},
+				{ID: 3, Type: "status", Priority: "low"},
+			},
+			[]int{2, 3}, []int{2}, []int{1}},
+		{"finished other type frees nothing", map[string]int{"backup_create": 1},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "status"}, {ID: 3, Type: "backup_create"}},
+			[]int{1, 2}, []int{2}, nil},
+		{"non-positive limit ignored", map[string]int{"backup_create": 0, "status": -1},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "backup_create"}, {ID: 3, Type: "status"}},
+			[]int{1, 2, 3}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := openQueue(t, tt.tasks)
+			q.SetLimits(tt.limits)
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("started %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.done {
+				q.Done(id)
+			}
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.after) {
+				t.Errorf("after %v finished, started %v, want %v", tt.done, got, tt.after)
+			}
+		})
+	}
+}
+
+func TestClassLimits(t *testing.T) {
+	classes := map[string]string{"backup_create": "borg", "restore": "borg", "package_install": "update"}
+	tests := []struct {
+		name   string
+		limits map[string]int
+		tasks  []api.Task
+		want   []int
+		done   []int
+		after  []int
+	}{
+		{"class shares its limit", map[string]int{"borg": 1},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "restore"}, {ID: 3, Type: "package_install"}},
+			[]int{1, 3}, []int{1}, []int{2}},
+		{"class limit of two", map[string]int{"borg": 2},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "restore"}, {ID: 3, Type: "backup_create"}},
+			[]int{1, 2}, []int{2}, []int{3}},
+		{"type limit within class", map[string]int{"borg": 3, "backup_create": 1},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "backup_create"}, {ID: 3, Type: "restore"}},
+			[]int{1, 3}, []int{1}, []int{2}},
+		{"class without limit", map[string]int{"update": 1},
+			[]api.Task{{ID: 1, Type: "backup_create"}, {ID: 2, Type: "restore"}, {ID: 3, Type: "status"}},
+			[]int{1, 2, 3}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := openQueue(t, tt.tasks)
+			q.SetClasses(classes)
+			q.SetLimits(tt.limits)
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("started %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.done {
+				q.Done(id)
+			}
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.after) {
+				t.Errorf("after %v finished, started %v, want %v", tt.done, got, tt.after)
+			}
+		})
+	}
+}
+
+func TestSerialKeys(t *testing.T) {
+	// Tasks 1-3 and 6 work on repository A, 4 on B, 5 on none
+	keys := map[int]string{1: "repo:A", 2: "repo:A", 3: "repo:A", 4: "repo:B", 6: "repo:A"}
+	tests := []struct {
+		name    string
+		tasks   []api.Task
+		reserve []api.Task // offline runs holding their repository
+		want    []int
+		done    []int
+		release []api.Task
+		after   []int
+	}{
+		{"one task per repository",
+			[]api.Task{{ID: 1}, {ID: 2}, {ID: 4}, {ID: 5}}, nil,
+			[]int{1, 4, 5}, []int{1}, nil, []int{2}},
+		{"queue order within repository",
+			[]api.Task{{ID: 1, Priority: "low"}, {ID: 2}, {ID: 3, Priority: "high"}}, nil,
+			[]int{3}, []int{3}, nil, []int{2}},
+		{"offline run holds repository",
+			[]api.Task{{ID: 1}, {ID: 4}}, []api.Task{{ID: 6}},
+			[]int{4}, nil, []api.Task{{ID: 6}}, []int{1}},
+		{"task without key unaffected",
+			[]api.Task{{ID: 5}}, []api.Task{{ID: 6}},
+			[]int{5}, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := openQueue(t, tt.tasks)
+			q.SetSerialKey(func(task api.Task) string { return keys[task.ID] })
+			for _, task := range tt.reserve {
+				if !q.Reserve(task) {
+					t.Fatalf("Reserve(#%d) = false on a free repository", task.ID)
+				}
+			}
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("started %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.done {
+				q.Done(id)
+			}
+			for _, task := range tt.release {
+				q.Release(task)
+			}
+			if got := startAll(t, q); !reflect.DeepEqual(got, tt.after) {
+				t.Errorf("started %v, want %v", got, tt.after)
+			}
+		})
+	}
+}
+
+func TestReserveBusyRepository(t *testing.T) {
+	q := openQueue(t, []api.Task{{ID: 1, Type: "backup_create"}})
+	q.SetSerialKey(func(task api.Task) string { return "repo:A" })
+	if got := startAll(t, q); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("started %v, want [1]", got)
+	}
+	if q.Reserve(api.Task{ID: 2}) {
+		t.Error("Reserve succeeded while a queued task runs on the repository")
+	}
+	q.Done(1)
+	if !q.Reserve(api.Task{ID: 2}) {
+		t.Error("Reserve failed on a free repository")
+	}
+}
+
+func TestPushRedelivery(t *testing.T) {
+	q := openQueue(t, nil)
+	tests := []struct {
+		name   string
+		action func()
+		want   bool
+	}{
+		{"new task", func() {}, true},
+		{"pending task offered again", func() {}, false},
+		{"running task offered again", func() { startAll(t, q) }, false},
+		{"finished task offered again", func() { q.Done(1) }, true},
+	}
+	for _, tt := range tests {
+		tt.action()
+		added, err := q.Push(api.Task{ID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != tt.want {
+			t.Errorf("%s: Push = %v, want %v", tt.name, added, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package secrets keeps the repository passphrases synced from the server encrypted on
+// disk (AES-256-GCM). The key is a local file that never leaves the host, so a copy of
+// the data directory alone does not reveal the passphrases.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+)
+
+// keySize is the size of the AES-256 key
+const keySize = 32
+
+// Store is the encrypted secret store, a name -> secret map held in one file
+type Store struct {
+	path string
+	aead cipher.AEAD
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// Open loads the store kept in path, encrypted with the key in keyFile. The key is
+// generated on first use; an existing key readable by group or others is refused.
+func Open(path, keyFile string) (*Store, error) {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secret store key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("secret store key: %w", err)
+	}
+
+	s := &Store{path: path, aead: aead, values: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read secret store: %w", err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("secret store is truncated")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("secret store cannot be decrypted with %s (key replaced?): %w", keyFile, err)
+	}
+	if err := json.Unmarshal(plain, &s.values); err != nil {
+		return nil, fmt.Errorf("secret store is corrupt: %w", err)
+	}
+	return s, nil
+}
+
+// Get returns a secret, false when the store does not hold it
+func (s *Store) Get(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[name]
+	return v, ok
+}
+
+// Len returns the number of stored secrets
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.values)
+}
+
+// Replace stores values in place of the current secrets
+func (s *Store) Replace(values map[string]string) error {
+	plain, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to marshal secrets: %w", err)
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create secret store directory: %w", err)
+	}
+	if err := fileutil.WriteAtomic(s.path, s.aead.Seal(nonce, nonce, plain, nil), 0600); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.values = make(map[string]string, len(values))
+	for name, v := range values {
+		s.values[name] = v
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// loadKey reads the store key, creating it when the file does not exist
+func loadKey(keyFile string) ([]byte, error) {
+	info, err := os.Stat(keyFile)
+	if os.IsNotExist(err) {
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, fmt.Errorf("failed to generate secret store key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create secret store key directory: %w", err)
+		}
+		if err := fileutil.WriteAtomic(keyFile, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write secret store key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secret store key: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("secret store key %s is accessible by group or others (mode %v), chmod 600 it", keyFile, info.Mode().Perm())
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret store key: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secret store key %s: expected %d bytes, got %d", keyFile, keySize, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,281 @@
+// Package spool keeps task results that could not be reported to the server (API
+// unreachable) on disk and replays them, in order, once the server is back. Without it
+// a backup that ran for hours would look hung or orphaned server-side.
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/fileutil"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// Entry kinds
+const (
+	KindComplete = "complete"
+	KindFail     = "fail"
+)
+
+// Replay backoff bounds
+const (
+	minBackoff = 30 * time.Second
+	maxBackoff = 15 * time.Minute
+)
+
+// Entry is the final outcome of a task waiting to be reported
+type Entry struct {
+	TaskID   int                    `json:"task_id"`
+	Kind     string                 `json:"kind"`
+	Result   map[string]interface{} `json:"result,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	ExitCode int                    `json:"exit_code"`
+	// Final progress, re-sent before the outcome (0 = none)
+	Progress int    `json:"progress,omitempty"`
+	Message  string `json:"message,omitempty"`
+
+	Seq       uint64    `json:"seq"`
+	CreatedAt time.Time `json:"created_at"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Spool is the on-disk result spool, one JSON file per task under dir. There is at
+// most one entry per task ID: a newer outcome replaces an older one, so a replay is
+// idempotent per task.
+type Spool struct {
+	dir    string
+	client *api.Client
+
+	mu      sync.Mutex
+	entries map[int]*Entry
+	seq     uint64
+	wake    chan struct{}
+}
+
+// Open loads the spool stored in dir, creating the directory if needed
+func Open(dir string, client *api.Client) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		dir:     dir,
+		client:  client,
+		entries: make(map[int]*Entry),
+		wake:    make(chan struct{}, 1),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if fileutil.IsTempFile(name) {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			slog.Warn("Skipping unreadable entry", logging.ComponentKey, "SPOOL", "file", name, "error", err)
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			slog.Warn("Removing corrupt entry", logging.ComponentKey, "SPOOL", "file", name, "error", err)
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if e.Seq > s.seq {
+			s.seq = e.Seq
+		}
+		s.entries[e.TaskID] = &e
+	}
+
+	if len(s.entries) > 0 {
+		slog.Info("Task results waiting to be reported", logging.ComponentKey, "SPOOL", "count", len(s.entries))
+	}
+
+	return s, nil
+}
+
+// Add records a task outcome for later delivery
+func (s *Spool) Add(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	e.Seq = s.seq
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	s.entries[e.TaskID] = &e
+	s.signal()
+
+	return s.save(&e)
+}
+
+// Has reports whether a result for this task is waiting to be reported
+func (s *Spool) Has(taskID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.entries[taskID]
+	return ok
+}
+
+// Len returns the number of results waiting to be reported
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Run replays spooled results until ctx is done. Results are sent oldest first; on
+// a transport error the replay stops and retries with exponential backoff so
+// outcomes reach the server in the order they happened.
+func (s *Spool) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		wait := backoff
+		if err := s.replay(ctx); err != nil {
+			slog.Warn("Server still unreachable", logging.ComponentKey, "SPOOL", "error", err, "pending", s.Len(), "retry_in", backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else {
+			backoff = minBackoff
+			wait = 0 // nothing left: sleep until the next Add
+		}
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer:
+		case <-s.wake:
+			if wait > 0 {
+				// Keep the backoff: a new result does not mean the server is back.
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+}
+
+// replay sends every pending entry in order, stopping at the first transport error
+func (s *Spool) replay(ctx context.Context) error {
+	for _, e := range s.snapshot() {
+		err := s.deliver(ctx, e)
+		switch {
+		case err == nil:
+			slog.Info("Reported task result", logging.ComponentKey, "SPOOL", "task_id", e.TaskID, "kind", e.Kind, "attempts", e.Attempts+1)
+			s.remove(e)
+		case api.IsRejected(err):
+			// The server refuses this outcome (task deleted, not ours, ...): it will
+			// never be accepted, keeping it would block the spool forever.
+			slog.Error("Dropping task result rejected by server", logging.ComponentKey, "SPOOL", "task_id", e.TaskID, "kind", e.Kind, "error", err)
+			s.remove(e)
+		default:
+			s.recordAttempt(e, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends one entry: final progress first, then the outcome
+func (s *Spool) deliver(ctx context.Context, e Entry) error {
+	if e.Progress > 0 {
+		if err := s.client.UpdateProgress(ctx, e.TaskID, e.Progress, e.Message); err != nil && !api.IsRejected(err) {
+			return err
+		}
+	}
+	if e.Kind == KindFail {
+		return s.client.FailTask(ctx, e.TaskID, e.Error, e.ExitCode)
+	}
+	return s.client.CompleteTask(ctx, e.TaskID, e.Result, e.ExitCode)
+}
+
+// snapshot returns the pending entries, oldest first
+func (s *Spool) snapshot() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out
+}
+
+// remove deletes a delivered entry unless it was replaced meanwhile by a newer one
+func (s *Spool) remove(e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cur, ok := s.entries[e.TaskID]; !ok || cur.Seq != e.Seq {
+		return
+	}
+	delete(s.entries, e.TaskID)
+	if err := os.Remove(s.path(e.TaskID)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove entry", logging.ComponentKey, "SPOOL", "task_id", e.TaskID, "error", err)
+	}
+}
+
+func (s *Spool) recordAttempt(e Entry, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, ok := s.entries[e.TaskID]
+	if !ok || cur.Seq != e.Seq {
+		return
+	}
+	cur.Attempts++
+	cur.LastError = err.Error()
+	if err := s.save(cur); err != nil {
+		slog.Error("Failed to persist entry", logging.ComponentKey, "SPOOL", "task_id", e.TaskID, "error", err)
+	}
+}
+
+// signal wakes the replay loop without blocking
+func (s *Spool) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Spool) path(taskID int) string {
+	return filepath.Join(s.dir, strconv.Itoa(taskID)+".json")
+}
+
+// save writes an entry atomically. Caller holds s.mu.
+func (s *Spool) save(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %w", err)
+	}
+	return fileutil.WriteAtomic(s.path(e.TaskID), data, 0600)
+}
@@ -0,0 +1,97 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/logging"
+)
+
+// Serve runs the read-only status API on a Unix socket until ctx is done. snapshot is
+// called for every request.
+func Serve(ctx context.Context, socketPath string, snapshot func() Snapshot) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// A socket left by a previous run would make Listen fail.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	// Owner and group only: the status exposes paths and task details.
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(snapshot()); err != nil {
+			slog.Warn("Failed to write response", logging.ComponentKey, "STATUS", "error", err)
+		}
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	slog.Info("Listening", logging.ComponentKey, "STATUS", "socket", socketPath)
+	err = server.Serve(listener)
+	os.Remove(socketPath)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Fetch reads the status from the agent listening on socketPath
+func Fetch(ctx context.Context, socketPath string) (*Snapshot, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://agent/status", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("agent not reachable on %s (not running, or no permission?): %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status API returned HTTP %d: %s", resp.StatusCode, body)
+	}
+
+	var s Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to parse status: %w", err)
+	}
+	return &s, nil
+}
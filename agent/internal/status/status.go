@@ -0,0 +1,165 @@
+// Package status exposes what the agent is doing to operators on the host: a
+// read-only HTTP API on a Unix socket, rendered by "phpborg-agent status".
+package status
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// Snapshot is the document served by the status API
+type Snapshot struct {
+	Version   string    `json:"version"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"started_at"`
+	Draining  bool      `json:"draining"`
+	Streaming bool      `json:"streaming"`
+	// API circuit breaker state (closed, open, half-open)
+	Breaker string `json:"breaker"`
+	// API endpoint and borg SSH host in use (see server.urls, borg_ssh.hosts)
+	Endpoint string `json:"api_endpoint"`
+	BorgHost string `json:"borg_host,omitempty"`
+
+	Running        []TaskStatus     `json:"running"`
+	QueuePending   int              `json:"queue_pending"`
+	SpoolPending   int              `json:"spool_pending"`
+	LastHeartbeat  *HeartbeatStatus `json:"last_heartbeat,omitempty"`
+	CertExpiresAt  *time.Time       `json:"cert_expires_at,omitempty"`
+	BorgMode       string           `json:"borg_mode,omitempty"`
+	BorgModeProbed *time.Time       `json:"borg_mode_probed_at,omitempty"`
+
+	// Heartbeat interval in use (configured, or asked by the server)
+	HeartbeatIntervalSeconds float64 `json:"heartbeat_interval_seconds"`
+	// Server clock minus agent clock, from the last heartbeat (absent = unknown)
+	ClockSkewSeconds *float64 `json:"clock_skew_seconds,omitempty"`
+
+	// Offline schedule (absent when disabled): last sync, whether the agent runs it
+	// itself (server unreachable) and the runs waiting to be uploaded
+	Offline *OfflineStatus `json:"offline,omitempty"`
+}
+
+// OfflineStatus is the state of the offline schedule
+type OfflineStatus struct {
+	SyncedAt    *time.Time `json:"synced_at,omitempty"`
+	Active      bool       `json:"active"`
+	RunsPending int        `json:"runs_pending"`
+}
+
+// TaskStatus is a running task as last seen by the agent
+type TaskStatus struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type"`
+	Priority  string    `json:"priority,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+
+	Progress int               `json:"progress"`
+	Phase    string            `json:"phase,omitempty"`
+	Info     *api.ProgressInfo `json:"info,omitempty"`
+	// Last progress report (zero if none yet)
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+
+	// External process currently run by the task (borg, or its sudo wrapper)
+	PID     int    `json:"pid,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+// HeartbeatStatus is the outcome of the last heartbeat
+type HeartbeatStatus struct {
+	At    time.Time `json:"at"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Tracker records the running tasks and the last heartbeat. It is fed by the worker
+// loop, the API client (progress) and the executor (processes).
+type Tracker struct {
+	mu        sync.Mutex
+	tasks     map[int]*TaskStatus
+	heartbeat *HeartbeatStatus
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{tasks: make(map[int]*TaskStatus)}
+}
+
+// TaskStarted records a task handed to a worker
+func (t *Tracker) TaskStarted(task api.Task) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tasks[task.ID] = &TaskStatus{ID: task.ID, Type: task.Type, Priority: task.Priority, StartedAt: time.Now().UTC()}
+}
+
+// TaskFinished forgets a task
+func (t *Tracker) TaskFinished(taskID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tasks, taskID)
+}
+
+// TaskProgress records a progress update (see api.Client.SetProgressObserver)
+func (t *Tracker) TaskProgress(taskID int, progress int, info api.ProgressInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ts, ok := t.tasks[taskID]
+	if !ok {
+		return
+	}
+	ts.Progress = progress
+	ts.UpdatedAt = time.Now().UTC()
+	if info.Phase != "" {
+		ts.Phase = info.Phase
+	}
+	// Keep the last detailed borg statistics when a plain message follows
+	if info.Phase != "" || info.FilesCount > 0 || ts.Info == nil {
+		ts.Info = &info
+	} else {
+		ts.Info.Message = info.Message
+	}
+}
+
+// TaskProcess records the process a task is running (pid 0 = none)
+func (t *Tracker) TaskProcess(taskID int, pid int, command string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ts, ok := t.tasks[taskID]; ok {
+		ts.PID, ts.Command = pid, command
+	}
+}
+
+// Heartbeat records the outcome of a heartbeat
+func (t *Tracker) Heartbeat(err error) {
+	hb := &HeartbeatStatus{At: time.Now().UTC(), OK: err == nil}
+	if err != nil {
+		hb.Error = err.Error()
+	}
+	t.mu.Lock()
+	t.heartbeat = hb
+	t.mu.Unlock()
+}
+
+// Fill copies the tracked state into s
+func (t *Tracker) Fill(s *Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.Running = make([]TaskStatus, 0, len(t.tasks))
+	for _, ts := range t.tasks {
+		c := *ts
+		if ts.Info != nil {
+			info := *ts.Info
+			c.Info = &info
+		}
+		s.Running = append(s.Running, c)
+	}
+	sort.Slice(s.Running, func(i, j int) bool { return s.Running[i].StartedAt.Before(s.Running[j].StartedAt) })
+
+	if t.heartbeat != nil {
+		hb := *t.heartbeat
+		s.LastHeartbeat = &hb
+	}
+}
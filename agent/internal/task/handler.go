@@ -6,7 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,6 +19,10 @@ import (
 	"github.com/phpborg/phpborg-agent/internal/api"
 	"github.com/phpborg/phpborg-agent/internal/config"
 	"github.com/phpborg/phpborg-agent/internal/executor"
+	"github.com/phpborg/phpborg-agent/internal/ledger"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/platform"
+	"github.com/phpborg/phpborg-agent/internal/spool"
 )
 
 // Note: executor package is imported above for BorgProgress type
@@ -28,10 +32,33 @@ type Handler struct {
 	config   *config.Config
 	client   *api.Client
 	executor *executor.Executor
-	// activeBackups counts backup_create tasks currently running (atomic). An
-	// agent_update is DEFERRED while any backup runs, so a self-update never kills a
+	// spool keeps outcomes the server could not be told about (API unreachable)
+	spool *spool.Spool
+	// ledger answers a re-delivered task with its stored outcome instead of running it
+	// again
+	ledger *ledger.Ledger
+	// updateBlockers counts running tasks whose type blocks self-update (atomic). An
+	// agent_update is DEFERRED while any of them runs, so a self-update never kills a
 	// backup mid-flight (Bug 27a).
-	activeBackups int32
+	updateBlockers int32
+
+	// cancels holds every running task, so a cancellation pushed by the server stops
+	// it without waiting for the next status poll.
+	cancelsMu sync.Mutex
+	cancels   map[int]runningTask
+
+	// gracePeriod returns the current shutdown grace period, which a SIGHUP reloads
+	// (nil = config.Agent.ShutdownGracePeriod)
+	gracePeriod func() time.Duration
+
+	// offlineRuns is the offline scheduler (nil when offline.enabled is off)
+	offlineRuns OfflineRuns
+}
+
+// runningTask is how a running task can be stopped
+type runningTask struct {
+	cancel      context.CancelFunc
+	cancellable bool
 }
 
 // stateDir holds one marker file per running task so orphans left by a brutal restart
@@ -43,7 +70,7 @@ func (h *Handler) stateDir() string {
 func (h *Handler) markTaskRunning(taskID int) {
 	dir := h.stateDir()
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Printf("[STATE] could not create state dir: %v", err)
+		slog.Error("Could not create state dir", logging.ComponentKey, "STATE", "error", err)
 		return
 	}
 	_ = os.WriteFile(filepath.Join(dir, strconv.Itoa(taskID)), []byte(time.Now().UTC().Format(time.RFC3339)), 0644)
@@ -71,44 +98,124 @@ func (h *Handler) ReconcileOrphanedTasks(ctx context.Context) {
 			_ = os.Remove(filepath.Join(dir, e.Name()))
 			continue
 		}
-		log.Printf("[STATE] reconciling orphaned task #%d (agent restarted while it was running)", taskID)
+		if h.spool.Has(taskID) {
+			// It finished; its real outcome is waiting in the spool.
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		slog.Info("Reconciling orphaned task (agent restarted while it was running)", logging.ComponentKey, "STATE", "task_id", taskID)
 		if err := h.client.FailTask(ctx, taskID, "agent restarted while task was running; backup interrupted (resumes from last borg checkpoint on retry)", 137); err != nil {
-			log.Printf("[STATE] could not report orphan #%d failed: %v (will retry next start)", taskID, err)
+			slog.Warn("Could not report orphaned task failed (will retry next start)", logging.ComponentKey, "STATE", "task_id", taskID, "error", err)
 			continue // keep the marker so we try again next start
 		}
 		_ = os.Remove(filepath.Join(dir, e.Name()))
 	}
 }
 
+// interruptedError is reported for a task the agent was running when it stopped
+const interruptedError = "agent restarted while task was running; task interrupted"
+
+// FailInterrupted reports the tasks the local queue had handed to a worker when the
+// agent stopped. A task with an outcome in the ledger gets it reported; the others are
+// reported failed, through the spool when the server is unreachable. Backups still
+// marked running are left to ReconcileOrphanedTasks: call this first.
+func (h *Handler) FailInterrupted(ctx context.Context, tasks []api.Task) {
+	for _, t := range tasks {
+		if _, err := os.Stat(filepath.Join(h.stateDir(), strconv.Itoa(t.ID))); err == nil {
+			continue
+		}
+		if h.spool.Has(t.ID) {
+			continue // it finished; its outcome is waiting in the spool
+		}
+		if rec, ok := h.ledger.Get(t.ID, t.Attempt); ok {
+			h.reportStored(ctx, rec)
+			continue
+		}
+		slog.Warn("Reporting a task interrupted by the agent stop as failed", logging.ComponentKey, "QUEUE", "task_id", t.ID, "type", t.Type)
+		h.record(ledger.Record{TaskID: t.ID, Attempt: t.Attempt, Type: t.Type, Kind: ledger.KindFail, Error: interruptedError, ExitCode: 137})
+		if err := h.client.FailTask(ctx, t.ID, interruptedError, 137); err != nil {
+			h.spoolResult(spool.Entry{TaskID: t.ID, Kind: spool.KindFail, Error: interruptedError, ExitCode: 137}, err)
+		}
+	}
+}
+
 // NewHandler creates a new task handler
-func NewHandler(cfg *config.Config, client *api.Client, exec *executor.Executor) *Handler {
+func NewHandler(cfg *config.Config, client *api.Client, exec *executor.Executor, resultSpool *spool.Spool, taskLedger *ledger.Ledger) *Handler {
 	return &Handler{
 		config:   cfg,
 		client:   client,
 		executor: exec,
+		spool:    resultSpool,
+		ledger:   taskLedger,
+		cancels:  make(map[int]runningTask),
 	}
 }
 
+// SetGracePeriod makes the handler read the shutdown grace period through fn, which
+// returns the reloaded value
+func (h *Handler) SetGracePeriod(fn func() time.Duration) {
+	h.gracePeriod = fn
+}
+
+// CancelTask cancels a running task. It reports false when the task is not running
+// on this agent. A task whose type is not cancellable keeps running.
+func (h *Handler) CancelTask(taskID int) bool {
+	h.cancelsMu.Lock()
+	rt, ok := h.cancels[taskID]
+	h.cancelsMu.Unlock()
+	if !ok {
+		return false
+	}
+	if !rt.cancellable {
+		slog.Info("Cancel ignored: task type cannot be cancelled", logging.ComponentKey, "TASK", "task_id", taskID)
+		return true
+	}
+	slog.Info("Task cancelled by server", logging.ComponentKey, "TASK", "task_id", taskID)
+	rt.cancel()
+	return true
+}
+
+func (h *Handler) trackCancel(taskID int, rt runningTask) {
+	h.cancelsMu.Lock()
+	h.cancels[taskID] = rt
+	h.cancelsMu.Unlock()
+}
+
+func (h *Handler) untrackCancel(taskID int) {
+	h.cancelsMu.Lock()
+	delete(h.cancels, taskID)
+	h.cancelsMu.Unlock()
+}
+
 // ProcessTask handles a single task
 func (h *Handler) ProcessTask(ctx context.Context, task api.Task) error {
-	log.Printf("[TASK] Processing task %d: type=%s priority=%s", task.ID, task.Type, task.Priority)
+	logger := logging.Component(ctx, "TASK")
+	logger.Info("Processing task", "priority", task.Priority)
 
-	// Mark task as started
-	if err := h.client.StartTask(ctx, task.ID); err != nil {
+	// A re-delivery of an attempt that already ran gets its stored outcome: the same
+	// backup must not run twice
+	if rec, ok := h.ledger.Get(task.ID, task.Attempt); ok {
+		logger.Info("Task already executed, reporting the stored outcome", "attempt", task.Attempt, "outcome", rec.Kind, "finished_at", rec.FinishedAt)
+		h.reportStored(context.WithoutCancel(ctx), rec)
+		return nil
+	}
+
+	// Mark task as started, claiming it with a lease renewed while it runs
+	lease, err := h.client.StartTask(ctx, task.ID, taskLease)
+	if err != nil {
 		return fmt.Errorf("failed to start task: %w", err)
 	}
 
-	// Create task context with timeout.
-	// Bug 23: backups of multi-TB / millions-of-small-files repos legitimately run for
-	// many hours. They must NOT inherit the generic 1h fallback (which killed borg mid
-	// archive). When no explicit timeout is set for a backup task, run without a cap
-	// (bounded only by the parent context / the borg process itself).
-	timeout := time.Duration(task.TimeoutSeconds) * time.Second
-	isBackup := task.Type == "backup_create" || task.Type == "backup_restore"
-	if timeout <= 0 && !isBackup {
-		timeout = 1 * time.Hour
+	// Unknown types still get a context and a log, so the failure reaches the UI
+	taskType := lookup(task.Type)
+	if taskType == nil {
+		taskType = &TaskType{Name: task.Type}
 	}
 
+	// Create task context with the timeout of the task type (0 = no cap, bounded only
+	// by the parent context / the borg process itself)
+	timeout := taskType.timeout(task)
+
 	var taskCtx context.Context
 	var cancel context.CancelFunc
 	if timeout > 0 {
@@ -118,48 +225,78 @@ func (h *Handler) ProcessTask(ctx context.Context, task api.Task) error {
 		taskCtx, cancel = context.WithCancel(ctx)
 	}
 	defer cancel()
+	h.trackCancel(task.ID, runningTask{cancel: cancel, cancellable: taskType.Cancellable})
+	defer h.untrackCancel(task.ID)
+
+	// Live log for the UI. Closed (flushed) before the outcome is reported, so the
+	// server has the whole log when the task ends.
+	tl := h.client.OpenTaskLog(task.ID)
+	defer tl.Close()
+	taskCtx = withTaskLog(taskCtx, tl)
+	tl.Logf(api.TaskLogInfo, "Task started on agent %s (type %s)", h.config.Agent.Name, task.Type)
+	if lease != nil {
+		go h.keepLease(taskCtx, task.ID, lease, cancel)
+	}
 
 	// Execute task based on type
 	var result map[string]interface{}
 	var taskErr error
 	var exitCode int
 
-	switch task.Type {
-	case "backup_create":
-		result, exitCode, taskErr = h.handleBackupCreate(taskCtx, task)
-	case "backup_restore":
-		result, exitCode, taskErr = h.handleBackupRestore(taskCtx, task)
-	case "capabilities_detect":
-		result, exitCode, taskErr = h.handleCapabilitiesDetect(taskCtx, task)
-	case "stats_collect":
-		result, exitCode, taskErr = h.handleStatsCollect(taskCtx, task)
-	case "agent_update":
-		result, exitCode, taskErr = h.handleAgentUpdate(taskCtx, task)
-	case "test":
-		result, exitCode, taskErr = h.handleTest(taskCtx, task)
-	default:
+	switch {
+	case taskType.Handle == nil:
 		taskErr = fmt.Errorf("unknown task type: %s", task.Type)
 		exitCode = 1
+	case taskType.BlocksUpdate:
+		atomic.AddInt32(&h.updateBlockers, 1)
+		result, exitCode, taskErr = taskType.Handle(h, taskCtx, task)
+		atomic.AddInt32(&h.updateBlockers, -1)
+	default:
+		result, exitCode, taskErr = taskType.Handle(h, taskCtx, task)
 	}
 
-	// Report result
+	// Report result. The outcome is reported even if the agent is shutting down (ctx
+	// cancelled); if the server cannot be reached it goes to the spool and is replayed
+	// once the API is back.
+	reportCtx := context.WithoutCancel(ctx)
 	if taskErr != nil {
-		log.Printf("[TASK] Task %d failed: %v", task.ID, taskErr)
-		if err := h.client.FailTask(ctx, task.ID, taskErr.Error(), exitCode); err != nil {
-			log.Printf("[TASK] Failed to report failure: %v", err)
+		tl.Logf(api.TaskLogError, "Task failed (exit %d): %v", exitCode, taskErr)
+		tl.Close()
+		logger.Warn("Task failed", "exit_code", exitCode, "error", taskErr)
+		h.record(ledger.Record{TaskID: task.ID, Attempt: task.Attempt, Type: task.Type, Kind: ledger.KindFail, Error: taskErr.Error(), ExitCode: exitCode})
+		if err := h.client.FailTask(reportCtx, task.ID, taskErr.Error(), exitCode); err != nil {
+			logger.Error("Failed to report failure", "error", err)
+			h.spoolResult(spool.Entry{TaskID: task.ID, Kind: spool.KindFail, Error: taskErr.Error(), ExitCode: exitCode}, err)
 		}
 		return taskErr
 	}
 
-	log.Printf("[TASK] Task %d completed successfully", task.ID)
-	if err := h.client.CompleteTask(ctx, task.ID, result, exitCode); err != nil {
-		log.Printf("[TASK] Failed to report completion: %v", err)
-		return err
+	logger.Info("Task completed successfully")
+	tl.Logf(api.TaskLogInfo, "Task completed")
+	tl.Close()
+	message, _ := result["message"].(string)
+	h.record(ledger.Record{TaskID: task.ID, Attempt: task.Attempt, Type: task.Type, Kind: ledger.KindComplete, Result: result, ExitCode: exitCode, Message: message})
+	if err := h.client.CompleteTask(reportCtx, task.ID, result, exitCode); err != nil {
+		logger.Error("Failed to report completion", "error", err)
+		h.spoolResult(spool.Entry{TaskID: task.ID, Kind: spool.KindComplete, Result: result, ExitCode: exitCode, Progress: 100, Message: message}, err)
 	}
 
 	return nil
 }
 
+// spoolResult keeps an outcome the server could not be told about. A rejection by the
+// server (HTTP 4xx) is final and not spooled.
+func (h *Handler) spoolResult(e spool.Entry, reportErr error) {
+	if api.IsRejected(reportErr) {
+		return
+	}
+	if err := h.spool.Add(e); err != nil {
+		slog.Error("Task outcome could not be spooled", logging.ComponentKey, "TASK", "task_id", e.TaskID, "error", err)
+		return
+	}
+	slog.Info("Task outcome spooled, it will be reported when the server is reachable", logging.ComponentKey, "TASK", "task_id", e.TaskID)
+}
+
 // tailString returns at most the last n bytes of s, marking truncation. Bug 24: borg's
 // --progress/--log-json stream over 800k+ files is multiple MB and overflowed the
 // persisted job output. We keep the final --json stats (stdout, small) and only a tail
@@ -194,52 +331,85 @@ func isTransientConnError(stderr string) bool {
 	return false
 }
 
-// handleBackupCreate handles a backup creation task
+// handleBackupCreate handles a backup creation task: borg create between the pre and
+// post hooks, or followed by the on_failure hooks when it fails
 func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[string]interface{}, int, error) {
-	// Extract parameters from payload
-	repoPath, _ := task.Payload["repo_path"].(string)
-	archiveName, _ := task.Payload["archive_name"].(string)
-	passphrase, _ := task.Payload["passphrase"].(string)
-
-	pathsRaw, _ := task.Payload["paths"].([]interface{})
-	paths := make([]string, len(pathsRaw))
-	for i, p := range pathsRaw {
-		paths[i], _ = p.(string)
+	var p BackupCreatePayload
+	if err := decodePayload(task, &p); err != nil {
+		return nil, err.ExitCode, err
+	}
+	// Queued by the server for a window the agent already backed up on its own
+	if ranAt, ok := h.ranOffline(task, &p); ok {
+		message := fmt.Sprintf("backup job #%d already ran offline at %s in this schedule window", *p.BackupJobID, ranAt.Format(time.RFC3339))
+		taskLog(ctx).Logf(api.TaskLogInfo, "Skipped: %s", message)
+		return map[string]interface{}{
+			"superseded_by_offline_run": true,
+			"offline_run_started_at":    ranAt.Format(time.RFC3339),
+			"message":                   message,
+		}, 0, nil
 	}
+	hooks := h.newHookRunner(task, &p)
 
-	excludesRaw, _ := task.Payload["excludes"].([]interface{})
-	excludes := make([]string, len(excludesRaw))
-	for i, e := range excludesRaw {
-		excludes[i], _ = e.(string)
+	// on_failure hooks run even when the task was cancelled or timed out: they resume
+	// what the pre hooks paused
+	failed := func(exitCode int, err error) (map[string]interface{}, int, error) {
+		_ = hooks.run(context.WithoutCancel(ctx), HookOnFailure, "failed", err)
+		return nil, exitCode, fmt.Errorf("%w%s", err, hooks.summary())
 	}
 
-	compression, _ := task.Payload["compression"].(string)
+	if err := hooks.run(ctx, HookPre, "", nil); err != nil {
+		return failed(1, err)
+	}
 
-	// Bug 17: optional --one-file-system (JSON booleans decode to bool)
-	oneFileSystem, _ := task.Payload["one_file_system"].(bool)
+	res, exitCode, err := h.runBackupCreate(ctx, task, &p)
+	if err != nil {
+		return failed(exitCode, err)
+	}
 
-	// Bug 21: allow access to an unencrypted repository (empty passphrase). Explicit
-	// payload flag wins; otherwise inferred from an empty passphrase below.
-	allowUnencrypted, _ := task.Payload["allow_unencrypted"].(bool)
+	status := "success"
+	if hasWarnings, _ := res["has_warnings"].(bool); hasWarnings {
+		status = "warning"
+	}
+	if err := hooks.run(ctx, HookPost, status, nil); err != nil {
+		// The archive is committed and verified: the backup succeeded, flagged with a
+		// warning since it is not done as asked. on_failure hooks do not run.
+		res["has_warnings"] = true
+		res["post_hook_failed"] = true
+		if _, ok := res["message"]; !ok {
+			res["message"] = fmt.Sprintf("Archive %s committed, but %v", p.ArchiveName, err)
+		}
+	}
 
-	if repoPath == "" || archiveName == "" || len(paths) == 0 {
-		return nil, 1, fmt.Errorf("missing required parameters: repo_path, archive_name, paths")
+	if len(hooks.results) > 0 {
+		res["hooks"] = hooks.results
 	}
+	if hooks.warnings > 0 {
+		res["hook_warnings"] = hooks.warnings
+	}
+	return res, exitCode, nil
+}
+
+// runBackupCreate runs borg create and verifies the archive was committed
+func (h *Handler) runBackupCreate(ctx context.Context, task api.Task, p *BackupCreatePayload) (map[string]interface{}, int, error) {
+	logger := logging.Component(ctx, "BACKUP")
+	tl := taskLog(ctx)
+
+	repoPath, archiveName, passphrase := p.RepoPath, p.ArchiveName, p.Passphrase
+
+	// A backup of the offline schedule has no server task: no progress is sent and no
+	// cancellation polled
+	offline := isOfflineRun(ctx)
 
-	// Bug 27a: this backup is active — an agent_update will be deferred while it runs.
-	atomic.AddInt32(&h.activeBackups, 1)
-	defer atomic.AddInt32(&h.activeBackups, -1)
 	// Bug 27c: persist a marker so an orphan left by a brutal restart is reconciled.
-	h.markTaskRunning(task.ID)
-	defer h.clearTaskRunning(task.ID)
+	if !offline {
+		h.markTaskRunning(task.ID)
+		defer h.clearTaskRunning(task.ID)
+	}
 
 	// Bug 33: the expected total size (osize of the LAST archive of this repo, provided
 	// by the server) lets us compute a REAL percentage from borg's archive_progress
 	// instead of a hardcoded 10%.
-	expectedOsize := int64(0)
-	if v, ok := task.Payload["expected_osize"].(float64); ok {
-		expectedOsize = int64(v)
-	}
+	expectedOsize := p.ExpectedOsize
 
 	// Shared live-progress state (Bug 33): the phase is EXPLICIT and the keepalive
 	// re-sends the last RICH info instead of a generic message that used to wipe the
@@ -251,6 +421,9 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 		Message: "Initializing: repository lock & chunk cache sync...",
 	}
 	sendProgress := func() {
+		if offline {
+			return
+		}
 		progressMu.Lock()
 		pct, info := lastPct, lastInfo
 		progressMu.Unlock()
@@ -289,6 +462,9 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 
 	// Start goroutine to check for cancellation every 5 seconds
 	go func() {
+		if offline {
+			return
+		}
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
 
@@ -300,11 +476,12 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 				// Check if task has been cancelled
 				status, err := h.client.GetTaskStatus(ctx, task.ID)
 				if err != nil {
-					log.Printf("[BACKUP] Failed to check task status: %v", err)
+					logger.Warn("Failed to check task status", "error", err)
 					continue
 				}
 				if status.ShouldCancel {
-					log.Printf("[BACKUP] Task %d cancelled by user, stopping backup...", task.ID)
+					logger.Info("Task cancelled by user, stopping backup...")
+					tl.Logf(api.TaskLogWarning, "Cancelled by user, stopping borg")
 					cancelled = true
 					cancelBackup()
 					return
@@ -318,6 +495,11 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 
 	// Create progress callback for real-time updates
 	progressCallback := func(progress executor.BorgProgress) {
+		if progress.Type != executor.BorgEventProgress {
+			shipBorgLog(tl, progress)
+			return
+		}
+
 		// Throttle updates to max 1 per second
 		if time.Since(lastUpdate) < time.Second {
 			return
@@ -361,8 +543,11 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 		lastPct, lastInfo = progressPercent, info
 		progressMu.Unlock()
 
+		if offline {
+			return
+		}
 		if err := h.client.UpdateProgressWithInfo(ctx, task.ID, progressPercent, info); err != nil {
-			log.Printf("[BACKUP] Failed to send progress update: %v", err)
+			logger.Debug("Failed to send progress update", "error", err)
 		}
 	}
 
@@ -373,7 +558,7 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 	const maxBorgAttempts = 6
 	var result *executor.CommandResult
 	for attempt := 1; attempt <= maxBorgAttempts; attempt++ {
-		result = h.executor.BorgCreateWithProgress(backupCtx, repoPath, archiveName, paths, excludes, compression, passphrase, oneFileSystem, allowUnencrypted, progressCallback)
+		result = h.executor.BorgCreateWithProgress(backupCtx, repoPath, archiveName, p.Paths, p.Excludes, p.Compression, passphrase, p.OneFileSystem, p.AllowUnencrypted, progressCallback)
 
 		// Stop immediately on cancel/timeout or a committed result (exit 0/1).
 		if backupCtx.Err() != nil || cancelled {
@@ -385,8 +570,11 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 		// Retry only on a transient connection failure, with capped backoff.
 		if attempt < maxBorgAttempts && isTransientConnError(result.Stderr) {
 			backoff := time.Duration(attempt*30) * time.Second // 30s,60s,90s,...
-			log.Printf("[BACKUP] transient connection failure (attempt %d/%d), resuming in %v", attempt, maxBorgAttempts, backoff)
-			h.client.UpdateProgress(ctx, task.ID, 10, fmt.Sprintf("Connection lost — resuming from last checkpoint in %ds (attempt %d/%d)...", int(backoff.Seconds()), attempt+1, maxBorgAttempts))
+			logger.Warn("Transient connection failure, resuming from the last checkpoint", "attempt", attempt, "max_attempts", maxBorgAttempts, "backoff", backoff)
+			tl.Logf(api.TaskLogWarning, "Connection lost (borg exit %d), resuming from the last checkpoint in %v (attempt %d/%d)", result.ExitCode, backoff, attempt+1, maxBorgAttempts)
+			if !offline {
+				h.client.UpdateProgress(ctx, task.ID, 10, fmt.Sprintf("Connection lost — resuming from last checkpoint in %ds (attempt %d/%d)...", int(backoff.Seconds()), attempt+1, maxBorgAttempts))
+			}
 			select {
 			case <-time.After(backoff):
 			case <-backupCtx.Done():
@@ -395,6 +583,9 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 		}
 		break // non-transient error: fall through to the status logic below
 	}
+	mode, _ := h.executor.BorgMode()
+	tl.Logf(api.TaskLogInfo, "borg create finished: exit %d after %v (launch mode %s, ran_as_root=%v)",
+		result.ExitCode, result.Duration.Round(time.Second), mode, result.RanAsRoot)
 
 	// === Bug 23: derive the status from the REAL outcome ===================
 	// A "success" MUST NEVER be reported unless borg exited cleanly and therefore
@@ -442,8 +633,9 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 	lastInfo.Message = "Verifying the archive was committed..."
 	progressMu.Unlock()
 	sendProgress()
-	exists, vres := h.executor.BorgArchiveExists(ctx, repoPath, archiveName, passphrase, allowUnencrypted)
+	exists, vres := h.executor.BorgArchiveExists(ctx, repoPath, archiveName, passphrase, p.AllowUnencrypted)
 	if !exists {
+		tl.Logf(api.TaskLogError, "Verification failed: archive %q is not in the repository", archiveName)
 		return nil, 2, fmt.Errorf(
 			"borg exited %d but archive %q is NOT present in the repository — the backup did NOT complete "+
 				"(launcher or borg failed; ran_as_root=%v). borg stderr: %s | verification stderr: %s",
@@ -463,7 +655,13 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 	benignSkips := strings.Count(result.Stderr, "vanished") +
 		strings.Count(result.Stderr, "changed while we backed it up")
 
+	tl.Logf(api.TaskLogInfo, "Verified: archive %q is in the repository", archiveName)
+	if permDenied > 0 {
+		tl.Logf(api.TaskLogWarning, "%d file(s) skipped with 'Permission denied': the archive is incomplete", permDenied)
+	}
+
 	switch {
+	case offline:
 	case permDenied > 0:
 		h.client.UpdateProgress(ctx, task.ID, 95, fmt.Sprintf(
 			"WARNING: backup INCOMPLETE — %d file(s) UNREADABLE (permission denied). Root-only files (secrets, keys) are missing from this archive.",
@@ -478,16 +676,18 @@ func (h *Handler) handleBackupCreate(ctx context.Context, task api.Task) (map[st
 		h.client.UpdateProgress(ctx, task.ID, 95, "Backup completed successfully")
 	}
 
+	recordBackupMetrics(repoPath, result.Stdout, permDenied)
+
 	res := map[string]interface{}{
-		"stdout":                     result.Stdout,                    // final borg --json stats (kept in full)
-		"stderr":                     tailString(result.Stderr, 16384), // Bug 24: only a tail of the progress stream
-		"duration":                   result.Duration.String(),
-		"has_warnings":               hasWarnings,
-		"exit_code":                  result.ExitCode,
-		"ran_as_root":                result.RanAsRoot,   // Bug 31: false => root-only files were skipped
-		"archive_verified":           true,               // Bug 32: proof-of-archive check passed (borg list)
-		"skipped_permission_denied":  permDenied,         // GRAVE: unreadable => incomplete backup
-		"skipped_benign":             benignSkips,        // benign: changed/vanished on a live system
+		"stdout":                    result.Stdout,                    // final borg --json stats (kept in full)
+		"stderr":                    tailString(result.Stderr, 16384), // Bug 24: only a tail of the progress stream
+		"duration":                  result.Duration.String(),
+		"has_warnings":              hasWarnings,
+		"exit_code":                 result.ExitCode,
+		"ran_as_root":               result.RanAsRoot, // Bug 31: false => root-only files were skipped
+		"archive_verified":          true,             // Bug 32: proof-of-archive check passed (borg list)
+		"skipped_permission_denied": permDenied,       // GRAVE: unreadable => incomplete backup
+		"skipped_benign":            benignSkips,      // benign: changed/vanished on a live system
 	}
 	if permDenied > 0 {
 		res["message"] = fmt.Sprintf(
@@ -518,27 +718,19 @@ func formatBytes(bytes int64) string {
 
 // handleBackupRestore handles a backup restoration task
 func (h *Handler) handleBackupRestore(ctx context.Context, task api.Task) (map[string]interface{}, int, error) {
-	repoPath, _ := task.Payload["repo_path"].(string)
-	archiveName, _ := task.Payload["archive_name"].(string)
-	destPath, _ := task.Payload["dest_path"].(string)
-
-	patternsRaw, _ := task.Payload["patterns"].([]interface{})
-	patterns := make([]string, len(patternsRaw))
-	for i, p := range patternsRaw {
-		patterns[i], _ = p.(string)
-	}
-
-	if repoPath == "" || archiveName == "" {
-		return nil, 1, fmt.Errorf("missing required parameters: repo_path, archive_name")
+	var p BackupRestorePayload
+	if err := decodePayload(task, &p); err != nil {
+		return nil, err.ExitCode, err
 	}
 
+	destPath := p.DestPath
 	if destPath == "" {
 		destPath = "/var/restore"
 	}
 
 	h.client.UpdateProgress(ctx, task.ID, 10, "Starting restore...")
 
-	result := h.executor.BorgExtract(ctx, repoPath, archiveName, destPath, patterns)
+	result := h.executor.BorgExtract(ctx, p.RepoPath, p.ArchiveName, destPath, p.Patterns)
 
 	if result.ExitCode != 0 {
 		return nil, result.ExitCode, fmt.Errorf("borg extract failed: %s", result.Stderr)
@@ -556,6 +748,9 @@ func (h *Handler) handleBackupRestore(ctx context.Context, task api.Task) (map[s
 
 // handleCapabilitiesDetect detects system capabilities
 func (h *Handler) handleCapabilitiesDetect(ctx context.Context, task api.Task) (map[string]interface{}, int, error) {
+	if err := decodePayload(task, &ServerPayload{}); err != nil {
+		return nil, err.ExitCode, err
+	}
 	h.client.UpdateProgress(ctx, task.ID, 50, "Detecting capabilities...")
 
 	caps := h.executor.DetectCapabilities(ctx)
@@ -569,7 +764,10 @@ func (h *Handler) handleCapabilitiesDetect(ctx context.Context, task api.Task) (
 
 // handleStatsCollect handles a stats collection task
 func (h *Handler) handleStatsCollect(ctx context.Context, task api.Task) (map[string]interface{}, int, error) {
-	log.Printf("[STATS] Collecting system stats...")
+	if err := decodePayload(task, &ServerPayload{}); err != nil {
+		return nil, err.ExitCode, err
+	}
+	slog.Debug("Collecting system stats", logging.ComponentKey, "STATS")
 	h.client.UpdateProgress(ctx, task.ID, 10, "Collecting system information...")
 
 	stats := make(map[string]interface{})
@@ -731,7 +929,7 @@ func (h *Handler) handleStatsCollect(ctx context.Context, task api.Task) (map[st
 	}
 
 	h.client.UpdateProgress(ctx, task.ID, 100, "Stats collection completed")
-	log.Printf("[STATS] Stats collection completed: %d metrics", len(stats))
+	slog.Debug("Stats collection completed", logging.ComponentKey, "STATS", "metrics", len(stats))
 
 	return stats, 0, nil
 }
@@ -761,7 +959,11 @@ func formatUptime(seconds int) string {
 
 // handleTest handles a test task (for debugging)
 func (h *Handler) handleTest(ctx context.Context, task api.Task) (map[string]interface{}, int, error) {
-	message, _ := task.Payload["message"].(string)
+	var p TestPayload
+	if err := decodePayload(task, &p); err != nil {
+		return nil, err.ExitCode, err
+	}
+	message := p.Message
 	if message == "" {
 		message = "Test task executed successfully"
 	}
@@ -790,22 +992,20 @@ func (h *Handler) handleAgentUpdate(ctx context.Context, task api.Task) (map[str
 	// Bug 27a: NEVER self-update while a backup is running — the restart would kill borg
 	// mid-archive (this is exactly what killed backup #89 at ~457 GB). Defer: report the
 	// update as deferred; the server re-offers it and it applies once the backup is done.
-	if atomic.LoadInt32(&h.activeBackups) > 0 {
-		log.Printf("[UPDATE] deferred: a backup is running (won't restart the agent mid-backup)")
+	// Every task type declared BlocksUpdate counts (backups and restores).
+	if atomic.LoadInt32(&h.updateBlockers) > 0 {
+		slog.Info("Update deferred: a backup or restore is running (won't restart the agent mid-task)", logging.ComponentKey, "UPDATE")
 		return map[string]interface{}{
 			"status":  "deferred",
-			"message": "Agent update deferred: a backup is currently running. It will apply after the backup completes.",
+			"message": "Agent update deferred: a backup or restore is currently running. It will apply after it completes.",
 		}, 0, nil
 	}
 
-	// Extract parameters
-	expectedChecksum, _ := task.Payload["checksum"].(string)
-	newVersion, _ := task.Payload["version"].(string)
-	forceUpdate, _ := task.Payload["force"].(bool)
-
-	if expectedChecksum == "" && !forceUpdate {
-		return nil, 1, fmt.Errorf("checksum required for update (or set force=true)")
+	var p AgentUpdatePayload
+	if err := decodePayload(task, &p); err != nil {
+		return nil, err.ExitCode, err
 	}
+	expectedChecksum, newVersion, forceUpdate := p.Checksum, p.Version, p.Force
 
 	// Guard 3 (idempotence) — THE fix for the restart loop that killed backup #89:
 	// if the RUNNING binary is already the target version, do NOTHING. No download, no
@@ -813,7 +1013,7 @@ func (h *Handler) handleAgentUpdate(ctx context.Context, task api.Task) (map[str
 	// agent must never happen, even if a previous update's unit/sudoers write failed
 	// (read-only /etc) and the server keeps re-offering the same version.
 	if !forceUpdate && newVersion != "" && newVersion == h.config.Agent.Version {
-		log.Printf("[UPDATE] already running target version %s — no action, no restart", newVersion)
+		slog.Info("Already running the target version, no action, no restart", logging.ComponentKey, "UPDATE", "version", newVersion)
 		return map[string]interface{}{
 			"status":       "up_to_date",
 			"new_version":  newVersion,
@@ -906,11 +1106,11 @@ func (h *Handler) handleAgentUpdate(ctx context.Context, task api.Task) (map[str
 
 	// Set ownership to match old binary (agent user)
 	if err := os.Chmod(currentBinary, 0755); err != nil {
-		log.Printf("[UPDATE] Warning: failed to set permissions: %v", err)
+		slog.Warn("Failed to set permissions", logging.ComponentKey, "UPDATE", "error", err)
 	}
 
-	os.Remove(tmpFile)    // Clean up temp file
-	os.Remove(oldBinary)  // Clean up old binary
+	os.Remove(tmpFile)   // Clean up temp file
+	os.Remove(oldBinary) // Clean up old binary
 
 	h.client.UpdateProgress(ctx, task.ID, 85, "Updating system configuration...")
 
@@ -937,7 +1137,7 @@ func (h *Handler) handleAgentUpdate(ctx context.Context, task api.Task) (map[str
 		if err := exec.Command("sudo", "systemctl", "restart", "phpborg-agent").Run(); err == nil {
 			return
 		}
-		log.Printf("[UPDATE] restarting via systemd (Restart=always) to load the new binary...")
+		slog.Info("Restarting via systemd (Restart=always) to load the new binary", logging.ComponentKey, "UPDATE")
 		os.Exit(0)
 	}()
 
@@ -964,7 +1164,7 @@ func (h *Handler) handleAgentUpdate(ctx context.Context, task api.Task) (map[str
 				"Agent updated to %s. Unit/sudoers refresh deferred (read-only /etc) — redeploy once to apply.",
 				newVersion,
 			)
-			log.Printf("[UPDATE] unit/sudoers refresh deferred: read-only /etc (redeploy the agent once to apply)")
+			slog.Warn("Unit/sudoers refresh deferred: read-only /etc (redeploy the agent once to apply)", logging.ComponentKey, "UPDATE")
 			return result, 0, nil
 		}
 
@@ -1028,41 +1228,23 @@ func copyFile(src, dst string) error {
 	return os.Chmod(dst, sourceInfo.Mode())
 }
 
-// desiredSystemdUnit is the canonical agent unit. It MUST stay in sync with the
-// installer (AgentInstallService::generateInstallScript). It includes ReadWritePaths
-// for the agent's own unit file and sudoers file so that self-update can rewrite them
-// even under ProtectSystem=strict (Bug 22).
-const desiredSystemdUnit = `[Unit]
-Description=phpBorg Agent
-Documentation=https://github.com/altzone/phpBorg
-After=network.target
-
-[Service]
-Type=simple
-User=phpborg-agent
-Group=phpborg-agent
-ExecStart=/var/lib/phpborg-agent/bin/phpborg-agent -config /etc/phpborg-agent/config.yaml
-Restart=always
-RestartSec=10
-
-# Security hardening.
-# NoNewPrivileges MUST be "no": the agent runs borg create as root via sudo (Bug 31)
-# and NNP=yes forbids any privilege elevation — with it, sudo fails with
-# 'The "no new privileges" flag is set' and no backup can read root-only files.
-# ProtectSystem=strict stays: borg only READS sources (read-only fs is fine) and
-# writes its cache under /var/lib/phpborg-agent (ReadWritePaths below).
-NoNewPrivileges=no
-ProtectSystem=strict
-ProtectHome=read-only
-PrivateTmp=yes
-ReadWritePaths=/var/log/phpborg-agent
-ReadWritePaths=/var/lib/phpborg-agent
-ReadWritePaths=/etc/systemd/system/phpborg-agent.service
-ReadWritePaths=/etc/sudoers.d/phpborg-agent
-
-[Install]
-WantedBy=multi-user.target
-`
+// desiredSystemdUnit is the canonical agent unit, rendered from the template shared
+// with the installer (platform.SystemdUnit). Its ReadWritePaths cover the agent's own
+// unit file and sudoers file so that self-update can rewrite them even under
+// ProtectSystem=strict (Bug 22).
+func (h *Handler) desiredSystemdUnit() string {
+	return platform.SystemdUnit("phpborg-agent",
+		"/var/lib/phpborg-agent/bin/phpborg-agent -config /etc/phpborg-agent/config.yaml",
+		h.shutdownGracePeriod())
+}
+
+// shutdownGracePeriod returns the current agent.shutdown_grace_period
+func (h *Handler) shutdownGracePeriod() time.Duration {
+	if h.gracePeriod != nil {
+		return h.gracePeriod()
+	}
+	return h.config.Agent.ShutdownGracePeriod
+}
 
 // isReadOnlyErr reports whether a write failed because the filesystem is read-only —
 // the expected case for an agent deployed before ReadWritePaths was added to its unit
@@ -1078,26 +1260,27 @@ func isReadOnlyErr(err error) bool {
 func (h *Handler) updateSystemdService() (bool, error) {
 	servicePath := "/etc/systemd/system/phpborg-agent.service"
 
+	desired := h.desiredSystemdUnit()
 	current, _ := os.ReadFile(servicePath)
-	if string(current) == desiredSystemdUnit {
-		log.Println("[UPDATE] systemd unit already up to date, skipping")
+	if string(current) == desired {
+		slog.Debug("Systemd unit already up to date, skipping", logging.ComponentKey, "UPDATE")
 		return false, nil
 	}
 
-	if err := os.WriteFile(servicePath, []byte(desiredSystemdUnit), 0644); err != nil {
+	if err := os.WriteFile(servicePath, []byte(desired), 0644); err != nil {
 		// Read-only /etc is expected on older-deployed agents; handled calmly by the
 		// caller (deferred, not a per-update alarm). Only log unexpected failures here.
 		if !isReadOnlyErr(err) {
-			log.Printf("[UPDATE] failed to update systemd unit: %v", err)
+			slog.Warn("Failed to update systemd unit", logging.ComponentKey, "UPDATE", "error", err)
 		}
 		return true, fmt.Errorf("systemd unit not writable: %w", err)
 	}
 
 	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
 		// Non-fatal: the unit file was written; a reload will happen on the next boot.
-		log.Printf("[UPDATE] warning: daemon-reload failed: %v", err)
+		slog.Warn("daemon-reload failed", logging.ComponentKey, "UPDATE", "error", err)
 	}
-	log.Println("[UPDATE] systemd unit updated")
+	slog.Info("Systemd unit updated", logging.ComponentKey, "UPDATE")
 	return true, nil
 }
 
@@ -1176,16 +1359,16 @@ func (h *Handler) updateSudoersFile() (bool, error) {
 
 	current, _ := os.ReadFile(sudoersPath)
 	if string(current) == desiredSudoers {
-		log.Println("[UPDATE] sudoers already up to date, skipping")
+		slog.Debug("Sudoers already up to date, skipping", logging.ComponentKey, "UPDATE")
 		return false, nil
 	}
 
 	if err := os.WriteFile(sudoersPath, []byte(desiredSudoers), 0440); err != nil {
 		if !isReadOnlyErr(err) {
-			log.Printf("[UPDATE] failed to update sudoers: %v", err)
+			slog.Warn("Failed to update sudoers", logging.ComponentKey, "UPDATE", "error", err)
 		}
 		return true, fmt.Errorf("sudoers not writable: %w", err)
 	}
-	log.Println("[UPDATE] sudoers updated")
+	slog.Info("Sudoers updated", logging.ComponentKey, "UPDATE")
 	return true, nil
 }
@@ -0,0 +1,192 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// hookOutputTail bounds the output of each hook kept in the task result
+const hookOutputTail = 4096
+
+// HookResult is the outcome of a hook, reported in the task result
+type HookResult struct {
+	Name     string `json:"name"`
+	Stage    string `json:"stage"`
+	ExitCode int    `json:"exit_code"`
+	Duration string `json:"duration"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Policy applied when it failed (abort, warn, continue)
+	OnError string `json:"on_error,omitempty"`
+}
+
+// hookRunner runs the hooks of one backup_create task and collects their results
+type hookRunner struct {
+	h       *Handler
+	task    api.Task
+	payload *BackupCreatePayload
+
+	results  []HookResult
+	warnings int
+}
+
+func (h *Handler) newHookRunner(task api.Task, p *BackupCreatePayload) *hookRunner {
+	return &hookRunner{h: h, task: task, payload: p}
+}
+
+// run runs the hooks of a stage in order. It returns an error when a hook failed under
+// the abort policy; the remaining hooks of the stage are then skipped. status and
+// backupErr describe the backup to post and on_failure hooks.
+func (r *hookRunner) run(ctx context.Context, stage, status string, backupErr error) error {
+	tl := taskLog(ctx)
+	for _, hook := range r.payload.Hooks {
+		if hook.Stage != stage {
+			continue
+		}
+		res := r.runOne(ctx, hook, status, backupErr)
+		if res.Error == "" {
+			r.results = append(r.results, res)
+			tl.Logf(api.TaskLogInfo, "Hook %s (%s) succeeded in %s", hook.Name, stage, res.Duration)
+			continue
+		}
+
+		res.OnError = hook.policy()
+		r.results = append(r.results, res)
+		switch res.OnError {
+		case HookAbort:
+			tl.Logf(api.TaskLogError, "Hook %s (%s) failed: %s", hook.Name, stage, res.Error)
+			return fmt.Errorf("%s hook %s failed: %s", stage, hook.Name, res.Error)
+		case HookWarn:
+			r.warnings++
+			tl.Logf(api.TaskLogWarning, "Hook %s (%s) failed, continuing: %s", hook.Name, stage, res.Error)
+		default:
+			tl.Logf(api.TaskLogInfo, "Hook %s (%s) failed, ignored: %s", hook.Name, stage, res.Error)
+		}
+	}
+	return nil
+}
+
+// runOne runs a single hook. A hook that cannot be started or exits non-zero has
+// Error set.
+func (r *hookRunner) runOne(ctx context.Context, hook BackupHook, status string, backupErr error) HookResult {
+	res := HookResult{Name: hook.Name, Stage: hook.Stage, ExitCode: -1, Duration: "0s"}
+
+	path, err := r.resolve(hook.Name)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	timeout := time.Duration(hook.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = r.h.config.Hooks.Timeout
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+
+	env := []string{
+		"PHPBORG_HOOK_STAGE=" + hook.Stage,
+		"PHPBORG_TASK_ID=" + strconv.Itoa(r.task.ID),
+		"PHPBORG_REPO_PATH=" + r.payload.RepoPath,
+		"PHPBORG_ARCHIVE_NAME=" + r.payload.ArchiveName,
+		"PHPBORG_BACKUP_PATHS=" + strings.Join(r.payload.Paths, "\n"),
+	}
+	if status != "" {
+		env = append(env, "PHPBORG_BACKUP_STATUS="+status)
+	}
+	if backupErr != nil {
+		env = append(env, "PHPBORG_BACKUP_ERROR="+backupErr.Error())
+	}
+
+	result := r.h.executor.RunEnv(ctx, path, hook.Args, env, timeout)
+	res.ExitCode = result.ExitCode
+	res.Duration = result.Duration.Round(time.Millisecond).String()
+	res.Stdout = tailString(result.Stdout, hookOutputTail)
+	res.Stderr = tailString(result.Stderr, hookOutputTail)
+	switch {
+	case result.Error != nil:
+		res.Error = result.Error.Error()
+	case result.ExitCode != 0:
+		res.Error = fmt.Sprintf("exit code %d", result.ExitCode)
+	}
+	return res
+}
+
+// resolve returns the path of an allowed hook: an executable regular file directly in
+// the hook directory (after symlinks). It and the directory must be owned by root or
+// the agent user, and neither may let group or others write to it.
+func (r *hookRunner) resolve(name string) (string, error) {
+	dir := r.h.config.Hooks.Dir
+	if dir == "" {
+		return "", fmt.Errorf("hooks are disabled (hooks.dir is empty)")
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("hook directory: %w", err)
+	}
+	if err := checkTrusted(dir); err != nil {
+		return "", err
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("hook %s is not installed in %s", name, dir)
+	}
+	if filepath.Dir(path) != dir {
+		return "", fmt.Errorf("hook %s points outside %s", name, dir)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("hook %s is not an executable file", name)
+	}
+	if err := checkTrusted(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkTrusted refuses a hook or hook directory owned by another user than root or
+// the agent user, or writable by group or others
+func checkTrusted(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	uid, ok := fileOwner(info)
+	if !ok {
+		return fmt.Errorf("%s: cannot read its owner, refusing to run hooks from it", path)
+	}
+	if uid != 0 && uid != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not root or the agent user, refusing to run hooks from it", path, uid)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others (mode %v), refusing to run hooks from it", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// summary describes the hook failures, appended to a failed task's error
+func (r *hookRunner) summary() string {
+	var failed []string
+	for _, res := range r.results {
+		if res.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", res.Stage, res.Name, res.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return ""
+	}
+	return " | hooks failed: " + strings.Join(failed, "; ")
+}
@@ -0,0 +1,75 @@
+package task
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/ledger"
+	"github.com/phpborg/phpborg-agent/internal/logging"
+	"github.com/phpborg/phpborg-agent/internal/spool"
+)
+
+// taskLease is the lease asked for when claiming a task. It is renewed at a third of
+// its duration, so a couple of failed renewals (server restarting) do not lose it.
+const taskLease = 10 * time.Minute
+
+// keepLease renews the lease on a running task until ctx ends. When the server answers
+// that the lease is lost (task reassigned, failed by the watchdog, deleted...) the
+// task is stopped rather than left running next to another run of it. Other errors,
+// refusals included, are retried at the next renewal.
+func (h *Handler) keepLease(ctx context.Context, taskID int, lease *api.TaskLease, cancel context.CancelFunc) {
+	every := time.Duration(lease.Seconds) * time.Second / 3
+	if every < time.Second {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := h.client.RenewLease(ctx, taskID, taskLease)
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return
+		case api.IsLeaseLost(err):
+			slog.Warn("Lease lost, stopping the task", logging.ComponentKey, "TASK", "task_id", taskID, "error", err)
+			taskLog(ctx).Logf(api.TaskLogError, "Lease lost (%v): the server no longer expects this run, stopping", err)
+			cancel()
+			return
+		default:
+			slog.Warn("Could not renew the lease (will retry)", logging.ComponentKey, "TASK", "task_id", taskID, "error", err)
+		}
+	}
+}
+
+// record stores the outcome of a task in the ledger
+func (h *Handler) record(r ledger.Record) {
+	if err := h.ledger.Add(r); err != nil {
+		slog.Error("Could not record the outcome (a re-delivery would run it again)", logging.ComponentKey, "TASK", "task_id", r.TaskID, "error", err)
+	}
+}
+
+// reportStored reports again the stored outcome of a re-delivered task. An outcome
+// still waiting in the spool is left to the spool.
+func (h *Handler) reportStored(ctx context.Context, r ledger.Record) {
+	if h.spool.Has(r.TaskID) {
+		return
+	}
+	if r.Kind == ledger.KindComplete {
+		if err := h.client.CompleteTask(ctx, r.TaskID, r.Result, r.ExitCode); err != nil {
+			h.spoolResult(spool.Entry{TaskID: r.TaskID, Kind: spool.KindComplete, Result: r.Result, ExitCode: r.ExitCode, Progress: 100, Message: r.Message}, err)
+		}
+		return
+	}
+	if err := h.client.FailTask(ctx, r.TaskID, r.Error, r.ExitCode); err != nil {
+		h.spoolResult(spool.Entry{TaskID: r.TaskID, Kind: spool.KindFail, Error: r.Error, ExitCode: r.ExitCode}, err)
+	}
+}
@@ -0,0 +1,34 @@
+package task
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/metrics"
+)
+
+// borgCreateStats is the part of `borg create --json` output the metrics use
+type borgCreateStats struct {
+	Archive struct {
+		Stats struct {
+			OriginalSize     int64 `json:"original_size"`
+			CompressedSize   int64 `json:"compressed_size"`
+			DeduplicatedSize int64 `json:"deduplicated_size"`
+		} `json:"stats"`
+	} `json:"archive"`
+}
+
+// recordBackupMetrics exports the outcome of a committed backup
+func recordBackupMetrics(repoPath, stdout string, permDenied int) {
+	metrics.LastBackupSuccess.Set(float64(time.Now().Unix()), repoPath)
+	metrics.SkippedPermissionDenied.Add(float64(permDenied))
+
+	var out borgCreateStats
+	if err := json.Unmarshal([]byte(stdout), &out); err != nil {
+		return // no stats (older borg, truncated output): sizes are simply not counted
+	}
+	stats := out.Archive.Stats
+	metrics.BorgBytes.Add(float64(stats.OriginalSize), "original")
+	metrics.BorgBytes.Add(float64(stats.CompressedSize), "compressed")
+	metrics.BorgBytes.Add(float64(stats.DeduplicatedSize), "deduplicated")
+}
@@ -0,0 +1,60 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// OfflineRuns tells whether a backup job already ran on the offline schedule in the
+// schedule window of a task created at createdAt (offline.Scheduler)
+type OfflineRuns interface {
+	RanOffline(jobID int, createdAt string) (time.Time, bool)
+}
+
+// SetOfflineRuns makes backup_create tasks of a job the agent already ran offline in
+// the same window complete without running (offline.enabled)
+func (h *Handler) SetOfflineRuns(r OfflineRuns) {
+	h.offlineRuns = r
+}
+
+// ranOffline reports whether task duplicates a backup the agent ran on its own while
+// the server was unreachable, and when that run started
+func (h *Handler) ranOffline(task api.Task, p *BackupCreatePayload) (time.Time, bool) {
+	if h.offlineRuns == nil || p.BackupJobID == nil || task.ID == 0 {
+		return time.Time{}, false
+	}
+	return h.offlineRuns.RanOffline(*p.BackupJobID, task.CreatedAt)
+}
+
+type offlineRunKey struct{}
+
+// withOfflineRun marks ctx as running a backup of the offline schedule: there is no
+// server task to report progress to or to poll for a cancellation
+func withOfflineRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, offlineRunKey{}, true)
+}
+
+// isOfflineRun reports whether ctx runs a backup of the offline schedule
+func isOfflineRun(ctx context.Context) bool {
+	offline, _ := ctx.Value(offlineRunKey{}).(bool)
+	return offline
+}
+
+// RunOffline runs a backup of the synced schedule while the server is unreachable. t
+// is not a server task (no ID): nothing is reported, the caller keeps the outcome and
+// uploads it once the server is back.
+func (h *Handler) RunOffline(ctx context.Context, t api.Task) (map[string]interface{}, int, error) {
+	taskType := lookup(t.Type)
+	if taskType == nil || taskType.Handle == nil {
+		return nil, 1, fmt.Errorf("unknown task type: %s", t.Type)
+	}
+	if taskType.BlocksUpdate {
+		atomic.AddInt32(&h.updateBlockers, 1)
+		defer atomic.AddInt32(&h.updateBlockers, -1)
+	}
+	return taskType.Handle(h, withOfflineRun(ctx), t)
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package task
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid owning a file
+func fileOwner(info os.FileInfo) (int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
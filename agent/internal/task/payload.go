@@ -0,0 +1,258 @@
+package task
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// PayloadVersion is the newest task payload protocol version this agent understands.
+// A task without a version comes from a server that predates versioning and is read
+// as version 1.
+const PayloadVersion = 1
+
+// Error codes of a payload the agent refuses. The code starts the error message
+// reported to the server; the exit code follows sysexits(3).
+const (
+	ErrCodePayloadInvalid     = "PAYLOAD_INVALID"
+	ErrCodePayloadUnsupported = "PAYLOAD_VERSION_UNSUPPORTED"
+
+	exitPayloadInvalid     = 65 // EX_DATAERR
+	exitPayloadUnsupported = 76 // EX_PROTOCOL
+)
+
+// PayloadError is a task payload the agent refuses to run
+type PayloadError struct {
+	Code     string
+	ExitCode int
+	Err      error
+}
+
+func (e *PayloadError) Error() string {
+	return e.Code + ": " + e.Err.Error()
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// payload is a typed task payload
+type payload interface {
+	validate() error
+}
+
+// BackupCreatePayload is the payload of a backup_create task
+type BackupCreatePayload struct {
+	RepoPath    string   `json:"repo_path"`
+	ArchiveName string   `json:"archive_name"`
+	Passphrase  string   `json:"passphrase"`
+	Paths       []string `json:"paths"`
+	Excludes    []string `json:"excludes"`
+	Compression string   `json:"compression"`
+	// Bug 17: optional --one-file-system
+	OneFileSystem bool `json:"one_file_system"`
+	// Bug 21: access an unencrypted repository (also inferred from an empty passphrase)
+	AllowUnencrypted bool `json:"allow_unencrypted"`
+	// Bug 33: original size of the last archive of the repo (0 = unknown)
+	ExpectedOsize int64 `json:"expected_osize"`
+	// Hooks run around borg create, in order within each stage
+	Hooks []BackupHook `json:"hooks"`
+
+	// Server-side bookkeeping, not used by the agent
+	ServerID     int  `json:"server_id"`
+	RepositoryID int  `json:"repository_id"`
+	BackupJobID  *int `json:"backup_job_id"`
+}
+
+func (p *BackupCreatePayload) validate() error {
+	if err := required("repo_path", p.RepoPath, "archive_name", p.ArchiveName); err != nil {
+		return err
+	}
+	if len(p.Paths) == 0 {
+		return errors.New("paths: at least one path is required")
+	}
+	for i, path := range p.Paths {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("paths[%d]: empty path", i)
+		}
+	}
+	if p.ExpectedOsize < 0 {
+		return fmt.Errorf("expected_osize: must not be negative (got %d)", p.ExpectedOsize)
+	}
+	for i := range p.Hooks {
+		if err := p.Hooks[i].validate(); err != nil {
+			return fmt.Errorf("hooks[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Hook stages
+const (
+	HookPre       = "pre"        // before borg create
+	HookPost      = "post"       // after the archive is committed and verified
+	HookOnFailure = "on_failure" // after a failed backup, e.g. to resume what pre paused
+)
+
+// Hook failure policies
+const (
+	HookAbort    = "abort"    // fail the backup (pre: borg does not run)
+	HookWarn     = "warn"     // go on, flagged as a warning in the result
+	HookContinue = "continue" // go on, only recorded in the result
+)
+
+// BackupHook is a hook of a backup_create task. Name is an executable of the local
+// hook directory (hooks.dir): the server picks among the installed hooks, it cannot
+// send a command.
+type BackupHook struct {
+	Name  string   `json:"name"`
+	Stage string   `json:"stage"`
+	Args  []string `json:"args"`
+	// 0 = hooks.timeout
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// Failure policy; default abort for pre hooks, warn otherwise
+	OnError string `json:"on_error"`
+}
+
+func (b *BackupHook) validate() error {
+	if b.Name == "" || b.Name != filepath.Base(b.Name) || strings.HasPrefix(b.Name, ".") {
+		return fmt.Errorf("name: %q is not a file name of the hook directory", b.Name)
+	}
+	switch b.Stage {
+	case HookPre, HookPost, HookOnFailure:
+	default:
+		return fmt.Errorf("stage: unknown stage %q (pre, post, on_failure)", b.Stage)
+	}
+	switch b.OnError {
+	case "", HookAbort, HookWarn, HookContinue:
+	default:
+		return fmt.Errorf("on_error: unknown policy %q (abort, warn, continue)", b.OnError)
+	}
+	if b.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout_seconds: must not be negative (got %d)", b.TimeoutSeconds)
+	}
+	return nil
+}
+
+// policy returns the failure policy of the hook
+func (b *BackupHook) policy() string {
+	switch {
+	case b.OnError != "":
+		return b.OnError
+	case b.Stage == HookPre:
+		return HookAbort
+	}
+	return HookWarn
+}
+
+// BackupRestorePayload is the payload of a backup_restore task
+type BackupRestorePayload struct {
+	RepoPath    string   `json:"repo_path"`
+	ArchiveName string   `json:"archive_name"`
+	DestPath    string   `json:"dest_path"` // empty = /var/restore
+	Patterns    []string `json:"patterns"`
+
+	ServerID int `json:"server_id"`
+}
+
+func (p *BackupRestorePayload) validate() error {
+	return required("repo_path", p.RepoPath, "archive_name", p.ArchiveName)
+}
+
+// AgentUpdatePayload is the payload of an agent_update task
+type AgentUpdatePayload struct {
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"` // SHA-256 of the new binary, hex
+	Force    bool   `json:"force"`
+
+	ServerID int `json:"server_id"`
+}
+
+func (p *AgentUpdatePayload) validate() error {
+	if p.Checksum == "" {
+		if !p.Force {
+			return errors.New("checksum: required for update (or set force=true)")
+		}
+		return nil
+	}
+	if b, err := hex.DecodeString(p.Checksum); err != nil || len(b) != 32 {
+		return fmt.Errorf("checksum: %q is not a hex SHA-256", p.Checksum)
+	}
+	return nil
+}
+
+// TestPayload is the payload of a test task
+type TestPayload struct {
+	Message string `json:"message"`
+
+	ServerID int `json:"server_id"`
+}
+
+func (p *TestPayload) validate() error { return nil }
+
+// ServerPayload is the payload of the tasks that take no parameters
+// (capabilities_detect, stats_collect)
+type ServerPayload struct {
+	ServerID int `json:"server_id"`
+}
+
+func (p *ServerPayload) validate() error { return nil }
+
+// required checks name/value pairs of required string fields
+func required(fields ...string) error {
+	var missing []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if strings.TrimSpace(fields[i+1]) == "" {
+			missing = append(missing, fields[i])
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required parameters: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// decodePayload strictly decodes the payload of task into p and validates it:
+// unknown fields, wrong JSON types and missing required values are refused, as is a
+// payload version newer than PayloadVersion.
+func decodePayload(task api.Task, p payload) *PayloadError {
+	if task.PayloadVersion < 0 || task.PayloadVersion > PayloadVersion {
+		return &PayloadError{
+			Code:     ErrCodePayloadUnsupported,
+			ExitCode: exitPayloadUnsupported,
+			Err:      fmt.Errorf("%s payload version %d is not supported by this agent (up to %d), update the agent", task.Type, task.PayloadVersion, PayloadVersion),
+		}
+	}
+
+	invalid := func(err error) *PayloadError {
+		return &PayloadError{
+			Code:     ErrCodePayloadInvalid,
+			ExitCode: exitPayloadInvalid,
+			Err:      fmt.Errorf("%s payload: %w", task.Type, err),
+		}
+	}
+
+	raw := bytes.TrimSpace(task.Payload)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		raw = []byte("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return invalid(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return invalid(errors.New("trailing data after the payload object"))
+	}
+	if err := p.validate(); err != nil {
+		return invalid(err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package task
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+func TestDecodePayload(t *testing.T) {
+	const backup = `"repo_path":"/srv/repo","archive_name":"a1","paths":["/etc"]`
+	checksum := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name     string
+		payload  string
+		version  int
+		target   func() payload
+		wantCode string
+		wantErr  string
+	}{
+		{"backup", `{` + backup + `}`, 1, newBackup, "", ""},
+		{"backup without version", `{` + backup + `}`, 0, newBackup, "", ""},
+		{"server bookkeeping", `{` + backup + `,"server_id":3,"repository_id":4,"backup_job_id":null}`, 1, newBackup, "", ""},
+		{"hooks", `{` + backup + `,"hooks":[{"name":"db-dump","stage":"pre","args":["--all"]},{"name":"notify","stage":"post","on_error":"continue"}]}`, 1, newBackup, "", ""},
+		{"newer version", `{` + backup + `}`, 2, newBackup, ErrCodePayloadUnsupported, "version 2"},
+		{"negative version", `{` + backup + `}`, -1, newBackup, ErrCodePayloadUnsupported, "version -1"},
+		{"unknown field", `{` + backup + `,"compresion":"lz4"}`, 1, newBackup, ErrCodePayloadInvalid, "compresion"},
+		{"wrong type", `{` + backup + `,"one_file_system":"yes"}`, 1, newBackup, ErrCodePayloadInvalid, "one_file_system"},
+		{"missing fields", `{"paths":["/etc"]}`, 1, newBackup, ErrCodePayloadInvalid, "repo_path, archive_name"},
+		{"blank field", `{"repo_path":" ","archive_name":"a1","paths":["/etc"]}`, 1, newBackup, ErrCodePayloadInvalid, "repo_path"},
+		{"no paths", `{"repo_path":"/srv/repo","archive_name":"a1"}`, 1, newBackup, ErrCodePayloadInvalid, "paths"},
+		{"empty path", `{"repo_path":"/srv/repo","archive_name":"a1","paths":["/etc",""]}`, 1, newBackup, ErrCodePayloadInvalid, "paths[1]"},
+		{"negative osize", `{` + backup + `,"expected_osize":-1}`, 1, newBackup, ErrCodePayloadInvalid, "expected_osize"},
+		{"hook path", `{` + backup + `,"hooks":[{"name":"../bin/sh","stage":"pre"}]}`, 1, newBackup, ErrCodePayloadInvalid, "hooks[0]: name"},
+		{"hidden hook", `{` + backup + `,"hooks":[{"name":".hidden","stage":"pre"}]}`, 1, newBackup, ErrCodePayloadInvalid, "hooks[0]: name"},
+		{"hook stage", `{` + backup + `,"hooks":[{"name":"db-dump","stage":"pre"},{"name":"db-dump","stage":"during"}]}`, 1, newBackup, ErrCodePayloadInvalid, "hooks[1]: stage"},
+		{"hook policy", `{` + backup + `,"hooks":[{"name":"db-dump","stage":"pre","on_error":"ignore"}]}`, 1, newBackup, ErrCodePayloadInvalid, "on_error"},
+		{"hook timeout", `{` + backup + `,"hooks":[{"name":"db-dump","stage":"pre","timeout_seconds":-5}]}`, 1, newBackup, ErrCodePayloadInvalid, "timeout_seconds"},
+		{"trailing data", `{` + backup + `}{}`, 1, newBackup, ErrCodePayloadInvalid, "trailing data"},
+		{"not an object", `["/etc"]`, 1, newBackup, ErrCodePayloadInvalid, "cannot unmarshal"},
+		{"empty payload", ``, 1, newServer, "", ""},
+		{"null payload", `null`, 1, newServer, "", ""},
+		{"empty backup payload", ``, 1, newBackup, ErrCodePayloadInvalid, "missing required parameters"},
+		{"update", `{"version":"2.1.0","checksum":"` + checksum + `"}`, 1, newUpdate, "", ""},
+		{"forced update", `{"version":"2.1.0","force":true}`, 1, newUpdate, "", ""},
+		{"update without checksum", `{"version":"2.1.0"}`, 1, newUpdate, ErrCodePayloadInvalid, "checksum: required"},
+		{"short checksum", `{"version":"2.1.0","checksum":"abcd"}`, 1, newUpdate, ErrCodePayloadInvalid, "not a hex SHA-256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := api.Task{ID: 1, Type: "backup_create", Payload: json.RawMessage(tt.payload), PayloadVersion: tt.version}
+			err := decodePayload(task, tt.target())
+			switch {
+			case tt.wantCode == "" && err != nil:
+				t.Errorf("decodePayload() error = %v", err)
+			case tt.wantCode != "" && err == nil:
+				t.Errorf("decodePayload() accepted the payload, want %s", tt.wantCode)
+			case tt.wantCode != "" && (err.Code != tt.wantCode || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("decodePayload() error = %v, want %s containing %q", err, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHookPolicy(t *testing.T) {
+	tests := []struct {
+		stage, onError, want string
+	}{
+		{HookPre, "", HookAbort},
+		{HookPost, "", HookWarn},
+		{HookOnFailure, "", HookWarn},
+		{HookPre, HookContinue, HookContinue},
+		{HookPost, HookAbort, HookAbort},
+	}
+	for _, tt := range tests {
+		h := BackupHook{Name: "hook", Stage: tt.stage, OnError: tt.onError}
+		if got := h.policy(); got != tt.want {
+			t.Errorf("policy(stage=%s, on_error=%q) = %s, want %s", tt.stage, tt.onError, got, tt.want)
+		}
+	}
+}
+
+func newBackup() payload { return &BackupCreatePayload{} }
+func newServer() payload { return &ServerPayload{} }
+func newUpdate() payload { return &AgentUpdatePayload{} }
@@ -0,0 +1,157 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+// defaultTaskTimeout caps the task types that do not declare their own timeout
+const defaultTaskTimeout = 1 * time.Hour
+
+// Concurrency classes. agent.task_limits may cap a class as well as a single type.
+const (
+	ClassBorg   = "borg"   // runs borg against a repository
+	ClassSystem = "system" // light local inspection
+	ClassUpdate = "update" // replaces the agent binary
+)
+
+// HandlerFunc runs a task and returns its result, exit code and error
+type HandlerFunc func(h *Handler, ctx context.Context, task api.Task) (map[string]interface{}, int, error)
+
+// TaskType describes how the agent runs one task type
+type TaskType struct {
+	Name   string
+	Handle HandlerFunc
+	// Timeout applied when the server sends none. Zero means the default (1h),
+	// negative means no cap (bounded only by the parent context).
+	DefaultTimeout time.Duration
+	// Cancellable tasks are stopped when the server cancels them
+	Cancellable bool
+	// BlocksUpdate defers an agent_update while a task of this type runs
+	BlocksUpdate bool
+	// Class groups types that share a concurrency limit (see ClassOf)
+	Class string
+}
+
+// timeout returns the timeout of a task of this type (0 = no cap)
+func (t *TaskType) timeout(task api.Task) time.Duration {
+	if task.TimeoutSeconds > 0 {
+		return time.Duration(task.TimeoutSeconds) * time.Second
+	}
+	switch {
+	case t.DefaultTimeout < 0:
+		return 0
+	case t.DefaultTimeout == 0:
+		return defaultTaskTimeout
+	}
+	return t.DefaultTimeout
+}
+
+var registry = map[string]*TaskType{}
+
+// Register adds a task type. It panics on a duplicate or incomplete declaration, which
+// is a programming error.
+func Register(t TaskType) {
+	if t.Name == "" || t.Handle == nil {
+		panic("task: Register needs a name and a handler")
+	}
+	if _, dup := registry[t.Name]; dup {
+		panic(fmt.Sprintf("task: type %q registered twice", t.Name))
+	}
+	registry[t.Name] = &t
+}
+
+// lookup returns the registered task type, nil if unknown
+func lookup(name string) *TaskType {
+	return registry[name]
+}
+
+// Types returns the names of the registered task types, sorted. The heartbeat
+// advertises them so the server only dispatches types this agent knows.
+func Types() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Classes maps each registered task type to its concurrency class
+func Classes() map[string]string {
+	classes := make(map[string]string, len(registry))
+	for name, t := range registry {
+		if t.Class != "" {
+			classes[name] = t.Class
+		}
+	}
+	return classes
+}
+
+func init() {
+	// Bug 23: backups of multi-TB / millions-of-small-files repos legitimately run for
+	// many hours. They must NOT inherit the generic 1h fallback (which killed borg mid
+	// archive): without an explicit timeout they run uncapped.
+	Register(TaskType{
+		Name:           "backup_create",
+		Handle:         (*Handler).handleBackupCreate,
+		DefaultTimeout: -1,
+		Cancellable:    true,
+		BlocksUpdate:   true, // Bug 27a
+		Class:          ClassBorg,
+	})
+	Register(TaskType{
+		Name:           "backup_restore",
+		Handle:         (*Handler).handleBackupRestore,
+		DefaultTimeout: -1,
+		Cancellable:    true,
+		BlocksUpdate:   true,
+		Class:          ClassBorg,
+	})
+	Register(TaskType{
+		Name:        "capabilities_detect",
+		Handle:      (*Handler).handleCapabilitiesDetect,
+		Cancellable: true,
+		Class:       ClassSystem,
+	})
+	Register(TaskType{
+		Name:        "stats_collect",
+		Handle:      (*Handler).handleStatsCollect,
+		Cancellable: true,
+		Class:       ClassSystem,
+	})
+	// Not cancellable: stopping it halfway could leave the binary half replaced
+	Register(TaskType{
+		Name:   "agent_update",
+		Handle: (*Handler).handleAgentUpdate,
+		Class:  ClassUpdate,
+	})
+	Register(TaskType{
+		Name:        "test",
+		Handle:      (*Handler).handleTest,
+		Cancellable: true,
+		Class:       ClassSystem,
+	})
+}
+
+// SerialKey names the borg repository a task works on, "" when it has none. The queue
+// never runs two tasks on the same repository at once: they would fight over the borg
+// repository lock, or run the same backup twice.
+func SerialKey(task api.Task) string {
+	var target struct {
+		RepoPath string `json:"repo_path"`
+	}
+	if err := json.Unmarshal(task.Payload, &target); err != nil {
+		return ""
+	}
+	if repo := strings.TrimRight(strings.TrimSpace(target.RepoPath), "/"); repo != "" {
+		return "repo:" + repo
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package task
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+)
+
+func TestSerialKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"repository", `{"repo_path":"ssh://borg@backup:2222/srv/repo"}`, "repo:ssh://borg@backup:2222/srv/repo"},
+		{"trailing slash", `{"repo_path":"/srv/borg/repo/"}`, "repo:/srv/borg/repo"},
+		{"surrounding spaces", `{"repo_path":"  /srv/borg/repo "}`, "repo:/srv/borg/repo"},
+		{"no repository", `{"packages":["curl"]}`, ""},
+		{"blank repository", `{"repo_path":"  "}`, ""},
+		{"invalid payload", `{`, ""},
+		{"empty payload", ``, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := api.Task{ID: 1, Type: "backup_create", Payload: json.RawMessage(tt.payload)}
+			if got := SerialKey(task); got != tt.want {
+				t.Errorf("SerialKey(%s) = %q, want %q", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package task
+
+import (
+	"context"
+	"strings"
+
+	"github.com/phpborg/phpborg-agent/internal/api"
+	"github.com/phpborg/phpborg-agent/internal/executor"
+)
+
+type taskLogKey struct{}
+
+// withTaskLog attaches the server log channel of the running task to ctx
+func withTaskLog(ctx context.Context, l *api.TaskLog) context.Context {
+	return context.WithValue(ctx, taskLogKey{}, l)
+}
+
+// taskLog returns the log channel of the running task (nil-safe when there is none)
+func taskLog(ctx context.Context) *api.TaskLog {
+	l, _ := ctx.Value(taskLogKey{}).(*api.TaskLog)
+	return l
+}
+
+// shipBorgLog forwards a borg log message or output line to the task log
+func shipBorgLog(l *api.TaskLog, ev executor.BorgProgress) {
+	level := api.TaskLogInfo
+	switch strings.ToUpper(ev.LevelName) {
+	case "DEBUG":
+		level = api.TaskLogDebug
+	case "WARNING":
+		level = api.TaskLogWarning
+	case "ERROR", "CRITICAL":
+		level = api.TaskLogError
+	}
+	// Raw output is mostly ssh/sudo diagnostics; "Permission denied" & co. matter.
+	if ev.Type == executor.BorgEventOutput && strings.Contains(strings.ToLower(ev.Message), "denied") {
+		level = api.TaskLogWarning
+	}
+	l.Add(level, api.TaskLogSourceBorg, ev.Message)
+}
@@ -119,6 +119,7 @@ try {
     $router->post('/jobs/test', JobController::class, 'createTest', requireAuth: true);
     $router->get('/jobs/:id', JobController::class, 'show', requireAuth: true);
     $router->get('/jobs/:id/progress', JobController::class, 'progress', requireAuth: true);
+    $router->get('/jobs/:id/agent-log', JobController::class, 'agentLog', requireAuth: true);
     $router->post('/jobs/:id/cancel', JobController::class, 'cancel', requireAuth: true);
     $router->post('/jobs/:id/retry', JobController::class, 'retry', requireAuth: true);
 
@@ -343,14 +344,21 @@ try {
     // These routes are for phpborg-agent communication
     // ===========================================
     $router->post('/agent/register', AgentGatewayController::class, 'register', requireAuth: false); // Uses internal auth
+    $router->post('/agent/auth/enroll', AgentGatewayController::class, 'enrollToken', requireAuth: false); // One-time enrollment token
+    $router->post('/agent/auth/refresh', AgentGatewayController::class, 'refreshToken', requireAuth: false); // Agent token or mTLS
     $router->post('/agent/heartbeat', AgentGatewayController::class, 'heartbeat', requireAuth: false); // mTLS auth
     $router->get('/agent/tasks', AgentGatewayController::class, 'getTasks', requireAuth: false); // mTLS auth
+    $router->get('/agent/tasks/stream', AgentGatewayController::class, 'streamTasks', requireAuth: false); // mTLS auth
     $router->post('/agent/tasks/:taskId/start', AgentGatewayController::class, 'startTask', requireAuth: false); // mTLS auth
+    $router->post('/agent/tasks/:taskId/lease', AgentGatewayController::class, 'renewTaskLease', requireAuth: false); // mTLS auth
     $router->post('/agent/tasks/:taskId/progress', AgentGatewayController::class, 'updateProgress', requireAuth: false); // mTLS auth
+    $router->post('/agent/tasks/:taskId/log', AgentGatewayController::class, 'appendTaskLog', requireAuth: false); // mTLS auth
     $router->post('/agent/tasks/:taskId/complete', AgentGatewayController::class, 'completeTask', requireAuth: false); // mTLS auth
     $router->post('/agent/tasks/:taskId/fail', AgentGatewayController::class, 'failTask', requireAuth: false); // mTLS auth
     $router->get('/agent/tasks/:taskId/status', AgentGatewayController::class, 'getTaskStatus', requireAuth: false); // mTLS auth - for cancellation check
     $router->get('/agent/info', AgentGatewayController::class, 'getInfo', requireAuth: false); // mTLS auth
+    $router->get('/agent/schedule', AgentGatewayController::class, 'getSchedule', requireAuth: false); // mTLS auth - offline schedule
+    $router->post('/agent/offline-runs', AgentGatewayController::class, 'uploadOfflineRun', requireAuth: false); // mTLS auth
 
     // Agent Update Routes (called by agent via mTLS)
     $router->post('/agent/update/check', AgentGatewayController::class, 'checkUpdate', requireAuth: false); // mTLS auth
@@ -76,4 +76,15 @@ export const jobService = {
       throw error
     }
   },
+
+  /**
+   * Get the live log streamed by the agent running a job
+   * @param {number} id - Job ID
+   * @param {number} after - Last seq already loaded
+   * @returns {Promise<Array>} Log entries (seq, logged_at, level, source, message)
+   */
+  async getAgentLog(id, after = 0) {
+    const response = await api.get(`/jobs/${id}/agent-log`, { params: { after } })
+    return response.data.data?.entries || []
+  },
 }
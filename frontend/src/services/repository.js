@@ -45,8 +45,8 @@ export const repositoryService = {
   },
 
   /**
-   * Update repository backup source config (backup_path, exclude, one_file_system).
-   * @param {Object} config { backup_path?, exclude?, one_file_system? }
+   * Update repository backup source config (backup_path, exclude, one_file_system, backup_hooks).
+   * @param {Object} config { backup_path?, exclude?, one_file_system?, backup_hooks? }
    */
   async updateBackupConfig(id, config) {
     const response = await api.put(`/repositories/${id}/backup-config`, config)
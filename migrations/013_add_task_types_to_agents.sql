@@ -0,0 +1,8 @@
+-- Task types the agent can run, as advertised in its heartbeats. The gateway fails a
+-- pending task of any other type instead of dispatching it to an agent that would not
+-- know it. NULL = agent predates the advertisement (every type is dispatched).
+-- Idempotent (ADD COLUMN IF NOT EXISTS).
+ALTER TABLE `agents`
+  ADD COLUMN IF NOT EXISTS `task_types` JSON DEFAULT NULL
+  COMMENT 'Task types advertised by the agent heartbeat'
+  AFTER `capabilities`;
@@ -0,0 +1,9 @@
+-- Lease-based claiming: the agent claims a task with a lease when it starts it and
+-- renews the lease while the task runs. A running task whose lease expired is
+-- abandoned (agent dead or partitioned) and failed by the watchdog without waiting
+-- for the progress staleness threshold. NULL = agent predates leases.
+-- Idempotent (ADD COLUMN IF NOT EXISTS).
+ALTER TABLE `agent_tasks`
+  ADD COLUMN IF NOT EXISTS `lease_expires_at` DATETIME DEFAULT NULL
+  COMMENT 'Expiry of the agent lease on a running task'
+  AFTER `started_at`;
@@ -0,0 +1,12 @@
+-- Offline runs: backups an agent ran on its own from its synced schedule while the
+-- server was unreachable, uploaded once the server is back. They are recorded as
+-- finished agent tasks; offline_run_id (generated by the agent) makes an upload
+-- retried after a lost response land only once. NULL = task dispatched by the server.
+-- Idempotent (ADD COLUMN / ADD UNIQUE INDEX IF NOT EXISTS).
+ALTER TABLE `agent_tasks`
+  ADD COLUMN IF NOT EXISTS `offline_run_id` VARCHAR(64) DEFAULT NULL
+  COMMENT 'Agent-generated ID of a backup run while the server was unreachable'
+  AFTER `job_id`;
+
+ALTER TABLE `agent_tasks`
+  ADD UNIQUE INDEX IF NOT EXISTS `uniq_agent_offline_run` (`agent_id`, `offline_run_id`);
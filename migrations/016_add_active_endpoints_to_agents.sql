@@ -0,0 +1,10 @@
+-- API endpoint and borg SSH host the agent is using, as reported by its heartbeats.
+-- Agents configured with several endpoints (server.urls, borg_ssh.hosts) fail over
+-- between them; NULL = agent predates the report. Idempotent (ADD COLUMN IF NOT EXISTS).
+ALTER TABLE `agents`
+  ADD COLUMN IF NOT EXISTS `api_endpoint` VARCHAR(255) DEFAULT NULL
+  COMMENT 'API endpoint in use, from the agent heartbeat'
+  AFTER `task_types`,
+  ADD COLUMN IF NOT EXISTS `borg_host` VARCHAR(255) DEFAULT NULL
+  COMMENT 'Borg SSH host in use, from the agent heartbeat'
+  AFTER `api_endpoint`;
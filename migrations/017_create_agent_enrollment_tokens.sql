@@ -0,0 +1,24 @@
+-- One-time enrollment tokens. An agent without mTLS exchanges one (auth.enrollment_token)
+-- for a signed, expiring agent token on its first start (POST /agent/auth/enroll). Only
+-- the SHA-256 of the token is stored; used_at is set when it is consumed.
+CREATE TABLE IF NOT EXISTS `agent_enrollment_tokens` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `agent_uuid` varchar(36) NOT NULL COMMENT 'Agent the token enrolls',
+  `token_hash` char(64) NOT NULL COMMENT 'SHA-256 of the token',
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_token_hash` (`token_hash`),
+  KEY `idx_agent_uuid` (`agent_uuid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+  COMMENT='One-time agent enrollment tokens';
+
+-- Agents that may still authenticate with "Bearer <UUID>": the ones registered before
+-- agent tokens (existing rows get 1, new agents 0). Cleared once the agent enrolls;
+-- agents with an mTLS certificate never use it. Idempotent.
+ALTER TABLE `agents`
+  ADD COLUMN IF NOT EXISTS `legacy_uuid_auth` tinyint(1) NOT NULL DEFAULT 1
+  COMMENT 'May authenticate with its UUID as bearer (pre-token agents, until they enroll)';
+ALTER TABLE `agents` ALTER COLUMN `legacy_uuid_auth` SET DEFAULT 0;
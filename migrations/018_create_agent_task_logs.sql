@@ -0,0 +1,18 @@
+-- Live task logs streamed by the agents while a task runs (POST /agent/tasks/:id/log).
+-- seq numbers the entries of a task: the unique key drops the duplicates of a retried
+-- batch. Entries go away with their task (deleteOldTasks).
+CREATE TABLE IF NOT EXISTS `agent_task_logs` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `agent_task_id` int(11) NOT NULL,
+  `seq` int(11) NOT NULL COMMENT 'Entry number within the task, set by the agent',
+  `logged_at` datetime NOT NULL COMMENT 'Agent time of the entry',
+  `level` enum('debug','info','warning','error') NOT NULL DEFAULT 'info',
+  `source` varchar(16) NOT NULL DEFAULT 'agent' COMMENT 'agent or borg',
+  `message` text NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_task_seq` (`agent_task_id`, `seq`),
+  CONSTRAINT `fk_agent_task_logs_task` FOREIGN KEY (`agent_task_id`) REFERENCES `agent_tasks` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+  COMMENT='Live logs of agent tasks';
@@ -0,0 +1,7 @@
+-- Clock skew reported by the agent heartbeats: server clock minus agent clock, in
+-- seconds. NULL = not measured yet or agent predates the report.
+-- Idempotent (ADD COLUMN IF NOT EXISTS).
+ALTER TABLE `agents`
+  ADD COLUMN IF NOT EXISTS `clock_skew_seconds` DECIMAL(10,1) DEFAULT NULL
+  COMMENT 'Server clock minus agent clock, from the agent heartbeat'
+  AFTER `borg_host`;
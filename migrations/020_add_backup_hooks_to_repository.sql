@@ -0,0 +1,8 @@
+-- Hooks the agent runs around `borg create` for this repository, sent in the
+-- backup_create payload (`hooks`). JSON list of {name, stage, args, timeout_seconds,
+-- on_error}; each name is an executable of the agent's hooks.dir. NULL = no hooks.
+-- Idempotent (ADD COLUMN IF NOT EXISTS).
+ALTER TABLE `repository`
+  ADD COLUMN IF NOT EXISTS `backup_hooks` TEXT DEFAULT NULL
+  COMMENT 'Agent backup hooks (JSON list), sent in the backup_create payload'
+  AFTER `one_file_system`;
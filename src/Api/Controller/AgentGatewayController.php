@@ -9,6 +9,8 @@ use PhpBorg\Logger\LoggerInterface;
 use PhpBorg\Repository\AgentRepository;
 use PhpBorg\Repository\AgentTaskRepository;
 use PhpBorg\Service\Agent\AgentManager;
+use PhpBorg\Service\Agent\AgentScheduleService;
+use PhpBorg\Service\Agent\AgentTokenService;
 use PhpBorg\Service\Agent\CertificateManager;
 use PhpBorg\Service\Queue\JobQueue;
 
@@ -16,23 +18,51 @@ use PhpBorg\Service\Queue\JobQueue;
  * Agent Gateway API Controller
  *
  * This controller handles all communication between phpborg-agent instances
- * and the phpBorg server. Authentication is via mTLS client certificates.
+ * and the phpBorg server. Authentication is via mTLS client certificates or, without
+ * mTLS, a signed agent token (Bearer). Agents that never enrolled still send their UUID.
  *
  * Endpoints:
  * - POST /api/agent/register - Register a new agent
+ * - POST /api/agent/auth/enroll - Exchange a one-time enrollment token for an agent token
+ * - POST /api/agent/auth/refresh - Renew the agent token
  * - POST /api/agent/heartbeat - Agent heartbeat/keepalive
  * - GET  /api/agent/tasks - Poll for pending tasks
  * - POST /api/agent/tasks/{id}/start - Mark task as started
+ * - POST /api/agent/tasks/{id}/lease - Renew the agent lease on a running task
  * - POST /api/agent/tasks/{id}/progress - Update task progress
  * - POST /api/agent/tasks/{id}/complete - Mark task as completed
  * - POST /api/agent/tasks/{id}/fail - Mark task as failed
+ * - GET  /api/agent/schedule - Backup schedule, run by the agent during outages
+ * - POST /api/agent/offline-runs - Report a backup the agent ran during an outage
  */
 final class AgentGatewayController extends BaseController
 {
+    /**
+     * Version of the task payload format. The agent refuses (PAYLOAD_VERSION_UNSUPPORTED)
+     * a task whose payload version is newer than it understands.
+     */
+    private const TASK_PAYLOAD_VERSION = 1;
+
+    /** Bounds of the lease an agent may ask for on a running task (seconds) */
+    private const MIN_TASK_LEASE = 60;
+    private const MAX_TASK_LEASE = 3600;
+
+    /**
+     * The task stream ends after this many seconds, under the php-fpm
+     * request_terminate_timeout (300s), and pings the agent at this interval
+     */
+    private const TASK_STREAM_MAX_DURATION = 240;
+    private const TASK_STREAM_PING_INTERVAL = 30;
+
+    /** Most task log entries accepted in one request (the agent sends up to 100) */
+    private const TASK_LOG_MAX_BATCH = 500;
+
     private readonly AgentRepository $agentRepo;
     private readonly AgentTaskRepository $taskRepo;
     private readonly AgentManager $agentManager;
     private readonly CertificateManager $certManager;
+    private readonly AgentScheduleService $scheduleService;
+    private readonly AgentTokenService $tokenService;
     private readonly LoggerInterface $logger;
     private readonly \PhpBorg\Repository\ServerRepository $serverRepo;
     private readonly JobQueue $jobQueue;
@@ -44,6 +74,8 @@ final class AgentGatewayController extends BaseController
         $this->taskRepo = $app->getAgentTaskRepository();
         $this->agentManager = $app->getAgentManager();
         $this->certManager = $app->getCertificateManager();
+        $this->scheduleService = $app->getAgentScheduleService();
+        $this->tokenService = $app->getAgentTokenService();
         $this->logger = $app->getLogger();
         $this->serverRepo = $app->getServerRepository();
         $this->jobQueue = $app->getJobQueue();
@@ -92,9 +124,6 @@ final class AgentGatewayController extends BaseController
                 true // append-only by default
             );
 
-            // Generate mTLS certificate
-            $certificates = $this->certManager->generateAgentCertificate($uuid, $name);
-
             // Create database record
             $agentId = $this->agentRepo->create(
                 uuid: $uuid,
@@ -176,9 +205,17 @@ final class AgentGatewayController extends BaseController
             $this->serverRepo->updateAgentHeartbeat($agent['uuid'], $version);
         }
 
-        // Update capabilities if provided
-        if (isset($data['capabilities'])) {
-            $this->agentRepo->updateCapabilities($agent['id'], $data['capabilities']);
+        // Update capabilities if provided. Agents with a capability cache only send the
+        // sections that changed (capabilities_partial), merged into the stored set.
+        $storedCapabilities = !empty($agent['capabilities']) ? json_decode($agent['capabilities'], true) : null;
+        $hasCapabilities = is_array($storedCapabilities) && $storedCapabilities !== [];
+        if (isset($data['capabilities']) && is_array($data['capabilities'])) {
+            if (empty($data['capabilities_partial'])) {
+                $this->agentRepo->updateCapabilities($agent['id'], $data['capabilities']);
+                $hasCapabilities = true;
+            } elseif ($hasCapabilities) {
+                $this->agentRepo->updateCapabilities($agent['id'], array_merge($storedCapabilities, $data['capabilities']));
+            }
         }
 
         // Update OS info if provided
@@ -186,10 +223,53 @@ final class AgentGatewayController extends BaseController
             $this->agentRepo->updateOsInfo($agent['id'], $data['os_info']);
         }
 
-        $this->success([
+        // Task types the agent can run (getTasks never dispatches any other type)
+        if (isset($data['task_types']) && is_array($data['task_types'])) {
+            $this->agentRepo->updateTaskTypes($agent['id'], $data['task_types']);
+        }
+
+        // Endpoints in use, for agents failing over between several (server.urls, borg_ssh.hosts)
+        if (isset($data['api_endpoint']) && is_string($data['api_endpoint'])) {
+            $borgHost = isset($data['borg_host']) && is_string($data['borg_host']) ? substr($data['borg_host'], 0, 255) : null;
+            $this->agentRepo->updateEndpoints($agent['id'], substr($data['api_endpoint'], 0, 255), $borgHost);
+        }
+
+        // Clock skew measured by the agent on its previous heartbeat (server minus agent)
+        if (isset($data['clock_skew_seconds']) && is_numeric($data['clock_skew_seconds'])) {
+            $this->agentRepo->updateClockSkew($agent['id'], (float)$data['clock_skew_seconds']);
+        }
+
+        $response = [
             'server_time' => date('c'),
-            'next_heartbeat_in' => 60, // seconds
-        ], 'Heartbeat received');
+            // Acknowledges the agent's capability set; omitted when nothing is stored
+            // yet, which makes the agent send the complete set on the next heartbeat
+            'capabilities_hash' => $hasCapabilities ? ($data['capabilities_hash'] ?? null) : null,
+        ];
+
+        // Only sent when the agent.heartbeat_interval setting is set: it then overrides
+        // the agent's polling.heartbeat_interval. Unset, each agent keeps its own.
+        $heartbeatInterval = $this->heartbeatIntervalSetting();
+        if ($heartbeatInterval !== null) {
+            $response['next_heartbeat_in'] = $heartbeatInterval; // seconds
+        }
+
+        $this->success($response, 'Heartbeat received');
+    }
+
+    /**
+     * Heartbeat interval imposed on every agent (agent.heartbeat_interval setting, in
+     * seconds), null when unset or not positive
+     */
+    private function heartbeatIntervalSetting(): ?int
+    {
+        $settingsRepo = new \PhpBorg\Repository\SettingRepository($this->connection);
+        $value = $settingsRepo->findByKey('agent.heartbeat_interval')?->value;
+
+        if ($value === null || !ctype_digit(trim($value)) || (int)$value <= 0) {
+            return null;
+        }
+
+        return (int)$value;
     }
 
     /**
@@ -205,25 +285,127 @@ final class AgentGatewayController extends BaseController
             return;
         }
 
-        // Get pending tasks
+        $formattedTasks = $this->deliverableTasks($agent);
+
+        $this->success([
+            'tasks' => $formattedTasks,
+            'count' => count($formattedTasks),
+        ]);
+    }
+
+    /**
+     * Pending tasks of the agent, formatted for delivery (GET /agent/tasks and the
+     * task stream)
+     */
+    private function deliverableTasks(array $agent): array
+    {
         $tasks = $this->taskRepo->findPendingForAgent($agent['id'], 5);
 
-        // Format tasks for response
-        $formattedTasks = array_map(function ($task) {
+        // Fail the tasks of a type the agent does not advertise: it would only reject
+        // them. Agents that advertise nothing (older versions) get every type.
+        $taskTypes = !empty($agent['task_types']) ? json_decode($agent['task_types'], true) : null;
+        if (is_array($taskTypes)) {
+            $tasks = array_values(array_filter($tasks, function ($task) use ($taskTypes) {
+                if (in_array($task['type'], $taskTypes, true)) {
+                    return true;
+                }
+                $this->taskRepo->markFailed(
+                    (int)$task['id'],
+                    "Agent does not support task type '{$task['type']}' (update the agent)"
+                );
+                $this->logger->warning("Task #{$task['id']} failed: agent does not support type '{$task['type']}'", 'AGENT_API');
+                return false;
+            }));
+        }
+
+        return array_map(function ($task) {
             return [
                 'id' => $task['id'],
                 'type' => $task['type'],
                 'priority' => $task['priority'],
                 'payload' => json_decode($task['payload'], true),
+                'payload_version' => self::TASK_PAYLOAD_VERSION,
+                // Previous failed runs: the agent runs a new attempt, and answers a
+                // re-delivered attempt with the outcome it already has
+                'attempt' => (int)$task['attempts'],
                 'timeout_seconds' => $task['timeout_seconds'],
                 'created_at' => $task['created_at'],
             ];
         }, $tasks);
+    }
 
-        $this->success([
-            'tasks' => $formattedTasks,
-            'count' => count($formattedTasks),
-        ]);
+    /**
+     * Push channel for tasks (server-sent events)
+     * GET /api/agent/tasks/stream
+     *
+     * Events:
+     * - "task": a pending task, same fields as in GET /agent/tasks
+     * - "cancel": {"task_id": N}, a task cancelled while queued or running on the agent
+     * - "ping": every 30 seconds, so the agent can tell a silent stream from a dead one
+     *
+     * The stream ends before the php-fpm request timeout; the agent polls once when it
+     * reconnects, so nothing is missed in between.
+     */
+    public function streamTasks(): void
+    {
+        $agent = $this->requireAgentAuth();
+        if (!$agent) {
+            return;
+        }
+
+        while (ob_get_level()) {
+            ob_end_clean();
+        }
+        ob_implicit_flush(true);
+
+        header('Content-Type: text/event-stream');
+        header('Cache-Control: no-cache');
+        header('Connection: keep-alive');
+        header('X-Accel-Buffering: no'); // Disable nginx buffering
+
+        // Tasks the agent has (pushed, or already running), watched for cancellation
+        $delivered = [];
+        foreach ($this->taskRepo->findRunningForAgent($agent['id']) as $task) {
+            $delivered[(int)$task['id']] = true;
+        }
+
+        $startTime = time();
+        $lastPing = 0;
+        while (time() - $startTime < self::TASK_STREAM_MAX_DURATION && !connection_aborted()) {
+            if (time() - $lastPing >= self::TASK_STREAM_PING_INTERVAL) {
+                $this->sendStreamEvent('ping', ['timestamp' => time()]);
+                $lastPing = time();
+            }
+
+            foreach ($this->deliverableTasks($agent) as $task) {
+                if (!isset($delivered[(int)$task['id']])) {
+                    $this->sendStreamEvent('task', $task);
+                    $delivered[(int)$task['id']] = true;
+                }
+            }
+
+            foreach (array_keys($delivered) as $taskId) {
+                $status = $this->taskRepo->findById($taskId)['status'] ?? null;
+                if ($status === 'cancelled') {
+                    $this->sendStreamEvent('cancel', ['task_id' => $taskId]);
+                }
+                if (!in_array($status, ['pending', 'assigned', 'running'], true)) {
+                    unset($delivered[$taskId]);
+                }
+            }
+
+            sleep(2);
+        }
+    }
+
+    /**
+     * Write one server-sent event
+     */
+    private function sendStreamEvent(string $event, array $data): void
+    {
+        echo "event: {$event}\n";
+        echo 'data: ' . json_encode($data) . "\n\n";
+        flush();
     }
 
     /**
@@ -254,12 +436,72 @@ final class AgentGatewayController extends BaseController
             return;
         }
 
-        // Mark as running
-        $this->taskRepo->markRunning($taskId);
+        // Mark as running, under a lease when the agent asks for one
+        $leaseSeconds = $this->leaseSeconds($this->getJsonBody());
+        $this->taskRepo->markRunning($taskId, $leaseSeconds);
 
         $this->logger->info("Task {$taskId} started by agent {$agent['name']}", 'AGENT_API');
 
-        $this->success(null, 'Task started');
+        $this->success($leaseSeconds !== null ? $this->leaseData($leaseSeconds) : null, 'Task started');
+    }
+
+    /**
+     * Renew the agent lease on a running task
+     * POST /api/agent/tasks/{id}/lease
+     *
+     * Request body: { "lease_seconds": 600 }
+     *
+     * 409 LEASE_LOST when the task is no longer running, 404 TASK_NOT_FOUND when it was
+     * deleted: the agent lost its lease and stops the task. It retries on any other error.
+     *
+     * Must be authenticated via mTLS
+     */
+    public function renewTaskLease(int $taskId): void
+    {
+        $agent = $this->requireAgentAuth();
+        if (!$agent) {
+            return;
+        }
+
+        $task = $this->taskRepo->findById($taskId);
+        if (!$task) {
+            // The task is gone (deleted): the lease is lost as well
+            $this->error('Task not found', 404, 'TASK_NOT_FOUND');
+            return;
+        }
+
+        if ($task['agent_id'] !== $agent['id']) {
+            $this->error('Task does not belong to this agent', 403);
+            return;
+        }
+
+        $leaseSeconds = $this->leaseSeconds($this->getJsonBody()) ?? self::MIN_TASK_LEASE;
+        if (!$this->taskRepo->renewLease($taskId, $leaseSeconds)) {
+            $this->error("Task is no longer running (status: {$task['status']})", 409, 'LEASE_LOST');
+            return;
+        }
+
+        $this->success($this->leaseData($leaseSeconds), 'Lease renewed');
+    }
+
+    /**
+     * Lease duration asked by the agent, within bounds (null = no lease asked)
+     */
+    private function leaseSeconds(?array $data): ?int
+    {
+        if (!isset($data['lease_seconds']) || (int)$data['lease_seconds'] <= 0) {
+            return null;
+        }
+
+        return max(self::MIN_TASK_LEASE, min(self::MAX_TASK_LEASE, (int)$data['lease_seconds']));
+    }
+
+    private function leaseData(int $leaseSeconds): array
+    {
+        return [
+            'lease_seconds' => $leaseSeconds,
+            'lease_expires_at' => date('c', time() + $leaseSeconds),
+        ];
     }
 
     /**
@@ -322,6 +564,59 @@ final class AgentGatewayController extends BaseController
         $this->success(null, 'Progress updated');
     }
 
+    /**
+     * Append live log entries of a running task
+     * POST /api/agent/tasks/{id}/log
+     *
+     * Request body:
+     * {
+     *   "entries": [
+     *     {"seq": 1, "time": "2025-01-01T10:00:00Z", "level": "info", "source": "borg", "message": "..."}
+     *   ]
+     * }
+     *
+     * Entries already stored (same seq) are ignored, so a batch can be retried.
+     */
+    public function appendTaskLog(int $taskId): void
+    {
+        $agent = $this->requireAgentAuth();
+        if (!$agent) {
+            return;
+        }
+
+        $task = $this->taskRepo->findById($taskId);
+        if (!$task || $task['agent_id'] !== $agent['id']) {
+            $this->error('Task not found or not owned by agent', 404, 'TASK_NOT_FOUND');
+            return;
+        }
+
+        $data = $this->getJsonBody();
+        if (!is_array($data['entries'] ?? null) || count($data['entries']) > self::TASK_LOG_MAX_BATCH) {
+            $this->error('entries must be a list of at most ' . self::TASK_LOG_MAX_BATCH . ' log entries', 400, 'INVALID_ENTRIES');
+            return;
+        }
+
+        $entries = [];
+        foreach ($data['entries'] as $entry) {
+            if (!is_array($entry) || !is_int($entry['seq'] ?? null) || !is_string($entry['message'] ?? null)) {
+                continue;
+            }
+            $time = strtotime((string) ($entry['time'] ?? '')) ?: time();
+            $level = $entry['level'] ?? 'info';
+            $entries[] = [
+                'seq' => $entry['seq'],
+                'time' => date('Y-m-d H:i:s', $time),
+                'level' => in_array($level, ['debug', 'info', 'warning', 'error'], true) ? $level : 'info',
+                'source' => ($entry['source'] ?? '') === 'borg' ? 'borg' : 'agent',
+                'message' => mb_substr($entry['message'], 0, 4096),
+            ];
+        }
+
+        $stored = $this->taskRepo->appendLogs($taskId, $entries);
+
+        $this->success(['stored' => $stored], 'Log entries stored');
+    }
+
     /**
      * Get task status (used by agent to check for cancellation)
      * GET /api/agent/tasks/{id}/status
@@ -437,6 +732,66 @@ final class AgentGatewayController extends BaseController
         $this->success(null, 'Task marked as failed');
     }
 
+    /**
+     * Backup schedule of the agent's servers
+     * GET /api/agent/schedule[?secrets=1]
+     *
+     * The agent runs the due jobs itself while the server is unreachable. Repository
+     * passphrases are only sent with secrets=1, asked by agents that keep them in
+     * their encrypted secret store.
+     *
+     * Must be authenticated via mTLS
+     */
+    public function getSchedule(): void
+    {
+        $agent = $this->requireAgentAuth();
+        if (!$agent) {
+            return;
+        }
+
+        $withSecrets = ($_GET['secrets'] ?? '') === '1';
+
+        $this->success($this->scheduleService->buildSchedule($agent, $withSecrets, self::TASK_PAYLOAD_VERSION));
+    }
+
+    /**
+     * Report a backup the agent ran on its own while the server was unreachable
+     * POST /api/agent/offline-runs
+     *
+     * Request body:
+     * {
+     *   "run_id": "job12-1760680800",
+     *   "backup_job_id": 12,
+     *   "archive_name": "backup_2026-10-17_02-00-00",
+     *   "status": "completed",
+     *   "result": { ... },
+     *   "error": "",
+     *   "exit_code": 0,
+     *   "started_at": "2026-10-17T00:00:00Z",
+     *   "finished_at": "2026-10-17T00:42:10Z"
+     * }
+     *
+     * A run already recorded (same run_id) is acknowledged again.
+     *
+     * Must be authenticated via mTLS
+     */
+    public function uploadOfflineRun(): void
+    {
+        $agent = $this->requireAgentAuth();
+        if (!$agent) {
+            return;
+        }
+
+        try {
+            $recorded = $this->scheduleService->recordOfflineRun($agent, $this->getJsonBody());
+        } catch (\InvalidArgumentException $e) {
+            $this->error($e->getMessage(), 422, 'INVALID_OFFLINE_RUN');
+            return;
+        }
+
+        $this->success(null, $recorded ? 'Offline run recorded' : 'Offline run already recorded');
+    }
+
     /**
      * Get agent info (for debugging)
      * GET /api/agent/info
@@ -471,16 +826,24 @@ final class AgentGatewayController extends BaseController
         // Check for mTLS client certificate
         $clientCertCN = $_SERVER['SSL_CLIENT_S_DN_CN'] ?? null;
 
-        // For development/testing, also accept API key
+        // Without mTLS: a signed agent token, or the UUID for the pre-token agents that
+        // never enrolled (legacy_uuid_auth) and have no certificate
         if (!$clientCertCN) {
-            $apiKey = $this->getBearerToken();
-            if ($apiKey) {
-                // Look up agent by API key (UUID)
-                $agent = $this->agentRepo->findByUuid($apiKey);
-                if ($agent && $agent['status'] === 'active') {
-                    return $agent;
+            $bearer = $this->getBearerToken();
+            $agent = null;
+            if ($bearer && str_contains($bearer, '.')) {
+                $uuid = $this->tokenService->validateAgentToken($bearer);
+                $agent = $uuid !== null ? $this->agentRepo->findByUuid($uuid) : null;
+            } elseif ($bearer) {
+                $agent = $this->agentRepo->findByUuid($bearer);
+                if ($agent && (empty($agent['legacy_uuid_auth']) || $agent['certificate_cn'] !== null)) {
+                    $this->logger->warning("Refused the UUID bearer of agent {$agent['name']}: it must use its agent token or certificate", 'AGENT_API');
+                    $agent = null;
                 }
             }
+            if ($agent && $agent['status'] === 'active') {
+                return $agent;
+            }
 
             $this->error('Agent authentication required', 401, 'AUTH_REQUIRED');
             return null;
@@ -502,6 +865,65 @@ final class AgentGatewayController extends BaseController
         return $agent;
     }
 
+    /**
+     * Exchange a one-time enrollment token for an agent token
+     * POST /api/agent/auth/enroll
+     *
+     * Authorization: Bearer <enrollment token>
+     * Request body:
+     * {
+     *   "uuid": "...",
+     *   "name": "..."
+     * }
+     */
+    public function enrollToken(): void
+    {
+        $data = $this->getJsonBody();
+        $uuid = is_string($data['uuid'] ?? null) ? $data['uuid'] : '';
+        $enrollmentToken = $this->getBearerToken();
+
+        $agent = $uuid !== '' ? $this->agentRepo->findByUuid($uuid) : null;
+        if (!$agent || !$enrollmentToken || !$this->tokenService->consumeEnrollmentToken($enrollmentToken, $uuid)) {
+            $this->logger->warning("Agent enrollment refused for {$uuid}", 'AGENT_API');
+            $this->error('Invalid or expired enrollment token', 401, 'INVALID_ENROLLMENT_TOKEN');
+            return;
+        }
+        if ($agent['status'] !== 'active') {
+            $this->error('Agent is not active', 403, 'AGENT_INACTIVE');
+            return;
+        }
+
+        $this->agentRepo->clearLegacyUuidAuth($agent['id']);
+        $this->logger->info("Agent {$agent['name']} ({$uuid}) enrolled with a token", 'AGENT_API');
+        $this->success($this->tokenService->issueAgentToken($uuid), 'Agent enrolled');
+    }
+
+    /**
+     * Renew the agent token
+     * POST /api/agent/auth/refresh
+     *
+     * Authorization: Bearer <agent token>, accepted for a while after it expired.
+     * Under mTLS the client certificate identifies the agent instead.
+     */
+    public function refreshToken(): void
+    {
+        $clientCertCN = $_SERVER['SSL_CLIENT_S_DN_CN'] ?? null;
+        if ($clientCertCN) {
+            $agent = $this->agentRepo->findByCertificateCN($clientCertCN);
+        } else {
+            $bearer = $this->getBearerToken();
+            $uuid = $bearer ? $this->tokenService->validateAgentToken($bearer, forRefresh: true) : null;
+            $agent = $uuid !== null ? $this->agentRepo->findByUuid($uuid) : null;
+        }
+
+        if (!$agent || $agent['status'] !== 'active') {
+            $this->error('Invalid agent token', 401, 'INVALID_TOKEN');
+            return;
+        }
+
+        $this->success($this->tokenService->issueAgentToken($agent['uuid']), 'Agent token renewed');
+    }
+
     /**
      * Check for agent update
      * POST /api/agent/update/check
@@ -603,10 +1025,15 @@ final class AgentGatewayController extends BaseController
      * Renew agent certificate
      * POST /api/agent/certificate/renew
      *
+     * The agent generates the new key itself and sends a CSR for it, signed with the
+     * key of its current certificate. Only the certificate is returned.
+     *
      * Request body:
      * {
      *   "agent_uuid": "...",
-     *   "agent_name": "..."
+     *   "agent_name": "...",
+     *   "csr": "-----BEGIN CERTIFICATE REQUEST-----...",
+     *   "csr_signature": "base64 SHA-256 signature of csr by the current key"
      * }
      */
     public function renewCertificate(): void
@@ -626,9 +1053,15 @@ final class AgentGatewayController extends BaseController
             return;
         }
 
+        $csr = $data['csr'] ?? null;
+        $signature = is_string($data['csr_signature'] ?? null) ? base64_decode($data['csr_signature'], true) : false;
+        if (!is_string($csr) || $csr === '' || $signature === false || $signature === '') {
+            $this->error('csr and csr_signature are required', 400, 'CSR_REQUIRED');
+            return;
+        }
+
         try {
-            // Renew certificate using CertificateManager
-            $certificates = $this->certManager->renewAgentCertificate($agentUuid, $agentName);
+            $certificates = $this->certManager->signAgentCSR($agentUuid, $agentName, $csr, $signature);
 
             // Get expiry date
             $expiry = $this->certManager->getAgentCertificateExpiry($agentUuid);
@@ -637,11 +1070,13 @@ final class AgentGatewayController extends BaseController
 
             $this->success([
                 'cert' => base64_encode($certificates['cert']),
-                'key' => base64_encode($certificates['key']),
                 'ca' => base64_encode($certificates['ca']),
                 'expires_at' => $expiry?->format('Y-m-d H:i:s') ?? 'unknown',
             ], 'Certificate renewed successfully');
 
+        } catch (\InvalidArgumentException $e) {
+            $this->logger->warning("Certificate renewal refused for agent {$agentName} ({$agentUuid}): {$e->getMessage()}", 'AGENT_API');
+            $this->error('Certificate renewal refused: ' . $e->getMessage(), 400, 'INVALID_CSR');
         } catch (\Exception $e) {
             $this->logger->error("Certificate renewal failed: {$e->getMessage()}", 'AGENT_API');
             $this->error('Certificate renewal failed: ' . $e->getMessage(), 500, 'RENEWAL_FAILED');
@@ -701,6 +1136,10 @@ final class AgentGatewayController extends BaseController
      *   "total_memory_mb": 16384,
      *   "agent_version": "2.3.0"
      * }
+     *
+     * The enroll subcommand of the agent generates its keys itself and also sends
+     * "uuid", "ssh_public_key" and "csr" (CN = agent-{uuid}): no private key is then
+     * generated nor returned, and an agent token is issued with the certificate.
      */
     public function registerWithToken(): void
     {
@@ -726,12 +1165,37 @@ final class AgentGatewayController extends BaseController
             return;
         }
 
+        // Keys generated on the agent (enroll subcommand)
+        $csr = $data['csr'] ?? null;
+        if ($csr !== null) {
+            $this->validateRequired($data, ['uuid', 'ssh_public_key']);
+            if (!preg_match('/^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/', $data['uuid'])) {
+                $this->error('Invalid agent UUID', 400, 'INVALID_UUID');
+                return;
+            }
+            if ($this->agentRepo->findByUuid($data['uuid']) !== null) {
+                $this->error('Agent with this UUID already exists', 409, 'AGENT_EXISTS');
+                return;
+            }
+        }
+
         try {
-            // Generate UUID
-            $uuid = $this->generateUuid();
+            if ($csr !== null) {
+                $uuid = $data['uuid'];
+                $sshKeyPair = ['public' => trim($data['ssh_public_key']), 'private' => null];
+            } else {
+                // Generate UUID
+                $uuid = $this->generateUuid();
+
+                // Generate SSH key pair for the agent
+                $sshKeyPair = $this->generateSSHKeyPair();
+            }
 
-            // Generate SSH key pair for the agent
-            $sshKeyPair = $this->generateSSHKeyPair();
+            // mTLS certificate, from the agent CSR when it sent one (checked before
+            // anything is registered)
+            $certificates = $csr !== null
+                ? $this->certManager->issueAgentCertificateFromCSR($uuid, $name, $csr)
+                : $this->certManager->generateAgentCertificate($uuid, $name);
 
             // Register agent with generated SSH key
             $sshConfig = $this->agentManager->registerAgent(
@@ -741,9 +1205,6 @@ final class AgentGatewayController extends BaseController
                 true // append-only by default
             );
 
-            // Generate mTLS certificate
-            $certificates = $this->certManager->generateAgentCertificate($uuid, $name);
-
             // Create database record
             $agentId = $this->agentRepo->create(
                 uuid: $uuid,
@@ -777,18 +1238,27 @@ final class AgentGatewayController extends BaseController
 
             $this->logger->info("Agent registered via token: {$name} ({$uuid}) - OS: {$os}", 'AGENT_API');
 
-            $this->success([
+            $response = [
                 'uuid' => $uuid,
                 'borg_host' => $_SERVER['SERVER_NAME'] ?? 'localhost',
                 'borg_port' => $sshConfig['ssh_port'],
                 'borg_user' => $sshConfig['ssh_user'],
                 'backup_path' => $sshConfig['backup_path'],
-                'ssh_private_key' => $sshKeyPair['private'],
                 'tls_cert' => $certificates['cert'],
-                'tls_key' => $certificates['key'],
                 'ca_cert' => $certificates['ca'],
-            ], 'Agent registered successfully', 201);
+            ];
+            if ($csr !== null) {
+                $response += $this->tokenService->issueAgentToken($uuid);
+            } else {
+                $response['ssh_private_key'] = $sshKeyPair['private'];
+                $response['tls_key'] = $certificates['key'];
+            }
+
+            $this->success($response, 'Agent registered successfully', 201);
 
+        } catch (\InvalidArgumentException $e) {
+            $this->logger->warning("Agent registration refused: {$e->getMessage()}", 'AGENT_API');
+            $this->error($e->getMessage(), 400, 'INVALID_CSR');
         } catch (\Exception $e) {
             $this->logger->error("Agent registration failed: {$e->getMessage()}", 'AGENT_API');
             $this->error('Registration failed: ' . $e->getMessage(), 500);
@@ -6,6 +6,7 @@ namespace PhpBorg\Api\Controller;
 
 use PhpBorg\Application;
 use PhpBorg\Exception\PhpBorgException;
+use PhpBorg\Repository\AgentTaskRepository;
 use PhpBorg\Service\Queue\JobQueue;
 
 /**
@@ -14,10 +15,12 @@ use PhpBorg\Service\Queue\JobQueue;
 class JobController extends BaseController
 {
     private readonly JobQueue $jobQueue;
+    private readonly AgentTaskRepository $agentTaskRepo;
 
     public function __construct(Application $app)
     {
         $this->jobQueue = $app->getJobQueue();
+        $this->agentTaskRepo = $app->getAgentTaskRepository();
     }
 
     /**
@@ -159,6 +162,39 @@ class JobController extends BaseController
         }
     }
 
+    /**
+     * GET /api/jobs/:id/agent-log?after=<seq>
+     * Get the live log streamed by the agent running the job (latest agent task of
+     * the job), from the entry after the given seq
+     */
+    public function agentLog(): void
+    {
+        try {
+            $jobId = (int) ($_SERVER['ROUTE_PARAMS']['id'] ?? 0);
+
+            if ($jobId <= 0) {
+                $this->error('Invalid job ID', 400, 'INVALID_JOB_ID');
+                return;
+            }
+
+            $tasks = $this->agentTaskRepo->findByJobId($jobId);
+            if (empty($tasks)) {
+                $this->success(['entries' => [], 'agent_task_id' => null]);
+                return;
+            }
+
+            $task = end($tasks);
+            $after = max(0, (int) ($_GET['after'] ?? 0));
+
+            $this->success([
+                'entries' => $this->agentTaskRepo->findLogs((int) $task['id'], $after),
+                'agent_task_id' => (int) $task['id'],
+            ]);
+        } catch (PhpBorgException $e) {
+            $this->error($e->getMessage(), 500, 'AGENT_LOG_ERROR');
+        }
+    }
+
     /**
      * GET /api/jobs/stats
      * Get queue statistics
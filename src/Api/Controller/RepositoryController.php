@@ -169,6 +169,7 @@ final class RepositoryController extends BaseController
                 'backup_path' => $repository->backupPath,
                 'exclude' => $repository->exclude,
                 'one_file_system' => $repository->oneFileSystem,
+                'backup_hooks' => $repository->getBackupHooks(),
                 'repo_path' => $repository->repoPath,
                 // Retention policy
                 'retention' => [
@@ -268,10 +269,11 @@ final class RepositoryController extends BaseController
 
     /**
      * Update a repository's backup source configuration (Bug 16 + Bug 17):
-     * source paths (backup_path, CSV), exclude patterns (CSV), one-file-system flag.
+     * source paths (backup_path, CSV), exclude patterns (CSV), one-file-system flag,
+     * agent backup hooks.
      * PUT /api/repositories/{id}/backup-config
      *
-     * Body: { backup_path?, exclude?, one_file_system? } — omitted fields unchanged.
+     * Body: { backup_path?, exclude?, one_file_system?, backup_hooks? } — omitted fields unchanged.
      */
     public function updateBackupConfig(): void
     {
@@ -311,7 +313,17 @@ final class RepositoryController extends BaseController
                 return;
             }
 
-            $this->repositoryRepo->updateBackupConfig($id, $backupPath, $exclude, $oneFileSystem);
+            $backupHooks = null;
+            if (array_key_exists('backup_hooks', $data)) {
+                try {
+                    $backupHooks = $this->normaliseBackupHooks($data['backup_hooks']);
+                } catch (\InvalidArgumentException $e) {
+                    $this->error($e->getMessage(), 400, 'INVALID_BACKUP_HOOKS');
+                    return;
+                }
+            }
+
+            $this->repositoryRepo->updateBackupConfig($id, $backupPath, $exclude, $oneFileSystem, $backupHooks);
 
             $updated = $this->repositoryRepo->findById($id);
             $this->success([
@@ -320,12 +332,77 @@ final class RepositoryController extends BaseController
                 'exclude' => $updated->exclude,
                 'exclusion_patterns' => $updated->getExclusionPatterns(),
                 'one_file_system' => $updated->oneFileSystem,
+                'backup_hooks' => $updated->getBackupHooks(),
             ], 'Backup configuration updated');
         } catch (\Exception $e) {
             $this->error($e->getMessage(), 500, 'UPDATE_BACKUP_CONFIG_FAILED');
         }
     }
 
+    /**
+     * Validate agent backup hooks the way the agent decodes them (BackupHook in
+     * agent/internal/task/payload.go), so a bad hook is refused here rather than
+     * failing every backup of the repository
+     *
+     * @return array<int, array<string, mixed>>
+     * @throws \InvalidArgumentException
+     */
+    private function normaliseBackupHooks(mixed $hooks): array
+    {
+        if ($hooks === null || $hooks === '') {
+            return [];
+        }
+        if (!is_array($hooks) || !array_is_list($hooks)) {
+            throw new \InvalidArgumentException('backup_hooks must be a list');
+        }
+
+        $normalised = [];
+        foreach ($hooks as $i => $hook) {
+            if (!is_array($hook)) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}] must be an object");
+            }
+            $unknown = array_diff(array_keys($hook), ['name', 'stage', 'args', 'timeout_seconds', 'on_error']);
+            if ($unknown !== []) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}]: unknown field " . implode(', ', $unknown));
+            }
+
+            $name = $hook['name'] ?? '';
+            if (!is_string($name) || !preg_match('/^[A-Za-z0-9_][A-Za-z0-9._-]*$/', $name)) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}].name must be a file name of the agent hook directory");
+            }
+            $stage = $hook['stage'] ?? '';
+            if (!in_array($stage, ['pre', 'post', 'on_failure'], true)) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}].stage must be pre, post or on_failure");
+            }
+            $args = $hook['args'] ?? [];
+            if (!is_array($args) || !array_is_list($args) || array_filter($args, fn($a) => !is_string($a)) !== []) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}].args must be a list of strings");
+            }
+            $timeout = $hook['timeout_seconds'] ?? 0;
+            if (!is_int($timeout) || $timeout < 0) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}].timeout_seconds must be a positive integer (0 = agent default)");
+            }
+            $onError = $hook['on_error'] ?? '';
+            if (!in_array($onError, ['', 'abort', 'warn', 'continue'], true)) {
+                throw new \InvalidArgumentException("backup_hooks[{$i}].on_error must be abort, warn or continue");
+            }
+
+            $entry = ['name' => $name, 'stage' => $stage];
+            if ($args !== []) {
+                $entry['args'] = $args;
+            }
+            if ($timeout > 0) {
+                $entry['timeout_seconds'] = $timeout;
+            }
+            if ($onError !== '') {
+                $entry['on_error'] = $onError;
+            }
+            $normalised[] = $entry;
+        }
+
+        return $normalised;
+    }
+
     /**
      * Refresh/backfill archive size stats from borg (Bug 29).
      * POST /api/repositories/{id}/refresh-stats
@@ -151,7 +151,7 @@ class ServerController extends BaseController
                     'created_at' => $server->createdAt?->format('Y-m-d H:i:s'),
                     'updated_at' => $server->updatedAt?->format('Y-m-d H:i:s'),
                     // Agent information
-                    'agent' => $this->formatAgentInfo($server),
+                    'agent' => $this->formatAgentInfo($server, true),
                 ],
                 'repositories' => array_map(fn($repo) => [
                     'id' => $repo->id,
@@ -763,9 +763,10 @@ class ServerController extends BaseController
      * Format agent information for API response
      *
      * @param \PhpBorg\Entity\Server $server
+     * @param bool $withClockSkew Also return the clock skew the agent reported (one more query)
      * @return array|null
      */
-    private function formatAgentInfo($server): ?array
+    private function formatAgentInfo($server, bool $withClockSkew = false): ?array
     {
         // Return null if server doesn't use agent
         if ($server->connectionMode !== 'agent') {
@@ -801,7 +802,7 @@ class ServerController extends BaseController
             $needsUpdate = version_compare($server->agentVersion, $latestVersion, '<');
         }
 
-        return [
+        $info = [
             'uuid' => $server->agentUuid,
             'status' => $server->agentStatus,
             'status_label' => $server->getAgentStatusLabel(),
@@ -813,6 +814,14 @@ class ServerController extends BaseController
             'last_seen_ago' => $lastSeenAgo,
             'connection_mode' => $server->connectionMode,
         ];
+
+        if ($withClockSkew) {
+            // Server clock minus agent clock, in seconds (null = not reported yet)
+            $agent = $server->agentUuid ? $this->agentRepository->findByUuid($server->agentUuid) : null;
+            $info['clock_skew_seconds'] = isset($agent['clock_skew_seconds']) ? (float)$agent['clock_skew_seconds'] : null;
+        }
+
+        return $info;
     }
 
     /**
@@ -1079,7 +1088,7 @@ class ServerController extends BaseController
                     'active' => $server->active,
                     'created_at' => $server->createdAt?->format('Y-m-d H:i:s'),
                     'updated_at' => $server->updatedAt?->format('Y-m-d H:i:s'),
-                    'agent' => $this->formatAgentInfo($server),
+                    'agent' => $this->formatAgentInfo($server, true),
                 ],
                 'system' => $latestStats ? [
                     'os' => [
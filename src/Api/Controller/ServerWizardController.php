@@ -41,7 +41,8 @@ class ServerWizardController extends BaseController
         $this->agentInstallService = new AgentInstallService(
             $app->getServerRepository(),
             $app->getAgentRepository(),
-            $app->getSettingRepository()
+            $app->getSettingRepository(),
+            $app->getAgentTokenService()
         );
         $this->agentManager = $app->getAgentManager();
         $this->certManager = $app->getCertificateManager();
@@ -46,6 +46,8 @@ use PhpBorg\Service\Server\ServerStatsComputer;
 use PhpBorg\Service\Server\SshExecutor;
 use PhpBorg\Service\Setup\SetupService;
 use PhpBorg\Service\Agent\AgentManager;
+use PhpBorg\Service\Agent\AgentScheduleService;
+use PhpBorg\Service\Agent\AgentTokenService;
 use PhpBorg\Service\Agent\CertificateManager;
 use Symfony\Component\Dotenv\Dotenv;
 
@@ -550,6 +552,34 @@ final class Application
         );
     }
 
+    public function getAgentScheduleService(): AgentScheduleService
+    {
+        return $this->getService(AgentScheduleService::class, fn() =>
+            new AgentScheduleService(
+                $this->connection,
+                $this->getBackupJobRepository(),
+                $this->getBorgRepositoryRepository(),
+                $this->getServerRepository(),
+                $this->getArchiveRepository(),
+                $this->getAgentTaskRepository(),
+                $this->getSettingRepository(),
+                $this->getJobQueue(),
+                $this->getBackupNotificationService(),
+                $this->logger
+            )
+        );
+    }
+
+    public function getAgentTokenService(): AgentTokenService
+    {
+        return $this->getService(AgentTokenService::class, fn() =>
+            new AgentTokenService(
+                $this->config,
+                $this->connection
+            )
+        );
+    }
+
     public function getCertificateManager(): CertificateManager
     {
         return $this->getService(CertificateManager::class, fn() =>
@@ -7,6 +7,7 @@ namespace PhpBorg\Command;
 use PhpBorg\Application;
 use PhpBorg\Service\Queue\Handlers\ArchiveDeleteHandler;
 use PhpBorg\Service\Queue\Handlers\RefreshArchiveStatsHandler;
+use PhpBorg\Service\Queue\Handlers\SyncArchivesHandler;
 use PhpBorg\Service\Queue\Handlers\ArchiveMountHandler;
 use PhpBorg\Service\Queue\Handlers\ArchiveRestoreHandler;
 use PhpBorg\Service\Queue\Handlers\BackupCreateHandler;
@@ -134,6 +135,9 @@ final class WorkerStartCommand extends Command
         // Bug 29: refresh/backfill archive size stats from borg info (async)
         $worker->registerHandler('refresh_archive_stats', new RefreshArchiveStatsHandler($this->app));
 
+        // Import archives created by an agent while the server was unreachable
+        $worker->registerHandler('sync_archives', new SyncArchivesHandler($this->app));
+
         $worker->registerHandler('archive_mount', new ArchiveMountHandler(
             $this->app->getBorgExecutor(),
             $this->app->getArchiveRepository(),
@@ -35,6 +35,7 @@ final readonly class BorgRepository
         public int $totalChunks,
         public DateTimeImmutable $modified,
         public bool $oneFileSystem = false,
+        public ?string $backupHooks = null,
     ) {
     }
 
@@ -69,6 +70,7 @@ final readonly class BorgRepository
             totalChunks: (int)($row['ttchunks'] ?? 0),
             modified: new DateTimeImmutable($row['modified']),
             oneFileSystem: (bool)($row['one_file_system'] ?? false),
+            backupHooks: isset($row['backup_hooks']) && $row['backup_hooks'] !== '' ? (string)$row['backup_hooks'] : null,
         );
     }
 
@@ -95,6 +97,20 @@ final readonly class BorgRepository
         return array_map('trim', explode(',', $this->exclude));
     }
 
+    /**
+     * Get the agent backup hooks (the `hooks` of the backup_create payload)
+     *
+     * @return array<int, array<string, mixed>>
+     */
+    public function getBackupHooks(): array
+    {
+        if ($this->backupHooks === null) {
+            return [];
+        }
+        $hooks = json_decode($this->backupHooks, true);
+        return is_array($hooks) ? array_values($hooks) : [];
+    }
+
     /**
      * Convert to array for API response
      */
@@ -119,6 +135,7 @@ final readonly class BorgRepository
             'exclude' => $this->exclude,
             'exclusion_patterns' => $this->getExclusionPatterns(),
             'one_file_system' => $this->oneFileSystem,
+            'backup_hooks' => $this->getBackupHooks(),
             'size' => $this->size,
             'compressed_size' => $this->compressedSize,
             'deduplicated_size' => $this->deduplicatedSize,
@@ -202,6 +202,17 @@ final class AgentRepository
         );
     }
 
+    /**
+     * Stop accepting the agent UUID as bearer (the agent enrolled with a token)
+     */
+    public function clearLegacyUuidAuth(int $id): void
+    {
+        $this->connection->executeUpdate(
+            'UPDATE agents SET legacy_uuid_auth = 0, updated_at = NOW() WHERE id = ?',
+            [$id]
+        );
+    }
+
     /**
      * Update capabilities
      */
@@ -213,6 +224,41 @@ final class AgentRepository
         );
     }
 
+    /**
+     * Update the task types the agent advertises
+     *
+     * @param string[] $taskTypes
+     */
+    public function updateTaskTypes(int $id, array $taskTypes): void
+    {
+        $this->connection->executeUpdate(
+            'UPDATE agents SET task_types = ?, updated_at = NOW() WHERE id = ?',
+            [json_encode(array_values($taskTypes)), $id]
+        );
+    }
+
+    /**
+     * Update the API endpoint and borg SSH host the agent reports using
+     */
+    public function updateEndpoints(int $id, ?string $apiEndpoint, ?string $borgHost): void
+    {
+        $this->connection->executeUpdate(
+            'UPDATE agents SET api_endpoint = ?, borg_host = ?, updated_at = NOW() WHERE id = ?',
+            [$apiEndpoint, $borgHost, $id]
+        );
+    }
+
+    /**
+     * Update the clock skew reported by the agent (server minus agent, seconds)
+     */
+    public function updateClockSkew(int $id, float $skewSeconds): void
+    {
+        $this->connection->executeUpdate(
+            'UPDATE agents SET clock_skew_seconds = ?, updated_at = NOW() WHERE id = ?',
+            [round($skewSeconds, 1), $id]
+        );
+    }
+
     /**
      * Update OS info
      */
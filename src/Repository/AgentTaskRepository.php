@@ -117,6 +117,59 @@ final class AgentTaskRepository
         return $this->connection->getLastInsertId();
     }
 
+    /**
+     * Find the task recording an offline run of an agent
+     */
+    public function findByOfflineRunId(int $agentId, string $offlineRunId): ?array
+    {
+        return $this->connection->fetchOne(
+            'SELECT * FROM agent_tasks WHERE agent_id = ? AND offline_run_id = ?',
+            [$agentId, $offlineRunId]
+        );
+    }
+
+    /**
+     * Record a backup the agent ran on its own while the server was unreachable, as a
+     * finished task
+     *
+     * @param string $status completed or failed
+     */
+    public function createOfflineRun(
+        int $agentId,
+        string $offlineRunId,
+        array $payload,
+        string $status,
+        ?array $result,
+        ?string $error,
+        int $exitCode,
+        string $startedAt,
+        string $completedAt
+    ): int {
+        $this->connection->executeUpdate(
+            'INSERT INTO agent_tasks
+             (agent_id, offline_run_id, type, priority, payload, status, progress, started_at, completed_at,
+              result, error, exit_code, created_at)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)',
+            [
+                $agentId,
+                $offlineRunId,
+                'backup_create',
+                'normal',
+                json_encode($payload),
+                $status,
+                $status === 'completed' ? 100 : 0,
+                $startedAt,
+                $completedAt,
+                $result !== null ? json_encode($result) : null,
+                $error,
+                $exitCode,
+                $startedAt,
+            ]
+        );
+
+        return $this->connection->getLastInsertId();
+    }
+
     /**
      * Assign task to agent (mark as assigned)
      */
@@ -133,16 +186,33 @@ final class AgentTaskRepository
     }
 
     /**
-     * Mark task as running
+     * Mark task as running, optionally under an agent lease of $leaseSeconds
      */
-    public function markRunning(int $taskId): void
+    public function markRunning(int $taskId, ?int $leaseSeconds = null): void
     {
         $this->connection->executeUpdate(
             "UPDATE agent_tasks
-             SET status = 'running', started_at = NOW()
+             SET status = 'running', started_at = NOW(),
+                 lease_expires_at = IF(? IS NULL, NULL, DATE_ADD(NOW(), INTERVAL ? SECOND))
              WHERE id = ?",
-            [$taskId]
+            [$leaseSeconds, $leaseSeconds, $taskId]
+        );
+    }
+
+    /**
+     * Renew the agent lease on a running task. Returns false when the task is no longer
+     * running (lease lost: failed by the watchdog, completed, cancelled...).
+     */
+    public function renewLease(int $taskId, int $leaseSeconds): bool
+    {
+        $affected = $this->connection->executeUpdate(
+            "UPDATE agent_tasks
+             SET lease_expires_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+             WHERE id = ? AND status = 'running'",
+            [$leaseSeconds, $taskId]
         );
+
+        return $affected > 0;
     }
 
     /**
@@ -169,7 +239,8 @@ final class AgentTaskRepository
     /**
      * Bug 26 watchdog: running tasks whose agent has gone silent — no progress update for
      * `staleSeconds` — i.e. the agent was killed and cannot report the failure itself.
-     * Uses started_at as the baseline until the first progress arrives.
+     * Uses started_at as the baseline until the first progress arrives. A task whose
+     * agent lease expired is stuck as well.
      *
      * @return array<int, array<string, mixed>>
      */
@@ -178,7 +249,10 @@ final class AgentTaskRepository
         return $this->connection->fetchAll(
             "SELECT * FROM agent_tasks
              WHERE status = 'running'
-             AND TIMESTAMPDIFF(SECOND, COALESCE(progress_updated_at, started_at, assigned_at), NOW()) > ?",
+             AND (
+               TIMESTAMPDIFF(SECOND, COALESCE(progress_updated_at, started_at, assigned_at), NOW()) > ?
+               OR lease_expires_at < NOW()
+             )",
             [$staleSeconds]
         );
     }
@@ -268,6 +342,27 @@ final class AgentTaskRepository
         );
     }
 
+    /**
+     * Cancel the backup_create tasks of a backup job the agent has not started yet,
+     * created at or after $createdAfter. $reason is stored in the error column.
+     *
+     * @return int number of tasks cancelled
+     */
+    public function cancelPendingBackupsForJob(int $agentId, int $backupJobId, string $createdAfter, string $reason): int
+    {
+        return $this->connection->executeUpdate(
+            "UPDATE agent_tasks
+             SET status = 'cancelled', completed_at = NOW(), error = ?
+             WHERE agent_id = ?
+             AND type = 'backup_create'
+             AND status IN ('pending', 'assigned')
+             AND offline_run_id IS NULL
+             AND CAST(JSON_EXTRACT(payload, '$.backup_job_id') AS UNSIGNED) = ?
+             AND created_at >= ?",
+            [$reason, $agentId, $backupJobId, $createdAfter]
+        );
+    }
+
     /**
      * Find timed out tasks (running tasks that exceeded timeout)
      */
@@ -338,6 +433,49 @@ final class AgentTaskRepository
         return $stats;
     }
 
+    /**
+     * Append log entries of a task. Entries whose seq is already stored (retried
+     * batch) are ignored.
+     *
+     * @param array<array{seq: int, time: string, level: string, source: string, message: string}> $entries
+     * @return int Number of entries stored
+     */
+    public function appendLogs(int $taskId, array $entries): int
+    {
+        $stored = 0;
+        foreach ($entries as $entry) {
+            $stored += $this->connection->executeUpdate(
+                'INSERT IGNORE INTO agent_task_logs
+                 (agent_task_id, seq, logged_at, level, source, message)
+                 VALUES (?, ?, ?, ?, ?, ?)',
+                [
+                    $taskId,
+                    $entry['seq'],
+                    $entry['time'],
+                    $entry['level'],
+                    $entry['source'],
+                    $entry['message'],
+                ]
+            );
+        }
+
+        return $stored;
+    }
+
+    /**
+     * Find the log entries of a task after a given seq, in order
+     */
+    public function findLogs(int $taskId, int $afterSeq = 0, int $limit = 1000): array
+    {
+        return $this->connection->fetchAll(
+            'SELECT seq, logged_at, level, source, message FROM agent_task_logs
+             WHERE agent_task_id = ? AND seq > ?
+             ORDER BY seq
+             LIMIT ?',
+            [$taskId, $afterSeq, $limit]
+        );
+    }
+
     /**
      * Delete old completed/failed tasks
      */
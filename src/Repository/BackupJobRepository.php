@@ -217,6 +217,62 @@ final class BackupJobRepository
         );
     }
 
+    /**
+     * Find the enabled scheduled jobs of the servers managed by an agent
+     *
+     * @return array<int, BackupJob>
+     * @throws DatabaseException
+     */
+    public function findScheduledForAgent(string $agentUuid): array
+    {
+        $rows = $this->connection->fetchAll(
+            "SELECT bj.* FROM backup_jobs bj
+             JOIN repository r ON r.id = bj.repository_id
+             JOIN servers s ON s.id = r.server_id
+             WHERE s.agent_uuid = ?
+             AND bj.enabled = 1
+             AND bj.schedule_type != 'manual'
+             ORDER BY bj.id",
+            [$agentUuid]
+        );
+
+        return array_map(fn(array $row) => BackupJob::fromDatabase($row), $rows);
+    }
+
+    /**
+     * Update job after a run the agent made on its own while the server was
+     * unreachable. last_run_at only moves forward: runs may be uploaded out of order,
+     * or after the server ran the job again.
+     *
+     * @throws DatabaseException
+     */
+    public function updateAfterOfflineRun(int $id, DateTimeImmutable $ranAt, string $status): void
+    {
+        $job = $this->findById($id);
+        if (!$job || ($job->lastRunAt !== null && $job->lastRunAt >= $ranAt)) {
+            return;
+        }
+
+        $nextRunAt = $this->calculateNextRun(
+            $job->scheduleType,
+            $job->scheduleTime,
+            $job->scheduleDayOfWeek,
+            $job->scheduleDayOfMonth,
+            $job->cronExpression
+        );
+
+        $this->connection->executeUpdate(
+            'UPDATE backup_jobs SET
+                last_run_at = ?,
+                next_run_at = ?,
+                last_status = ?,
+                total_runs = total_runs + 1,
+                updated_at = NOW()
+             WHERE id = ?',
+            [$ranAt->format('Y-m-d H:i:s'), $nextRunAt, $status, $id]
+        );
+    }
+
     /**
      * Delete backup job
      *
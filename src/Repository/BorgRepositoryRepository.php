@@ -166,16 +166,19 @@ final class BorgRepositoryRepository
 
     /**
      * Update a repository's backup source configuration (Bug 16 + Bug 17):
-     * the source paths (backup_path, CSV), exclude patterns (CSV) and the
-     * one-file-system flag. Any argument left null is left unchanged.
+     * the source paths (backup_path, CSV), exclude patterns (CSV), the
+     * one-file-system flag and the agent backup hooks (an empty list removes them).
+     * Any argument left null is left unchanged.
      *
+     * @param array<int, array<string, mixed>>|null $backupHooks
      * @throws DatabaseException
      */
     public function updateBackupConfig(
         int $id,
         ?string $backupPath = null,
         ?string $exclude = null,
-        ?bool $oneFileSystem = null
+        ?bool $oneFileSystem = null,
+        ?array $backupHooks = null
     ): void {
         $sets = [];
         $params = [];
@@ -192,6 +195,10 @@ final class BorgRepositoryRepository
             $sets[] = 'one_file_system = ?';
             $params[] = $oneFileSystem ? 1 : 0;
         }
+        if ($backupHooks !== null) {
+            $sets[] = 'backup_hooks = ?';
+            $params[] = $backupHooks === [] ? null : json_encode(array_values($backupHooks));
+        }
 
         if (empty($sets)) {
             return;
@@ -14,20 +14,29 @@ use PhpBorg\Repository\SettingRepository;
  */
 class AgentInstallService
 {
+    /**
+     * TimeoutStopSec of the unit: the default agent.shutdown_grace_period (5m) plus
+     * the stop margin of the agent (platform.SystemdStopMargin, 2m)
+     */
+    private const SYSTEMD_STOP_TIMEOUT = 420;
+
     private ServerRepository $serverRepo;
     private AgentRepository $agentRepo;
     private SettingRepository $settingRepo;
+    private AgentTokenService $tokenService;
     private string $phpBorgRoot;
 
     public function __construct(
         ServerRepository $serverRepo,
         AgentRepository $agentRepo,
         SettingRepository $settingRepo,
+        AgentTokenService $tokenService,
         string $phpBorgRoot = '/opt/newphpborg/phpBorg'
     ) {
         $this->serverRepo = $serverRepo;
         $this->agentRepo = $agentRepo;
         $this->settingRepo = $settingRepo;
+        $this->tokenService = $tokenService;
         $this->phpBorgRoot = $phpBorgRoot;
     }
 
@@ -78,7 +87,10 @@ class AgentInstallService
         $agentName = $tokenData['agent_name'];
         $agentUuid = $tokenData['agent_uuid'];
 
-        return $this->buildInstallScript($agentName, $agentUuid, $serverUrl, $borgSshPort, $token);
+        // Used when the agent gets no mTLS certificate: exchanged on first start for an agent token
+        $enrollmentToken = $this->tokenService->issueEnrollmentToken($agentUuid);
+
+        return $this->buildInstallScript($agentName, $agentUuid, $serverUrl, $borgSshPort, $token, $enrollmentToken);
     }
 
     /**
@@ -205,6 +217,25 @@ class AgentInstallService
         ];
     }
 
+    /**
+     * Render the agent systemd unit from the template the agent uses for its own
+     * unit (platform.SystemdUnit), for the paths of the install script. The config
+     * it writes keeps the default shutdown grace period.
+     */
+    private function renderSystemdUnit(): string
+    {
+        $template = file_get_contents(dirname(__DIR__, 3) . '/agent/internal/platform/phpborg-agent.service');
+        if ($template === false) {
+            throw new \RuntimeException('Agent systemd unit template not found');
+        }
+
+        return strtr($template, [
+            '@USER@' => 'phpborg-agent',
+            '@EXEC_START@' => '/var/lib/phpborg-agent/bin/phpborg-agent -config /etc/phpborg-agent/config.yaml',
+            '@TIMEOUT_STOP_SEC@' => (string) self::SYSTEMD_STOP_TIMEOUT,
+        ]);
+    }
+
     /**
      * Build the bash install script
      */
@@ -213,10 +244,12 @@ class AgentInstallService
         string $agentUuid,
         string $serverUrl,
         string $borgSshPort,
-        string $token
+        string $token,
+        string $enrollmentToken
     ): string {
         $callbackUrl = rtrim($serverUrl, '/') . '/api/server-wizard/agent-callback/' . $token;
         $agentBinaryUrl = rtrim($serverUrl, '/') . '/downloads/phpborg-agent';
+        $systemdUnit = $this->renderSystemdUnit();
 
         return <<<BASH
 #!/bin/bash
@@ -232,6 +265,7 @@ AGENT_UUID="{$agentUuid}"
 SERVER_URL="{$serverUrl}"
 BORG_SSH_PORT="{$borgSshPort}"
 CALLBACK_URL="{$callbackUrl}"
+ENROLLMENT_TOKEN="{$enrollmentToken}"
 AGENT_BINARY_URL="{$agentBinaryUrl}"
 
 # Paths
@@ -597,11 +631,14 @@ if [ "\$USE_MTLS" = true ]; then
   key_file: \$CERTS_DIR/agent.key
   ca_file: \$CERTS_DIR/ca.crt"
 else
-    TLS_CONFIG="# TLS not configured - using Bearer token auth
+    TLS_CONFIG="# TLS not configured - using agent token auth
 # tls:
 #   cert_file: \$CERTS_DIR/agent.crt
 #   key_file: \$CERTS_DIR/agent.key
-#   ca_file: \$CERTS_DIR/ca.crt"
+#   ca_file: \$CERTS_DIR/ca.crt
+
+auth:
+  enrollment_token: \$ENROLLMENT_TOKEN"
 fi
 
 cat > "\$CONFIG_DIR/config.yaml" << CONFIG_EOF
@@ -645,36 +682,8 @@ echo -e "  \${GREEN}✓ Configuration created\${NC}"
 echo ""
 echo -e "\${YELLOW}[9/9] Creating systemd service...\${NC}"
 
-cat > /etc/systemd/system/phpborg-agent.service << SERVICE_EOF
-[Unit]
-Description=phpBorg Agent
-Documentation=https://github.com/altzone/phpBorg
-After=network.target
-
-[Service]
-Type=simple
-User=\$AGENT_USER
-Group=\$AGENT_USER
-ExecStart=\$BIN_PATH -config \$CONFIG_DIR/config.yaml
-Restart=always
-RestartSec=10
-
-# Security hardening
-# NoNewPrivileges must be "no": borg create runs as root via sudo (Bug 31);
-# NNP=yes blocks sudo entirely ('The "no new privileges" flag is set').
-NoNewPrivileges=no
-ProtectSystem=strict
-ProtectHome=read-only
-PrivateTmp=yes
-ReadWritePaths=\$LOG_DIR
-ReadWritePaths=\$AGENT_HOME
-# Bug 22: allow the agent self-update to rewrite its own unit and sudoers file
-ReadWritePaths=/etc/systemd/system/phpborg-agent.service
-ReadWritePaths=/etc/sudoers.d/phpborg-agent
-
-[Install]
-WantedBy=multi-user.target
-SERVICE_EOF
+cat > /etc/systemd/system/phpborg-agent.service << 'SERVICE_EOF'
+{$systemdUnit}SERVICE_EOF
 
 systemctl daemon-reload
 echo -e "  \${GREEN}✓ Systemd service created\${NC}"
@@ -0,0 +1,284 @@
+<?php
+
+declare(strict_types=1);
+
+namespace PhpBorg\Service\Agent;
+
+use DateTimeImmutable;
+use PhpBorg\Database\Connection;
+use PhpBorg\Entity\BackupJob;
+use PhpBorg\Entity\BorgRepository;
+use PhpBorg\Entity\Server;
+use PhpBorg\Logger\LoggerInterface;
+use PhpBorg\Repository\AgentTaskRepository;
+use PhpBorg\Repository\ArchiveRepository;
+use PhpBorg\Repository\BackupJobRepository;
+use PhpBorg\Repository\BorgRepositoryRepository;
+use PhpBorg\Repository\ServerRepository;
+use PhpBorg\Repository\SettingRepository;
+use PhpBorg\Service\Email\BackupNotificationService;
+use PhpBorg\Service\Queue\JobQueue;
+
+/**
+ * Agent Schedule Service
+ *
+ * Syncs the backup schedule to the agents, so they can run due backups on their own
+ * while the server is unreachable, and records the runs they upload once it is back.
+ */
+final class AgentScheduleService
+{
+    private const DATABASE_TYPES = ['mysql', 'mariadb', 'postgresql', 'postgres', 'mongodb'];
+
+    public function __construct(
+        private readonly Connection $connection,
+        private readonly BackupJobRepository $jobRepo,
+        private readonly BorgRepositoryRepository $repoRepo,
+        private readonly ServerRepository $serverRepo,
+        private readonly ArchiveRepository $archiveRepo,
+        private readonly AgentTaskRepository $taskRepo,
+        private readonly SettingRepository $settingRepo,
+        private readonly JobQueue $queue,
+        private readonly BackupNotificationService $notificationService,
+        private readonly LoggerInterface $logger,
+    ) {
+    }
+
+    /**
+     * Build the schedule of an agent: its enabled scheduled jobs, each with the
+     * backup_create payload the server would send (without archive name). Passphrases
+     * are only included with $withSecrets, for agents keeping them in a secret store.
+     *
+     * @param array<string, mixed> $agent
+     * @return array<string, mixed>
+     */
+    public function buildSchedule(array $agent, bool $withSecrets, int $payloadVersion): array
+    {
+        $jobs = [];
+        foreach ($this->jobRepo->findScheduledForAgent((string)$agent['uuid']) as $job) {
+            try {
+                $jobs[] = $this->scheduledJob($job, $withSecrets);
+            } catch (\Exception $e) {
+                $this->logger->warning("Backup job #{$job->id} left out of the schedule of agent {$agent['name']}: {$e->getMessage()}", 'AGENT_API');
+            }
+        }
+
+        return [
+            'timezone' => date_default_timezone_get(),
+            'payload_version' => $payloadVersion,
+            'generated_at' => date('c'),
+            'jobs' => $jobs,
+        ];
+    }
+
+    /**
+     * Record a run the agent made on its own. Returns false when the run was already
+     * recorded (upload retried after a lost response).
+     *
+     * @param array<string, mixed> $agent
+     * @param array<string, mixed> $run
+     * @throws \InvalidArgumentException on an invalid run or a job of another agent
+     */
+    public function recordOfflineRun(array $agent, array $run): bool
+    {
+        $runId = (string)($run['run_id'] ?? '');
+        if (!preg_match('/^[A-Za-z0-9._-]{1,64}$/', $runId)) {
+            throw new \InvalidArgumentException('Invalid run_id');
+        }
+        $status = $run['status'] ?? null;
+        if (!in_array($status, ['completed', 'failed'], true)) {
+            throw new \InvalidArgumentException('status must be completed or failed');
+        }
+        $jobId = (int)($run['backup_job_id'] ?? 0);
+        $job = $this->jobRepo->findById($jobId);
+        $repository = $job ? $this->repoRepo->findById($job->repositoryId) : null;
+        $server = $repository ? $this->serverRepo->findById($repository->serverId) : null;
+        if (!$server || $server->agentUuid !== $agent['uuid']) {
+            throw new \InvalidArgumentException("Backup job #{$jobId} is not scheduled on this agent");
+        }
+
+        if ($this->taskRepo->findByOfflineRunId((int)$agent['id'], $runId)) {
+            return false;
+        }
+
+        $startedAt = $this->parseTime($run['started_at'] ?? null);
+        $finishedAt = $this->parseTime($run['finished_at'] ?? null);
+        $archiveName = (string)($run['archive_name'] ?? '');
+        $result = is_array($run['result'] ?? null) ? $run['result'] : null;
+        $error = $status === 'failed' ? (string)($run['error'] ?? 'Unknown error') : null;
+
+        $taskId = $this->taskRepo->createOfflineRun(
+            (int)$agent['id'],
+            $runId,
+            [
+                'server_id' => $server->id,
+                'repository_id' => $repository->id,
+                'backup_job_id' => $job->id,
+                'archive_name' => $archiveName,
+                'offline' => true,
+            ],
+            $status,
+            $result,
+            $error,
+            (int)($run['exit_code'] ?? 0),
+            $startedAt->format('Y-m-d H:i:s'),
+            $finishedAt->format('Y-m-d H:i:s')
+        );
+
+        $this->jobRepo->updateAfterOfflineRun($job->id, $startedAt, $status === 'completed' ? 'success' : 'failure');
+
+        if ($status === 'completed') {
+            $this->logger->info("Offline backup {$archiveName} of {$server->name} recorded as agent task #{$taskId}", 'AGENT_API');
+            // The server queued the same job while it could not reach the agent: that
+            // run is done already. A failed offline run leaves them to run as a retry.
+            // The window starts at the scheduled time the agent ran the job for (older
+            // agents do not send it: from the start of the run).
+            $windowStart = isset($run['scheduled_at']) ? $this->parseTime($run['scheduled_at']) : $startedAt;
+            $cancelled = $this->taskRepo->cancelPendingBackupsForJob(
+                (int)$agent['id'],
+                $job->id,
+                min($windowStart, $startedAt)->format('Y-m-d H:i:s'),
+                "Superseded by offline run {$runId} ({$archiveName})"
+            );
+            if ($cancelled > 0) {
+                $this->logger->info("Cancelled {$cancelled} queued backup(s) of job #{$job->id}, already run offline", 'AGENT_API');
+            }
+            // The archive exists in the repository only: import it like a sync does
+            $this->queue->push('sync_archives', [
+                'server_id' => $server->id,
+                'type' => $repository->type,
+            ], 'default');
+            $this->notify(fn() => $this->notificationService->sendSuccessNotification($job->id, $server->name, $archiveName, $result ?? []));
+        } else {
+            $this->logger->warning("Offline backup of {$server->name} failed while the server was unreachable: {$error}", 'AGENT_API');
+            $this->notify(fn() => $this->notificationService->sendFailureNotification($job->id, $server->name, "Offline backup failed: {$error}"));
+        }
+
+        return true;
+    }
+
+    /**
+     * @return array<string, mixed>
+     */
+    private function scheduledJob(BackupJob $job, bool $withSecrets): array
+    {
+        $repository = $this->repoRepo->findById($job->repositoryId);
+        if (!$repository) {
+            throw new \RuntimeException("repository #{$job->repositoryId} not found");
+        }
+        $server = $this->serverRepo->findById($repository->serverId);
+        if (!$server) {
+            throw new \RuntimeException("server #{$repository->serverId} not found");
+        }
+
+        $encrypted = strtolower(trim($repository->encryption)) !== 'none';
+        $entry = [
+            'id' => $job->id,
+            'name' => $job->name,
+            'schedule' => [
+                'type' => $job->scheduleType,
+                'time' => $job->scheduleTime,
+                'day_of_week' => $job->scheduleDayOfWeek,
+                'day_of_month' => $job->scheduleDayOfMonth,
+                'cron' => $job->cronExpression,
+            ],
+            'last_run_at' => $job->lastRunAt?->format('c'),
+            // Archives are named <type>_<date>, like the backups the server dispatches
+            'archive_prefix' => $repository->type,
+            'backup' => $this->backupPayload($server, $repository, $job),
+            'encrypted' => $encrypted,
+        ];
+        if ($withSecrets && $encrypted) {
+            $entry['passphrase'] = $repository->passphrase;
+        }
+
+        return $entry;
+    }
+
+    /**
+     * backup_create payload of a job, as BackupCreateHandler builds it, without
+     * archive name and passphrase
+     *
+     * @return array<string, mixed>
+     */
+    private function backupPayload(Server $server, BorgRepository $repository, BackupJob $job): array
+    {
+        $portSetting = $this->settingRepo->findByKey('borg_ssh_port');
+        $port = $portSetting ? (int)$portSetting->value : 2222;
+
+        $ipKey = $server->backupType === 'external' ? 'network.external_ip' : 'network.internal_ip';
+        $ipSetting = $this->settingRepo->findByKey($ipKey);
+        if (!$ipSetting || $ipSetting->value === '') {
+            throw new \RuntimeException("network IP not configured in settings ({$ipKey})");
+        }
+
+        $paths = $repository->getBackupPaths();
+        if (empty($paths)) {
+            $paths = ['/'];
+        }
+        if (in_array($repository->type, self::DATABASE_TYPES, true) && ($paths === ['/'] || $paths === [''])) {
+            $paths = [$this->databaseDatadir($server->id, $repository->type)];
+        }
+
+        $archives = $this->archiveRepo->findByRepositoryId($repository->repoId);
+
+        $payload = [
+            'repo_path' => sprintf('ssh://phpborg-borg@%s:%d%s', $ipSetting->value, $port, $repository->repoPath),
+            'paths' => $paths,
+            'excludes' => $repository->exclude ? explode(',', $repository->exclude) : [],
+            'compression' => $repository->compression ?: 'lz4',
+            'one_file_system' => $repository->oneFileSystem,
+            'allow_unencrypted' => strtolower(trim($repository->encryption)) === 'none',
+            'expected_osize' => !empty($archives) ? (int)$archives[0]->originalSize : 0,
+            'server_id' => $server->id,
+            'repository_id' => $repository->id,
+            'backup_job_id' => $job->id,
+        ];
+        // Same rule as BackupCreateHandler: hooks only when the repository has some
+        $hooks = $repository->getBackupHooks();
+        if ($hooks !== []) {
+            $payload['hooks'] = $hooks;
+        }
+
+        return $payload;
+    }
+
+    /**
+     * Data directory of a database, from the server capabilities
+     */
+    private function databaseDatadir(int $serverId, string $type): string
+    {
+        $row = $this->connection->fetchOne('SELECT capabilities_data FROM servers WHERE id = ?', [$serverId]);
+        $capabilities = $row && $row['capabilities_data'] ? json_decode($row['capabilities_data'], true) : [];
+        $capType = match ($type) {
+            'mariadb' => 'mysql',
+            'postgres' => 'postgresql',
+            default => $type,
+        };
+        foreach ($capabilities['databases'] ?? [] as $db) {
+            if (($db['type'] ?? null) === $capType && !empty($db['datadir'])) {
+                return $db['datadir'];
+            }
+        }
+        throw new \RuntimeException("{$type} datadir not found in capabilities");
+    }
+
+    private function parseTime(mixed $value): DateTimeImmutable
+    {
+        try {
+            $time = new DateTimeImmutable(is_string($value) && $value !== '' ? $value : 'now');
+        } catch (\Exception) {
+            $time = new DateTimeImmutable();
+        }
+        // Stored in the server time zone, like every other timestamp
+        return $time->setTimezone(new \DateTimeZone(date_default_timezone_get()));
+    }
+
+    private function notify(callable $send): void
+    {
+        try {
+            $send();
+        } catch (\Exception $e) {
+            $this->logger->error("Failed to send notification: {$e->getMessage()}", 'AGENT_API');
+        }
+    }
+}
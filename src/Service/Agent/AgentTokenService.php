@@ -0,0 +1,115 @@
+<?php
+
+declare(strict_types=1);
+
+namespace PhpBorg\Service\Agent;
+
+use DateTimeImmutable;
+use Firebase\JWT\ExpiredException;
+use Firebase\JWT\JWT;
+use Firebase\JWT\Key;
+use PhpBorg\Config\Configuration;
+use PhpBorg\Database\Connection;
+
+/**
+ * Agent Token Service
+ *
+ * Issues the credentials of agents without mTLS: one-time enrollment tokens, exchanged
+ * by the agent on its first start for a signed, expiring agent token that it refreshes
+ * before expiry. Agent tokens are signed with a key derived from the app secret, so
+ * they are never accepted as user tokens (and the other way round).
+ */
+final class AgentTokenService
+{
+    private const AGENT_TOKEN_LIFETIME = 86400;       // 1 day
+    private const REFRESH_GRACE = 604800;             // expired tokens refreshable for 7 days
+    private const ENROLLMENT_TOKEN_LIFETIME = 604800; // 7 days
+    private const AUDIENCE = 'phpborg-agent';
+
+    public function __construct(
+        private readonly Configuration $config,
+        private readonly Connection $connection,
+    ) {
+    }
+
+    /**
+     * Create a one-time enrollment token for an agent. Only its hash is stored.
+     */
+    public function issueEnrollmentToken(string $agentUuid): string
+    {
+        $token = bin2hex(random_bytes(32));
+        $this->connection->executeUpdate(
+            'INSERT INTO agent_enrollment_tokens (agent_uuid, token_hash, expires_at) VALUES (?, ?, ?)',
+            [$agentUuid, hash('sha256', $token), date('Y-m-d H:i:s', time() + self::ENROLLMENT_TOKEN_LIFETIME)]
+        );
+
+        return $token;
+    }
+
+    /**
+     * Consume an enrollment token of the agent. False when it is unknown, expired,
+     * already used or issued for another agent.
+     */
+    public function consumeEnrollmentToken(string $token, string $agentUuid): bool
+    {
+        return $this->connection->executeUpdate(
+            'UPDATE agent_enrollment_tokens SET used_at = NOW()
+             WHERE token_hash = ? AND agent_uuid = ? AND used_at IS NULL AND expires_at > NOW()',
+            [hash('sha256', $token), $agentUuid]
+        ) === 1;
+    }
+
+    /**
+     * Issue an agent token
+     *
+     * @return array{token: string, expires_at: string}
+     */
+    public function issueAgentToken(string $agentUuid): array
+    {
+        $now = new DateTimeImmutable();
+        $exp = $now->getTimestamp() + self::AGENT_TOKEN_LIFETIME;
+
+        $token = JWT::encode([
+            'iss' => 'phpborg',
+            'aud' => self::AUDIENCE,
+            'iat' => $now->getTimestamp(),
+            'exp' => $exp,
+            'sub' => $agentUuid,
+        ], $this->signingKey(), 'HS256');
+
+        return [
+            'token' => $token,
+            'expires_at' => date('c', $exp),
+        ];
+    }
+
+    /**
+     * UUID of the agent a token was issued to, or null when the token is invalid or
+     * expired. With $forRefresh, a token expired less than REFRESH_GRACE ago is
+     * accepted (an agent that was down for a while can still get a new one).
+     */
+    public function validateAgentToken(string $token, bool $forRefresh = false): ?string
+    {
+        try {
+            $payload = (array)JWT::decode($token, new Key($this->signingKey(), 'HS256'));
+        } catch (ExpiredException $e) {
+            $payload = (array)$e->getPayload();
+            if (!$forRefresh || (int)($payload['exp'] ?? 0) < time() - self::REFRESH_GRACE) {
+                return null;
+            }
+        } catch (\Exception) {
+            return null;
+        }
+
+        if (($payload['aud'] ?? null) !== self::AUDIENCE || !is_string($payload['sub'] ?? null)) {
+            return null;
+        }
+
+        return $payload['sub'];
+    }
+
+    private function signingKey(): string
+    {
+        return hash_hmac('sha256', 'phpborg-agent-token', $this->config->appSecret);
+    }
+}
@@ -308,6 +308,115 @@ final class CertificateManager
         return $this->generateAgentCertificate($agentUuid, $agentName);
     }
 
+    /**
+     * Renew an agent certificate from a CSR for a key generated on the agent host
+     *
+     * The CSR must be signed, as raw PEM (SHA-256), by the key of the agent's current
+     * certificate, and name the agent (CN = agent-{uuid}). The new key never reaches
+     * the server; a key the server generated earlier is deleted.
+     *
+     * @return array{cert: string, ca: string}
+     * @throws \InvalidArgumentException on an invalid CSR or signature
+     */
+    public function signAgentCSR(string $agentUuid, string $agentName, string $csrPem, string $signature): array
+    {
+        $this->logger->info("Signing certificate request of agent: {$agentUuid}", 'CERT');
+
+        $this->ensureCAExists();
+        $this->ensureDirectoriesExist();
+
+        $certFile = self::AGENTS_DIR . "/{$agentUuid}.crt";
+        if (!file_exists($certFile)) {
+            throw new \InvalidArgumentException('No current certificate for this agent');
+        }
+        $currentKey = openssl_pkey_get_public(file_get_contents($certFile));
+        if ($currentKey === false || openssl_verify($csrPem, $signature, $currentKey, OPENSSL_ALGO_SHA256) !== 1) {
+            throw new \InvalidArgumentException('CSR signature does not match the current certificate');
+        }
+
+        $this->signCSR($agentUuid, $agentName, $csrPem);
+
+        $this->logger->info("Agent certificate renewed from CSR: {$agentUuid}", 'CERT');
+
+        return [
+            'cert' => file_get_contents($certFile),
+            'ca' => file_get_contents(self::CA_CERT),
+        ];
+    }
+
+    /**
+     * Issue the first certificate of an agent that generated its key itself (enroll
+     * subcommand). The CSR must name the agent (CN = agent-{uuid}).
+     *
+     * @return array{cert: string, ca: string}
+     * @throws \InvalidArgumentException on an invalid CSR
+     */
+    public function issueAgentCertificateFromCSR(string $agentUuid, string $agentName, string $csrPem): array
+    {
+        $this->logger->info("Issuing certificate from CSR for agent: {$agentName} ({$agentUuid})", 'CERT');
+
+        $this->ensureCAExists();
+        $this->ensureDirectoriesExist();
+        $this->signCSR($agentUuid, $agentName, $csrPem);
+
+        return [
+            'cert' => file_get_contents(self::AGENTS_DIR . "/{$agentUuid}.crt"),
+            'ca' => file_get_contents(self::CA_CERT),
+        ];
+    }
+
+    /**
+     * Sign a CSR of the agent into its certificate file, with the agent extensions
+     * (not those of the CSR). A key the server generated earlier is deleted.
+     *
+     * @throws \InvalidArgumentException on a CSR that does not name the agent
+     */
+    private function signCSR(string $agentUuid, string $agentName, string $csrPem): void
+    {
+        $subject = openssl_csr_get_subject($csrPem, true);
+        if (!is_array($subject) || ($subject['CN'] ?? null) !== "agent-{$agentUuid}") {
+            throw new \InvalidArgumentException("CSR common name must be agent-{$agentUuid}");
+        }
+
+        $certFile = self::AGENTS_DIR . "/{$agentUuid}.crt";
+        $csrFile = self::AGENTS_DIR . "/{$agentUuid}.csr";
+        $configFile = self::AGENTS_DIR . "/{$agentUuid}_csr.cnf";
+        $newCertFile = self::AGENTS_DIR . "/{$agentUuid}.crt.new";
+        file_put_contents($csrFile, $csrPem);
+        file_put_contents($configFile, $this->createAgentCSRConfig($agentUuid, $agentName));
+
+        try {
+            // Proof of possession of the new key
+            $this->runOpenssl(['req', '-in', $csrFile, '-verify', '-noout']);
+
+            // Sign with CA, with the agent extensions (not those of the CSR)
+            $this->runOpenssl([
+                'x509',
+                '-req',
+                '-in', $csrFile,
+                '-CA', self::CA_CERT,
+                '-CAkey', self::CA_KEY,
+                '-CAcreateserial',
+                '-out', $newCertFile,
+                '-days', (string) self::CERT_VALIDITY_DAYS,
+                '-sha256',
+                '-extfile', $configFile,
+                '-extensions', 'v3_req',
+            ]);
+        } finally {
+            @unlink($csrFile);
+            @unlink($configFile);
+        }
+
+        chmod($newCertFile, 0644);
+        rename($newCertFile, $certFile);
+
+        $keyFile = self::AGENTS_DIR . "/{$agentUuid}.key";
+        if (file_exists($keyFile)) {
+            unlink($keyFile);
+        }
+    }
+
     /**
      * List all agent certificates
      *
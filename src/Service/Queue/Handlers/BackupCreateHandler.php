@@ -532,6 +532,13 @@ final class BackupCreateHandler implements JobHandlerInterface
             'backup_job_id' => $backupJobId,
         ];
 
+        // Hooks around borg create, run by the agent from its hooks.dir. Only sent when
+        // set: agents without hook support refuse a payload with an unknown field.
+        $hooks = $repository->getBackupHooks();
+        if ($hooks !== []) {
+            $taskPayload['hooks'] = $hooks;
+        }
+
         // Bug 23: a backup of a multi-TB repo — especially the FIRST pass over hundreds
         // of millions of small files — can legitimately run for DAYS. Do NOT let it
         // inherit the generic 1h default (which killed borg mid-archive and produced a
@@ -602,6 +609,14 @@ final class BackupCreateHandler implements JobHandlerInterface
             if ($task['status'] === 'completed') {
                 $result = json_decode($task['result'] ?? '{}', true);
 
+                // The agent had already run this job on its own in the same schedule
+                // window, while it could not reach the server: nothing was backed up
+                if (!empty($result['superseded_by_offline_run'])) {
+                    $message = $result['message'] ?? 'already run by the agent offline';
+                    $queue->updateProgress($job->id, 100, $message);
+                    return "Backup for server '{$server->name}' not run: {$message}";
+                }
+
                 $queue->updateProgress($job->id, 95, "Backup completed, saving archive info...");
 
                 // Save archive to database by running borg info on the local repository
@@ -666,6 +681,14 @@ final class BackupCreateHandler implements JobHandlerInterface
                 throw new \Exception("Agent backup failed: {$error}");
             }
 
+            // Cancelled before the agent ran it, e.g. superseded by the offline run the
+            // agent made of the same job while the server could not reach it
+            if ($task['status'] === 'cancelled') {
+                $reason = $task['error'] ?: 'cancelled';
+                $queue->updateProgress($job->id, 100, "Agent task #{$taskId} cancelled: {$reason}");
+                return "Backup for server '{$server->name}' not run: agent task #{$taskId} cancelled ({$reason})";
+            }
+
             // Bug 33: MIRROR the agent's real progress instead of a fake time-based
             // percentage (min(30 + waited/maxWait*60, 90) froze at ~30 once maxWait
             // became 30 days). Single source of truth: the agent. Its rich message
@@ -0,0 +1,40 @@
+<?php
+
+declare(strict_types=1);
+
+namespace PhpBorg\Service\Queue\Handlers;
+
+use PhpBorg\Application;
+use PhpBorg\Entity\Job;
+use PhpBorg\Service\Queue\JobQueue;
+
+/**
+ * Background job that imports into the database the archives present in a borg
+ * repository but unknown to phpBorg, e.g. those an agent created on its own while the
+ * server was unreachable.
+ */
+final class SyncArchivesHandler implements JobHandlerInterface
+{
+    public function __construct(private readonly Application $app)
+    {
+    }
+
+    public function handle(Job $job, JobQueue $queue): string
+    {
+        $payload = $job->payload;
+        $serverId = isset($payload['server_id']) ? (int) $payload['server_id'] : null;
+        $type = $payload['type'] ?? null;
+
+        $queue->updateProgress($job->id, 5, 'Importing archives from borg...');
+
+        $result = $this->app->getBackupService()->syncArchivesFromBorg($serverId, $type);
+
+        $queue->updateProgress(
+            $job->id,
+            100,
+            "Imported {$result['synced']} archive(s), {$result['errors']} error(s)"
+        );
+
+        return json_encode($result);
+    }
+}
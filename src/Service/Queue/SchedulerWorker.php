@@ -123,13 +123,17 @@ final class SchedulerWorker
             foreach ($stuck as $task) {
                 $taskId = (int)$task['id'];
                 $type = $task['type'] ?? 'task';
+                $leaseExpired = !empty($task['lease_expires_at']) && strtotime($task['lease_expires_at']) < time();
+                $reason = $leaseExpired
+                    ? 'The agent stopped renewing its lease on the task'
+                    : "No progress from the agent for over {$staleSeconds}s";
                 $this->logger->warning(
-                    "Watchdog: agent {$type} task #{$taskId} has not reported progress for >{$staleSeconds}s — marking failed (agent presumed dead)",
+                    "Watchdog: agent {$type} task #{$taskId}: {$reason} — marking failed (agent presumed dead)",
                     'SCHEDULER'
                 );
                 $this->agentTaskRepository->markFailed(
                     $taskId,
-                    "No progress from the agent for over {$staleSeconds}s — agent presumed dead/killed. The backup resumes from its last checkpoint on the next run.",
+                    "{$reason} — agent presumed dead/killed. The backup resumes from its last checkpoint on the next run.",
                     137
                 );
             }